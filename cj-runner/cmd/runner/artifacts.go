@@ -0,0 +1,340 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Build products are all-or-nothing: a truncated binary is useless, so
+	// oversized products fail the request rather than setting a flag.
+	maxArtifactFileBytes  = 32 * 1024 * 1024
+	maxArtifactTotalBytes = 64 * 1024 * 1024
+
+	artifactManifestName = "manifest.json"
+	artifactMediaTar     = "application/x-tar"
+	artifactMediaZip     = "application/zip"
+)
+
+var errArtifactsTooLarge = errors.New("build products exceed the artifact size limit")
+
+// artifactEpoch pins archive timestamps so identical builds produce identical
+// archives. ZIP cannot represent dates before 1980.
+var artifactEpoch = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+type artifactFile struct {
+	path string
+	kind string
+	mode fs.FileMode
+	data []byte
+}
+
+type artifactBuild struct {
+	message runMessage
+	files   []artifactFile
+}
+
+type artifactManifest struct {
+	SchemaVersion       int                     `json:"schemaVersion"`
+	ToolchainLockSHA256 string                  `json:"toolchainLockSha256"`
+	Files               []artifactManifestEntry `json:"files"`
+}
+
+type artifactManifestEntry struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// buildProductKind classifies the compiler outputs worth returning. Sources,
+// seeded data and compiler scratch files are not build products.
+func buildProductKind(name string) (string, bool) {
+	switch {
+	case name == "main":
+		return "executable", true
+	case strings.HasSuffix(name, ".cjo"):
+		return "interface", true
+	case strings.HasSuffix(name, ".a"):
+		return "staticlib", true
+	case strings.HasSuffix(name, ".so"):
+		return "dylib", true
+	}
+	return "", false
+}
+
+func buildArtifacts(ctx context.Context, in runReq) (artifactBuild, error) {
+	srcDir, err := createRequestDirectory(in)
+	if err != nil {
+		return artifactBuild{message: runMessage{Phase: runPhaseCompile}}, err
+	}
+	defer os.RemoveAll(srcDir)
+
+	msg, err := compileRequest(ctx, srcDir, in, nextLearnerCredential())
+	if err != nil || msg.CompilerCode != 0 {
+		return artifactBuild{message: msg}, err
+	}
+	files, err := collectBuildProducts(srcDir)
+	return artifactBuild{message: msg, files: files}, err
+}
+
+// collectBuildProducts reads the build products below requestDirectory. A
+// build that ran learner code leaves the directory learner-controlled, so
+// each product is opened beneath it without following symlinks.
+func collectBuildProducts(requestDirectory string) ([]artifactFile, error) {
+	root, err := os.Open(requestDirectory)
+	if err != nil {
+		return nil, infrastructureError("open build products", err)
+	}
+	defer root.Close()
+
+	var files []artifactFile
+	total := 0
+	err = filepath.WalkDir(requestDirectory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return infrastructureError("list build products", err)
+		}
+		kind, ok := buildProductKind(entry.Name())
+		if !ok || !entry.Type().IsRegular() {
+			return nil
+		}
+		relative, err := filepath.Rel(requestDirectory, path)
+		if err != nil {
+			return infrastructureError("name build product", err)
+		}
+		file, err := openBeneath(root, relative)
+		if err != nil {
+			// The entry was replaced after it was listed.
+			return nil
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return infrastructureError("inspect build product", err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if info.Size() > maxArtifactFileBytes || total+int(info.Size()) > maxArtifactTotalBytes {
+			return errArtifactsTooLarge
+		}
+		data, err := io.ReadAll(io.LimitReader(file, maxArtifactFileBytes+1))
+		if err != nil {
+			return infrastructureError("read build product", err)
+		}
+		total += len(data)
+		if len(data) > maxArtifactFileBytes || total > maxArtifactTotalBytes {
+			return errArtifactsTooLarge
+		}
+		mode := fs.FileMode(0o644)
+		if kind == "executable" || kind == "dylib" {
+			mode = 0o755
+		}
+		files = append(files, artifactFile{path: relative, kind: kind, mode: mode, data: data})
+		return nil
+	})
+	return files, err
+}
+
+func newArtifactManifest(toolchainLockSHA256 string, files []artifactFile) artifactManifest {
+	manifest := artifactManifest{
+		SchemaVersion:       1,
+		ToolchainLockSHA256: toolchainLockSHA256,
+		Files:               make([]artifactManifestEntry, 0, len(files)),
+	}
+	for _, file := range files {
+		manifest.Files = append(manifest.Files, artifactManifestEntry{
+			Path:   file.path,
+			Kind:   file.kind,
+			Size:   len(file.data),
+			SHA256: fmt.Sprintf("%x", sha256.Sum256(file.data)),
+		})
+	}
+	return manifest
+}
+
+// negotiateArtifactMedia picks the supported archive type the Accept header
+// weights highest, the first listed on a tie. Types weighted q=0 are refused.
+// Without an Accept header, or with only a wildcard, the response is a tar
+// archive, or a ZIP archive when tar alone was refused. It returns "" when
+// the header accepts neither type.
+func negotiateArtifactMedia(r *http.Request) string {
+	values := r.Header.Values("Accept")
+	if strings.TrimSpace(strings.Join(values, "")) == "" {
+		return artifactMediaTar
+	}
+	chosen, chosenWeight := "", 0.0
+	tarRefused, zipRefused, wildcard := false, false, false
+	for _, value := range values {
+		for _, candidate := range strings.Split(value, ",") {
+			mediaType, parameters, err := mime.ParseMediaType(strings.TrimSpace(candidate))
+			if err != nil {
+				continue
+			}
+			mediaType = strings.ToLower(mediaType)
+			if mediaType != artifactMediaZip && mediaType != artifactMediaTar &&
+				mediaType != "*/*" && mediaType != "application/*" {
+				continue
+			}
+			weight := 1.0
+			if q, ok := parameters["q"]; ok {
+				weight, err = strconv.ParseFloat(q, 64)
+				if err != nil || weight < 0 || weight > 1 {
+					continue
+				}
+			}
+			switch {
+			case weight == 0:
+				tarRefused = tarRefused || mediaType == artifactMediaTar
+				zipRefused = zipRefused || mediaType == artifactMediaZip
+			case strings.HasSuffix(mediaType, "/*"):
+				wildcard = true
+			case weight > chosenWeight:
+				chosen, chosenWeight = mediaType, weight
+			}
+		}
+	}
+	switch {
+	case chosen != "":
+		return chosen
+	case tarRefused && zipRefused:
+		return ""
+	case wildcard && !tarRefused:
+		return artifactMediaTar
+	case tarRefused:
+		return artifactMediaZip
+	}
+	return ""
+}
+
+// hasRunPhaseOptions reports fields that only affect executing the program,
+// which an artifact build never does.
+func (in runReq) hasRunPhaseOptions() bool {
+	return in.Stdin != "" || in.Seccomp || in.Deterministic ||
+		len(in.RuntimeOptions) != 0 || len(in.Args) != 0 || len(in.Env) != 0 ||
+		len(in.Files) != 0 || len(in.OutputFiles) != 0 || in.RunTimeoutMs != 0 ||
+		in.OutputBudget != nil || in.Transcript
+}
+
+func (s *runnerServer) handleArtifacts(w http.ResponseWriter, r *http.Request) {
+	in, ok := s.readRunRequest(w, r)
+	if !ok {
+		return
+	}
+	if in.hasRunPhaseOptions() || (in.Mode != "" && in.Mode != runModeRun) {
+		// Other modes change or skip the build, so their products are not
+		// the program /run would execute.
+		writeError(
+			w,
+			http.StatusBadRequest,
+			"invalid_json_body",
+			"Artifact requests accept only fields that affect compilation.",
+		)
+		return
+	}
+	mediaType := negotiateArtifactMedia(r)
+	if mediaType == "" {
+		writeError(
+			w,
+			http.StatusNotAcceptable,
+			"not_acceptable",
+			fmt.Sprintf("Artifacts are available only as %s or %s.", artifactMediaTar, artifactMediaZip),
+		)
+		return
+	}
+	build, err := s.operations.buildArtifacts(r.Context(), in)
+	if errors.Is(err, errArtifactsTooLarge) {
+		writeError(
+			w,
+			http.StatusUnprocessableEntity,
+			"artifacts_too_large",
+			fmt.Sprintf("Build products exceed the %d-byte artifact limit.", maxArtifactTotalBytes),
+		)
+		return
+	}
+	if err != nil {
+		writeOperationError(w, r, err)
+		return
+	}
+	if build.message.CompilerCode != 0 {
+		// No products exist; the compile diagnostics use the /run shape.
+		writeRunMessage(w, http.StatusUnprocessableEntity, in, build.message)
+		return
+	}
+
+	manifest, err := json.MarshalIndent(
+		newArtifactManifest(s.config.toolchainLockSha256, build.files), "", "  ",
+	)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "runner_internal_error", "Runner operation failed.")
+		return
+	}
+	manifest = append(manifest, '\n')
+	extension := ".tar"
+	if mediaType == artifactMediaZip {
+		extension = ".zip"
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Content-Disposition", `attachment; filename="cangjie-artifacts`+extension+`"`)
+	w.WriteHeader(http.StatusOK)
+	// The status is committed; a failed write can only truncate the stream,
+	// which the client detects from the archive framing.
+	_ = writeArtifactArchive(w, mediaType, manifest, build.files)
+}
+
+func writeArtifactArchive(w io.Writer, mediaType string, manifest []byte, files []artifactFile) error {
+	entries := append([]artifactFile{{
+		path: artifactManifestName,
+		mode: 0o644,
+		data: manifest,
+	}}, files...)
+	if mediaType == artifactMediaZip {
+		archive := zip.NewWriter(w)
+		for _, entry := range entries {
+			header := &zip.FileHeader{Name: entry.path, Method: zip.Deflate, Modified: artifactEpoch}
+			header.SetMode(entry.mode)
+			writer, err := archive.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			if _, err := writer.Write(entry.data); err != nil {
+				return err
+			}
+		}
+		return archive.Close()
+	}
+	archive := tar.NewWriter(w)
+	for _, entry := range entries {
+		if err := archive.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     entry.path,
+			Mode:     int64(entry.mode),
+			Size:     int64(len(entry.data)),
+			ModTime:  artifactEpoch,
+			Format:   tar.FormatPAX,
+		}); err != nil {
+			return err
+		}
+		if _, err := archive.Write(entry.data); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
@@ -0,0 +1,219 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func readArtifactTar(t *testing.T, body []byte) map[string][]byte {
+	t.Helper()
+	entries := map[string][]byte{}
+	reader := tar.NewReader(bytes.NewReader(body))
+	for index := 0; ; index++ {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("read tar: %v", err)
+		}
+		if index == 0 && header.Name != artifactManifestName {
+			t.Fatalf("first entry = %q, want %q", header.Name, artifactManifestName)
+		}
+		if !header.ModTime.Equal(artifactEpoch) {
+			t.Fatalf("%s mtime = %v, want %v", header.Name, header.ModTime, artifactEpoch)
+		}
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("read tar entry: %v", err)
+		}
+		entries[header.Name] = data
+	}
+}
+
+func TestArtifactsStreamTarWithManifest(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	testHandler(testOperations()).ServeHTTP(
+		recorder,
+		runnerRequest(http.MethodPost, "/artifacts", "text/plain", "main() {}"),
+	)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d; body=%s", recorder.Code, recorder.Body.String())
+	}
+	if got := recorder.Header().Get("Content-Type"); got != artifactMediaTar {
+		t.Fatalf("Content-Type = %q, want %q", got, artifactMediaTar)
+	}
+	entries := readArtifactTar(t, recorder.Body.Bytes())
+	var manifest artifactManifest
+	if err := json.Unmarshal(entries[artifactManifestName], &manifest); err != nil {
+		t.Fatalf("decode manifest: %v", err)
+	}
+	binary := entries["main"]
+	if manifest.SchemaVersion != 1 || manifest.ToolchainLockSHA256 != testToolchainLockSHA256 ||
+		len(manifest.Files) != 1 || manifest.Files[0].Path != "main" ||
+		manifest.Files[0].Kind != "executable" || manifest.Files[0].Size != len(binary) ||
+		manifest.Files[0].SHA256 != fmt.Sprintf("%x", sha256.Sum256(binary)) {
+		t.Fatalf("manifest = %+v", manifest)
+	}
+}
+
+func TestArtifactsNegotiateZip(t *testing.T) {
+	request := runnerRequest(http.MethodPost, "/artifacts", "text/plain", "main() {}")
+	request.Header.Set("Accept", "application/json;q=0.5, application/zip")
+	recorder := httptest.NewRecorder()
+	testHandler(testOperations()).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != artifactMediaZip {
+		t.Fatalf("status = %d Content-Type = %q", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(recorder.Body.Bytes()), int64(recorder.Body.Len()))
+	if err != nil {
+		t.Fatalf("read zip: %v", err)
+	}
+	if len(archive.File) != 2 || archive.File[0].Name != artifactManifestName ||
+		archive.File[1].Name != "main" || archive.File[1].Mode().Perm() != 0o755 {
+		t.Fatalf("zip entries = %+v", archive.File)
+	}
+}
+
+func TestNegotiateArtifactMediaHonoursQualityValues(t *testing.T) {
+	for _, test := range []struct {
+		accept string
+		want   string
+	}{
+		{"", artifactMediaTar},
+		{"application/zip", artifactMediaZip},
+		{"application/zip;q=0, application/x-tar", artifactMediaTar},
+		{"application/x-tar;q=0.1, application/zip", artifactMediaZip},
+		{"application/zip;q=0.4, application/x-tar;q=0.6", artifactMediaTar},
+		{"application/x-tar, application/zip", artifactMediaTar},
+		{"application/x-tar;q=0", artifactMediaZip},
+		{"application/zip;q=high, application/x-tar;q=0.2", artifactMediaTar},
+		{"*/*", artifactMediaTar},
+		{"application/*;q=0.5, application/x-tar;q=0", artifactMediaZip},
+		{"application/x-tar;q=0, application/zip;q=0", ""},
+		{"application/json", ""},
+		{"application/x-tar;q=0, application/zip;q=0, */*", ""},
+	} {
+		request := runnerRequest(http.MethodPost, "/artifacts", "text/plain", "main() {}")
+		if test.accept != "" {
+			request.Header.Set("Accept", test.accept)
+		}
+		if got := negotiateArtifactMedia(request); got != test.want {
+			t.Errorf("Accept %q = %q, want %q", test.accept, got, test.want)
+		}
+	}
+}
+
+func TestArtifactsRefuseUnacceptableMedia(t *testing.T) {
+	for _, accept := range []string{"application/x-tar;q=0, application/zip;q=0", "application/json"} {
+		operations := testOperations()
+		operations.buildArtifacts = func(context.Context, runReq) (artifactBuild, error) {
+			t.Fatal("unacceptable request built artifacts")
+			return artifactBuild{}, nil
+		}
+		request := runnerRequest(http.MethodPost, "/artifacts", "text/plain", "main() {}")
+		request.Header.Set("Accept", accept)
+		recorder := httptest.NewRecorder()
+		testHandler(operations).ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusNotAcceptable ||
+			!bytes.Contains(recorder.Body.Bytes(), []byte(`"not_acceptable"`)) {
+			t.Fatalf("Accept %q status = %d; body=%s", accept, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestArtifactsReportCompileFailureAndLimits(t *testing.T) {
+	operations := testOperations()
+	operations.buildArtifacts = func(context.Context, runReq) (artifactBuild, error) {
+		return artifactBuild{message: runMessage{
+			Phase:          runPhaseCompile,
+			CompilerOutput: "error: expected expression",
+			CompilerCode:   1,
+		}}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(
+		recorder,
+		runnerRequest(http.MethodPost, "/artifacts", "text/plain", "main() {"),
+	)
+	var message runMessage
+	if recorder.Code != http.StatusUnprocessableEntity ||
+		json.Unmarshal(recorder.Body.Bytes(), &message) != nil ||
+		message.CompilerCode != 1 {
+		t.Fatalf("status = %d; body=%s", recorder.Code, recorder.Body.String())
+	}
+
+	operations.buildArtifacts = func(context.Context, runReq) (artifactBuild, error) {
+		return artifactBuild{}, errArtifactsTooLarge
+	}
+	recorder = httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(
+		recorder,
+		runnerRequest(http.MethodPost, "/artifacts", "text/plain", "main() {}"),
+	)
+	if recorder.Code != http.StatusUnprocessableEntity ||
+		!bytes.Contains(recorder.Body.Bytes(), []byte(`"artifacts_too_large"`)) {
+		t.Fatalf("status = %d; body=%s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestArtifactsRejectRunPhaseFields(t *testing.T) {
+	for _, body := range []string{
+		`{"code":"main() {}","stdin":"x"}`,
+		`{"code":"main() {}","args":["a"]}`,
+		`{"code":"main() {}","deterministic":true}`,
+		`{"code":"main() {}","output_files":["*.txt"]}`,
+		`{"code":"main() {}","mode":"dump","dumps":["ast"]}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(
+			recorder,
+			runnerRequest(http.MethodPost, "/artifacts", "application/json", body),
+		)
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestCollectBuildProductsSkipsSourcesAndLinks(t *testing.T) {
+	directory := t.TempDir()
+	for name, content := range map[string]string{
+		"main":       "binary",
+		"main.cj":    "main() {}",
+		"demo.cjo":   "interface",
+		"libdemo.so": "library",
+	} {
+		if err := os.WriteFile(filepath.Join(directory, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("/etc/passwd", filepath.Join(directory, "libescape.a")); err != nil {
+		t.Fatal(err)
+	}
+	files, err := collectBuildProducts(directory)
+	if err != nil {
+		t.Fatalf("collect build products: %v", err)
+	}
+	got := map[string]string{}
+	for _, file := range files {
+		got[file.path] = file.kind
+	}
+	want := map[string]string{"main": "executable", "demo.cjo": "interface", "libdemo.so": "dylib"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("build products = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,131 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	defaultBenchmarkRuns       = 5
+	defaultBenchmarkWarmupRuns = 1
+	maxBenchmarkRuns           = 20
+	maxBenchmarkWarmupRuns     = 5
+)
+
+// benchmarkArguments optimise every linked package; the measured build is
+// otherwise the one run mode would produce.
+var benchmarkArguments = []string{"-O2"}
+
+type benchmarkRequest struct {
+	Runs       int `json:"runs"`
+	WarmupRuns int `json:"warmup_runs"`
+}
+
+type benchmarkStatistics struct {
+	Min    float64 `json:"min"`
+	Median float64 `json:"median"`
+	Mean   float64 `json:"mean"`
+	Stddev float64 `json:"stddev"`
+}
+
+// benchmarkResult summarises the measured runs in milliseconds. Incomplete
+// marks a benchmark cut short by a failing run or the shared deadline; the
+// statistics then cover only the runs that finished.
+type benchmarkResult struct {
+	Runs            int                  `json:"runs"`
+	WarmupRuns      int                  `json:"warmup_runs"`
+	WallTimeMs      *benchmarkStatistics `json:"wall_time_ms,omitempty"`
+	CPUTimeMs       *benchmarkStatistics `json:"cpu_time_ms,omitempty"`
+	PeakMemoryBytes int64                `json:"peak_memory_bytes"`
+	Incomplete      bool                 `json:"incomplete,omitempty"`
+}
+
+func defaultBenchmarkRequest() benchmarkRequest {
+	return benchmarkRequest{Runs: defaultBenchmarkRuns, WarmupRuns: defaultBenchmarkWarmupRuns}
+}
+
+func parseBenchmarkRequest(benchmark benchmarkRequest) error {
+	if benchmark.Runs < 1 || benchmark.Runs > maxBenchmarkRuns {
+		return fmt.Errorf("benchmark runs must be 1-%d", maxBenchmarkRuns)
+	}
+	if benchmark.WarmupRuns < 0 || benchmark.WarmupRuns > maxBenchmarkWarmupRuns {
+		return fmt.Errorf("benchmark warmup_runs must be 0-%d", maxBenchmarkWarmupRuns)
+	}
+	return nil
+}
+
+// runBenchmark runs the program repeatedly with the same input. All
+// iterations share spec.timeout, so a benchmark never holds the response
+// longer than an ordinary run. Each iteration's timeout is what remains of
+// that shared deadline, so runProcess reports an overrun as an ordinary
+// learner timeout. The returned result is the last iteration that ran, which
+// is what the response shows as output.
+func runBenchmark(ctx context.Context, spec processSpec, benchmark benchmarkRequest) (processResult, benchmarkResult, error) {
+	deadline := time.Now().Add(spec.timeout)
+	summary := benchmarkResult{WarmupRuns: benchmark.WarmupRuns}
+	var last processResult
+	var wallTimes, cpuTimes []float64
+	for iteration := range benchmark.WarmupRuns + benchmark.Runs {
+		spec.timeout = time.Until(deadline).Truncate(time.Millisecond)
+		if spec.timeout <= 0 {
+			summary.Incomplete = true
+			break
+		}
+		result, err := runProcess(ctx, spec, "run learner binary")
+		if err != nil {
+			return processResult{}, benchmarkResult{}, err
+		}
+		last = result
+		if result.timedOut || result.exitCode != 0 {
+			summary.Incomplete = true
+			break
+		}
+		if iteration < benchmark.WarmupRuns {
+			continue
+		}
+		wallTimes = append(wallTimes, milliseconds(result.wallTime))
+		cpuTimes = append(cpuTimes, milliseconds(result.cpuTime))
+		summary.PeakMemoryBytes = max(summary.PeakMemoryBytes, result.peakMemoryBytes)
+	}
+	summary.Runs = len(wallTimes)
+	if len(wallTimes) != 0 {
+		summary.WallTimeMs = summarize(wallTimes)
+		summary.CPUTimeMs = summarize(cpuTimes)
+	}
+	return last, summary, nil
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
+
+// summarize reports the sample standard deviation, which is zero for a
+// single run.
+func summarize(samples []float64) *benchmarkStatistics {
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	middle := len(sorted) / 2
+	median := sorted[middle]
+	if len(sorted)%2 == 0 {
+		median = (sorted[middle-1] + sorted[middle]) / 2
+	}
+	var sum float64
+	for _, sample := range sorted {
+		sum += sample
+	}
+	mean := sum / float64(len(sorted))
+	var squares float64
+	for _, sample := range sorted {
+		squares += (sample - mean) * (sample - mean)
+	}
+	stddev := 0.0
+	if len(sorted) > 1 {
+		stddev = math.Sqrt(squares / float64(len(sorted)-1))
+	}
+	return &benchmarkStatistics{Min: sorted[0], Median: median, Mean: mean, Stddev: stddev}
+}
@@ -0,0 +1,137 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeFakeProgram writes a program that records each invocation and exits
+// with 3 on the invocation numbered failAt, if any.
+func writeFakeProgram(t *testing.T, failAt int) (string, string) {
+	t.Helper()
+	directory := t.TempDir()
+	program := filepath.Join(directory, "main")
+	script := fmt.Sprintf(`#!/bin/sh
+read line
+echo "$line" >> invocations
+count=$(wc -l < invocations)
+echo "run $count"
+if [ "$count" -eq %d ]; then exit 3; fi
+`, failAt)
+	if err := os.WriteFile(program, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return program, directory
+}
+
+func benchmarkSpec(program, directory string) processSpec {
+	return processSpec{
+		executable:       program,
+		environment:      []string{"PATH=/usr/bin:/bin"},
+		workingDirectory: directory,
+		timeout:          runTimeout,
+		stdin:            "input\n",
+	}
+}
+
+func TestRunBenchmarkDiscardsWarmupRuns(t *testing.T) {
+	program, directory := writeFakeProgram(t, 0)
+	result, summary, err := runBenchmark(context.Background(), benchmarkSpec(program, directory), benchmarkRequest{Runs: 3, WarmupRuns: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	invocations, err := os.ReadFile(filepath.Join(directory, "invocations"))
+	if err != nil || string(invocations) != strings.Repeat("input\n", 5) {
+		t.Fatalf("invocations = %q, err = %v", invocations, err)
+	}
+	if summary.Runs != 3 || summary.WarmupRuns != 2 || summary.Incomplete ||
+		summary.WallTimeMs == nil || summary.CPUTimeMs == nil || summary.PeakMemoryBytes <= 0 {
+		t.Fatalf("summary = %+v", summary)
+	}
+	if summary.WallTimeMs.Min <= 0 || summary.WallTimeMs.Min > summary.WallTimeMs.Median {
+		t.Fatalf("wall time = %+v", *summary.WallTimeMs)
+	}
+	if result.stdout.content != "run 5\n" || result.exitCode != 0 {
+		t.Fatalf("last run stdout = %q code = %d", result.stdout.content, result.exitCode)
+	}
+}
+
+func TestRunBenchmarkStopsAtFailingRun(t *testing.T) {
+	program, directory := writeFakeProgram(t, 3)
+	result, summary, err := runBenchmark(context.Background(), benchmarkSpec(program, directory), benchmarkRequest{Runs: 5, WarmupRuns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !summary.Incomplete || summary.Runs != 1 || result.exitCode != 3 || result.stdout.content != "run 3\n" {
+		t.Fatalf("summary = %+v, code = %d, stdout = %q", summary, result.exitCode, result.stdout.content)
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	statistics := summarize([]float64{4, 1, 3, 2})
+	if *statistics != (benchmarkStatistics{Min: 1, Median: 2.5, Mean: 2.5, Stddev: 1.2909944487358056}) {
+		t.Fatalf("statistics = %+v", *statistics)
+	}
+	if single := summarize([]float64{7}); *single != (benchmarkStatistics{Min: 7, Median: 7, Mean: 7}) {
+		t.Fatalf("single-run statistics = %+v", *single)
+	}
+}
+
+func TestBuildPlanOptimisesBenchmarkBuilds(t *testing.T) {
+	plan := buildPlan("/playground/run-1", runReq{
+		Mode:     runModeBenchmark,
+		Packages: []packageRequest{{Name: "util", OutputType: packageOutputStaticlib}},
+	})
+	for _, planned := range plan {
+		if !slices.Contains(planned.arguments, "-O2") {
+			t.Fatalf("%s arguments = %q", planned.step.Package, planned.arguments)
+		}
+	}
+	if slices.Contains(buildPlan("/playground/run-1", runReq{})[0].arguments, "-O2") {
+		t.Fatal("run mode build is optimised")
+	}
+}
+
+func TestRunRequestBenchmarkMode(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseRun}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost, "/run", "application/json",
+		`{"code":"main() {}","mode":"benchmark","benchmark":{"runs":10},"stdin":"1"}`,
+	))
+	if recorder.Code != http.StatusOK || received.Mode != runModeBenchmark ||
+		received.benchmark() != (benchmarkRequest{Runs: 10, WarmupRuns: defaultBenchmarkWarmupRuns}) {
+		t.Fatalf("status = %d received=%+v", recorder.Code, received)
+	}
+	if (runReq{Mode: runModeBenchmark}).benchmark() != defaultBenchmarkRequest() {
+		t.Fatal("benchmark without options does not use the defaults")
+	}
+	for _, body := range []string{
+		`{"code":"","benchmark":{"runs":3}}`,
+		`{"code":"","mode":"benchmark","benchmark":{"runs":0}}`,
+		`{"code":"","mode":"benchmark","benchmark":{"runs":21}}`,
+		`{"code":"","mode":"benchmark","benchmark":{"warmup_runs":-1}}`,
+		`{"code":"","mode":"benchmark","benchmark":{"iterations":3}}`,
+		`{"code":"","mode":"benchmark","benchmark":null}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/run", "application/json", body))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A request may declare library and macro packages that are compiled, in
+// request order, before the main package. Sources and products share one
+// runner-owned subdirectory, which also serves as the import and library
+// search path, so each package can import every package declared before it.
+const (
+	packageDirectoryName   = "pkgs"
+	maxBuildPackages       = 8
+	maxPackageSources      = 16
+	maxPackageNameBytes    = 64
+	maxPackageSourceBytes  = 255
+	mainPackageStepName    = "main"
+	packageSourceExtension = ".cj"
+
+	// cjc writes the expansion of every macro call site next to the source as
+	// <file>.macrocall when --debug-macro is given.
+	macroExpansionSuffix = ".macrocall"
+)
+
+type packageOutputType string
+
+const (
+	packageOutputStaticlib packageOutputType = "staticlib"
+	packageOutputDylib     packageOutputType = "dylib"
+	packageOutputExe       packageOutputType = "exe"
+	// Macro packages are compiled with --compile-macro into a library cjc
+	// loads while compiling consumers; nothing links or loads it at run time.
+	packageOutputMacro packageOutputType = "macro"
+	// packageOutputCHIR stops the main step after the front end and CHIR
+	// optimisation, skipping LLVM codegen and linking. Check mode uses it.
+	packageOutputCHIR packageOutputType = "chir"
+)
+
+// reservedPackageNames would shadow the toolchain's own packages or the
+// program's main step.
+var reservedPackageNames = []string{"main", "std", "stdx"}
+
+type packageSource struct {
+	Path    string `json:"path"`
+	Content string `json:"content"`
+}
+
+type packageRequest struct {
+	Name       string            `json:"name"`
+	OutputType packageOutputType `json:"output_type"`
+	Sources    []packageSource   `json:"sources"`
+}
+
+type buildStep struct {
+	Package      string            `json:"package"`
+	OutputType   packageOutputType `json:"output_type"`
+	CompilerCode int               `json:"compiler_code"`
+}
+
+func isPackageName(name string) bool {
+	if name == "" || len(name) > maxPackageNameBytes || name[0] < 'a' || name[0] > 'z' {
+		return false
+	}
+	return strings.IndexFunc(name, func(r rune) bool {
+		return (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '_'
+	}) == -1
+}
+
+func isPackageSourcePath(path string) bool {
+	stem, ok := strings.CutSuffix(path, packageSourceExtension)
+	return ok && stem != "" && len(path) <= maxPackageSourceBytes &&
+		strings.IndexFunc(stem, func(r rune) bool {
+			return (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') &&
+				(r < '0' || r > '9') && r != '_' && r != '-'
+		}) == -1
+}
+
+func parseBuildPackages(packages []packageRequest) error {
+	if len(packages) > maxBuildPackages {
+		return fmt.Errorf("packages must contain at most %d entries", maxBuildPackages)
+	}
+	seen := make(map[string]bool, len(packages))
+	for _, pkg := range packages {
+		if !isPackageName(pkg.Name) || slices.Contains(reservedPackageNames, pkg.Name) {
+			return fmt.Errorf("package name %q is not allowed", pkg.Name)
+		}
+		if seen[pkg.Name] {
+			return fmt.Errorf("package %q is declared twice", pkg.Name)
+		}
+		seen[pkg.Name] = true
+		switch pkg.OutputType {
+		case packageOutputStaticlib, packageOutputDylib, packageOutputMacro:
+		default:
+			return fmt.Errorf("package %q has unsupported output_type %q", pkg.Name, pkg.OutputType)
+		}
+		if len(pkg.Sources) == 0 || len(pkg.Sources) > maxPackageSources {
+			return fmt.Errorf("package %q must have 1-%d sources", pkg.Name, maxPackageSources)
+		}
+		paths := make(map[string]bool, len(pkg.Sources))
+		for _, source := range pkg.Sources {
+			if !isPackageSourcePath(source.Path) || paths[source.Path] {
+				return fmt.Errorf("package %q has invalid source path %q", pkg.Name, source.Path)
+			}
+			paths[source.Path] = true
+		}
+	}
+	return nil
+}
+
+func packageOutputDirectory(requestDirectory string) string {
+	return filepath.Join(requestDirectory, packageDirectoryName)
+}
+
+// writePackageSources lays out each declared package in its own directory
+// below the package output directory.
+func writePackageSources(requestDirectory string, packages []packageRequest) error {
+	for _, pkg := range packages {
+		directory := filepath.Join(packageOutputDirectory(requestDirectory), pkg.Name)
+		if err := os.MkdirAll(directory, 0o700); err != nil {
+			return err
+		}
+		for _, source := range pkg.Sources {
+			if err := os.WriteFile(filepath.Join(directory, source.Path), []byte(source.Content), 0o600); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func packageCompilerArguments(requestDirectory string, pkg packageRequest) []string {
+	outputDirectory := packageOutputDirectory(requestDirectory)
+	arguments := []string{
+		"--import-path=/linux_x86_64_cjnative/dynamic",
+		"--import-path=" + outputDirectory,
+		"--no-sub-pkg",
+		"--output-dir=" + outputDirectory,
+		"-V", "-j1", "-p", filepath.Join(outputDirectory, pkg.Name),
+	}
+	if pkg.OutputType == packageOutputMacro {
+		return append(arguments, "--compile-macro")
+	}
+	return append(arguments, "--output-type="+string(pkg.OutputType))
+}
+
+// packageLinkArguments makes the main step see every declared package. Static
+// archives resolve left to right, so later packages, which may depend on
+// earlier ones, are linked first. Macro packages are only imported.
+func packageLinkArguments(requestDirectory string, packages []packageRequest) []string {
+	if len(packages) == 0 {
+		return nil
+	}
+	outputDirectory := packageOutputDirectory(requestDirectory)
+	arguments := []string{"--import-path=" + outputDirectory, "-L", outputDirectory}
+	for _, pkg := range slices.Backward(packages) {
+		if !isMacroPackage(pkg) {
+			arguments = append(arguments, "-l"+pkg.Name)
+		}
+	}
+	return arguments
+}
+
+// packageLibraryEnvironment points the learner's library search path at the
+// package output directory when a dylib package must be loaded at run time.
+func packageLibraryEnvironment(environment []string, requestDirectory string, packages []packageRequest) []string {
+	if !slices.ContainsFunc(packages, func(pkg packageRequest) bool {
+		return pkg.OutputType == packageOutputDylib
+	}) {
+		return environment
+	}
+	adjusted := slices.Clone(environment)
+	for index, entry := range adjusted {
+		if value, ok := strings.CutPrefix(entry, "LD_LIBRARY_PATH="); ok {
+			adjusted[index] = "LD_LIBRARY_PATH=" + packageOutputDirectory(requestDirectory) + ":" + value
+		}
+	}
+	return adjusted
+}
+
+// buildCompilerExecutable is the cjc the build steps run. Tests replace it
+// with a stand-in.
+var buildCompilerExecutable = cangjieCompilerPath
+
+// plannedBuildStep is one compiler invocation of a request build. Steps that
+// leave executable empty run cjc in the request directory.
+type plannedBuildStep struct {
+	step             buildStep
+	operation        string
+	executable       string
+	workingDirectory string
+	arguments        []string
+	// runsLearnerCode marks steps that run as the learner. Their input acts
+	// as code inside the tool: cjc executes the learner's macros while it
+	// compiles their call sites, and gcc reads every file the learner's C
+	// sources include. Every later step runs as the learner too, because the
+	// runner identity can no longer read or write the request directory.
+	runsLearnerCode bool
+}
+
+func isMacroPackage(pkg packageRequest) bool {
+	return pkg.OutputType == packageOutputMacro
+}
+
+// buildRunsLearnerCode reports whether any build step of the request runs
+// learner code. Such a build hands the request directory to the learner
+// before that step, so the runner must treat it as learner-controlled after.
+func buildRunsLearnerCode(in runReq) bool {
+	return in.CLibrary != nil || slices.ContainsFunc(in.Packages, isMacroPackage)
+}
+
+// buildPlan orders the declared packages before the main package. Library
+// steps need nothing from the request beyond their own sources and earlier
+// products, so the order of the request is the build order. A macro package
+// must therefore precede every package that calls its macros.
+func buildPlan(requestDirectory string, in runReq) []plannedBuildStep {
+	packages := in.Packages
+	plan := make([]plannedBuildStep, 0, len(packages)+1)
+	// Every step after a macro package's own compile may load it.
+	loadsMacros := false
+	for _, pkg := range packages {
+		plan = append(plan, plannedBuildStep{
+			step:            buildStep{Package: pkg.Name, OutputType: pkg.OutputType},
+			operation:       "compile package " + pkg.Name,
+			arguments:       packageCompilerArguments(requestDirectory, pkg),
+			runsLearnerCode: loadsMacros,
+		})
+		loadsMacros = loadsMacros || isMacroPackage(pkg)
+	}
+	mainStep := plannedBuildStep{
+		step:      buildStep{Package: mainPackageStepName, OutputType: packageOutputExe},
+		operation: "compile",
+		arguments: slices.Concat(
+			compilerArguments(requestDirectory),
+			packageLinkArguments(requestDirectory, packages),
+			cLibraryLinkArguments(requestDirectory, in.CLibrary),
+			irDumpArguments(requestDirectory, in.Dumps),
+		),
+		runsLearnerCode: loadsMacros,
+	}
+	if in.Mode == runModeCoverage {
+		mainStep.arguments = append(mainStep.arguments, coverageArguments(in.CoverageTarget)...)
+	}
+	if in.Mode == runModeCheck {
+		// Library packages still build normally: the check needs their .cjo
+		// interfaces, and only the main package is what the editor asks about.
+		mainStep.step.OutputType = packageOutputCHIR
+		mainStep.operation = "check"
+		mainStep.arguments = checkOnlyArguments(mainStep.arguments)
+	}
+	plan = append(plan, mainStep)
+	switch in.Mode {
+	case runModeSanitize:
+		// Sanitizer builds are not link-compatible with regular ones, so every
+		// package that ends up in the binary is built with the same sanitizer.
+		appendLinkedStepArguments(plan, sanitizerArguments(in.sanitizer())...)
+	case runModeBenchmark:
+		appendLinkedStepArguments(plan, benchmarkArguments...)
+	case runModeDebug, runModeTrace:
+		appendLinkedStepArguments(plan, debugInfoArguments...)
+	}
+	if in.MacroExpansion {
+		// Only call sites expand; a macro package's own sources do not.
+		appendLinkedStepArguments(plan, "--debug-macro")
+	}
+	if in.CLibrary != nil {
+		// The C library depends on nothing in the request, so it builds first.
+		plan = append(cLibraryBuildPlan(requestDirectory, in.CLibrary), plan...)
+	}
+	for index := 1; index < len(plan); index++ {
+		plan[index].runsLearnerCode = plan[index].runsLearnerCode || plan[index-1].runsLearnerCode
+	}
+	return plan
+}
+
+// appendLinkedStepArguments adds arguments to every step whose code ends up in
+// the program, which excludes macro packages.
+func appendLinkedStepArguments(plan []plannedBuildStep, arguments ...string) {
+	for index := range plan {
+		if plan[index].step.OutputType != packageOutputMacro {
+			plan[index].arguments = append(plan[index].arguments, arguments...)
+		}
+	}
+}
+
+// checkOnlyArguments swaps the executable output for CHIR output and drops
+// the executable name, which a front-end-only build never writes.
+func checkOnlyArguments(arguments []string) []string {
+	checked := make([]string, 0, len(arguments))
+	for _, argument := range arguments {
+		switch argument {
+		case "--output-type=" + string(packageOutputExe):
+			checked = append(checked, "--output-type="+string(packageOutputCHIR))
+		case "-o=main":
+		default:
+			checked = append(checked, argument)
+		}
+	}
+	return checked
+}
+
+// macroExpansionPatterns cover the main package and every declared package.
+var macroExpansionPatterns = []string{
+	"*" + macroExpansionSuffix,
+	packageDirectoryName + "/*/*" + macroExpansionSuffix,
+}
@@ -0,0 +1,235 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBuildPlanOrdersPackagesBeforeMain(t *testing.T) {
+	packages := []packageRequest{
+		{Name: "base", OutputType: packageOutputStaticlib},
+		{Name: "greet", OutputType: packageOutputDylib},
+	}
+	plan := buildPlan("/playground/run-1", runReq{Packages: packages})
+	if len(plan) != 3 {
+		t.Fatalf("plan has %d steps, want 3", len(plan))
+	}
+	for index, want := range []buildStep{
+		{Package: "base", OutputType: packageOutputStaticlib},
+		{Package: "greet", OutputType: packageOutputDylib},
+		{Package: mainPackageStepName, OutputType: packageOutputExe},
+	} {
+		if plan[index].step != want {
+			t.Fatalf("step %d = %+v, want %+v", index, plan[index].step, want)
+		}
+	}
+	if !slices.Contains(plan[1].arguments, "--import-path=/playground/run-1/pkgs") ||
+		!slices.Contains(plan[1].arguments, "--output-type=dylib") ||
+		!slices.Contains(plan[1].arguments, "/playground/run-1/pkgs/greet") {
+		t.Fatalf("package arguments = %q", plan[1].arguments)
+	}
+	link := strings.Join(plan[2].arguments, " ")
+	if !strings.Contains(link, "--output-type=exe -o=main") ||
+		!strings.HasSuffix(link, "--import-path=/playground/run-1/pkgs -L /playground/run-1/pkgs -lgreet -lbase") {
+		t.Fatalf("main arguments = %q", plan[2].arguments)
+	}
+	if got := buildPlan("/playground/run-1", runReq{}); len(got) != 1 ||
+		!slices.Equal(got[0].arguments, compilerArguments("/playground/run-1")) {
+		t.Fatalf("plan without packages = %+v", got)
+	}
+}
+
+func TestPackageLibraryEnvironmentOnlyForDylibs(t *testing.T) {
+	environment := runtimeEnvironment("/playground/run-1")
+	static := []packageRequest{{Name: "base", OutputType: packageOutputStaticlib}}
+	if got := packageLibraryEnvironment(environment, "/playground/run-1", static); !slices.Equal(got, environment) {
+		t.Fatalf("static-only environment = %q", got)
+	}
+	dynamic := append(static, packageRequest{Name: "greet", OutputType: packageOutputDylib})
+	got := packageLibraryEnvironment(environment, "/playground/run-1", dynamic)
+	if !slices.Contains(got, "LD_LIBRARY_PATH=/playground/run-1/pkgs:"+cangjieLibs) {
+		t.Fatalf("dylib environment = %q", got)
+	}
+	if !slices.Contains(environment, "LD_LIBRARY_PATH="+cangjieLibs) {
+		t.Fatal("packageLibraryEnvironment modified its input")
+	}
+}
+
+func TestRunRequestPackages(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseCompile, CompilerCode: 1}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost,
+		"/run",
+		"application/json",
+		`{"code":"import greet.*\nmain() { hello() }","packages":[`+
+			`{"name":"greet","output_type":"staticlib","sources":[{"path":"greet.cj","content":"package greet"}]}]}`,
+	))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d; body=%s", recorder.Code, recorder.Body.String())
+	}
+	if len(received.Packages) != 1 || received.Packages[0].Name != "greet" ||
+		received.Packages[0].Sources[0].Path != "greet.cj" {
+		t.Fatalf("operation received packages=%+v", received.Packages)
+	}
+
+	source := `"sources":[{"path":"a.cj","content":""}]`
+	for _, body := range []string{
+		`{"code":"","packages":[{"name":"std","output_type":"staticlib",` + source + `}]}`,
+		`{"code":"","packages":[{"name":"Greet","output_type":"staticlib",` + source + `}]}`,
+		`{"code":"","packages":[{"name":"greet","output_type":"exe",` + source + `}]}`,
+		`{"code":"","packages":[{"name":"greet","output_type":"dylib","sources":[]}]}`,
+		`{"code":"","packages":[{"name":"greet","output_type":"dylib","sources":[{"path":"../a.cj","content":""}]}]}`,
+		`{"code":"","packages":[{"name":"greet","output_type":"dylib","sources":[{"path":"a.txt","content":""}]}]}`,
+		`{"code":"","packages":[{"name":"a","output_type":"dylib",` + source + `},{"name":"a","output_type":"dylib",` + source + `}]}`,
+		`{"code":"","packages":[{"name":"greet","output_type":"dylib","deps":[],` + source + `}]}`,
+		`{"code":"","files":[{"path":"pkgs/x","content":""}]}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(
+			recorder,
+			runnerRequest(http.MethodPost, "/run", "application/json", body),
+		)
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestBuildPlanCompilesMacroPackagesAndExpandsCallSites(t *testing.T) {
+	packages := []packageRequest{
+		{Name: "define", OutputType: packageOutputMacro},
+		{Name: "util", OutputType: packageOutputStaticlib},
+	}
+	plan := buildPlan("/playground/run-1", runReq{Packages: packages, MacroExpansion: true})
+	macro := plan[0].arguments
+	if !slices.Contains(macro, "--compile-macro") || slices.Contains(macro, "--debug-macro") ||
+		slices.ContainsFunc(macro, func(argument string) bool { return strings.HasPrefix(argument, "--output-type") }) {
+		t.Fatalf("macro package arguments = %q", macro)
+	}
+	for _, consumer := range plan[1:] {
+		if !slices.Contains(consumer.arguments, "--debug-macro") {
+			t.Fatalf("%s arguments = %q, want --debug-macro", consumer.step.Package, consumer.arguments)
+		}
+	}
+	if main := plan[2].arguments; slices.Contains(main, "-ldefine") || !slices.Contains(main, "-lutil") {
+		t.Fatalf("main arguments = %q, want util linked and define only imported", main)
+	}
+	if slices.Contains(buildPlan("/playground/run-1", runReq{Packages: packages})[2].arguments, "--debug-macro") {
+		t.Fatal("macro expansion was requested implicitly")
+	}
+}
+
+func TestMacroExpansionPatternsCoverMainAndPackages(t *testing.T) {
+	directory := t.TempDir()
+	for _, path := range []string{
+		"main.cj.macrocall",
+		"main.cj",
+		"pkgs/util/util.cj.macrocall",
+		"pkgs/define/define.cj",
+	} {
+		full := filepath.Join(directory, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte("expanded"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, truncated, err := collectOutputFiles(directory, macroExpansionPatterns, maxSerializedOutputBytes)
+	if err != nil || truncated {
+		t.Fatalf("collect expansions: truncated=%t err=%v", truncated, err)
+	}
+	if len(files) != 2 || files[0].Path != "main.cj.macrocall" ||
+		files[1].Path != "pkgs/util/util.cj.macrocall" || files[1].Content != "expanded" {
+		t.Fatalf("expansions = %+v", files)
+	}
+}
+
+func TestRunRequestMacroPackage(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseCompile, CompilerCode: 1}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost,
+		"/run",
+		"application/json",
+		`{"code":"import define.*","macro_expansion":true,"packages":[`+
+			`{"name":"define","output_type":"macro","sources":[{"path":"define.cj","content":"macro package define"}]}]}`,
+	))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d; body=%s", recorder.Code, recorder.Body.String())
+	}
+	if !received.MacroExpansion || len(received.Packages) != 1 ||
+		received.Packages[0].OutputType != packageOutputMacro {
+		t.Fatalf("operation received %+v", received)
+	}
+	recorder = httptest.NewRecorder()
+	testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost, "/run", "application/json", `{"code":"","macro_expansion":"yes"}`,
+	))
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatalf("non-boolean macro_expansion status = %d", recorder.Code)
+	}
+}
+
+func TestBuildPlanCheckModeStopsMainStepBeforeCodegen(t *testing.T) {
+	packages := []packageRequest{{Name: "util", OutputType: packageOutputStaticlib}}
+	plan := buildPlan("/playground/run-1", runReq{Mode: runModeCheck, Packages: packages})
+	if !slices.Contains(plan[0].arguments, "--output-type=staticlib") {
+		t.Fatalf("package arguments = %q, want a normal library build", plan[0].arguments)
+	}
+	check := plan[1]
+	if check.step.OutputType != packageOutputCHIR || check.operation != "check" ||
+		!slices.Contains(check.arguments, "--output-type=chir") ||
+		slices.Contains(check.arguments, "--output-type=exe") || slices.Contains(check.arguments, "-o=main") {
+		t.Fatalf("check step = %+v", check)
+	}
+	if !slices.Contains(check.arguments, "--import-path=/playground/run-1/pkgs") {
+		t.Fatalf("check arguments = %q, want package imports", check.arguments)
+	}
+}
+
+func TestRunRequestCheckMode(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseCheck}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost, "/run", "application/json", `{"code":"main() {}","mode":"check"}`,
+	))
+	if recorder.Code != http.StatusOK || received.Mode != runModeCheck ||
+		!strings.Contains(recorder.Body.String(), `"phase":"check"`) {
+		t.Fatalf("status = %d mode=%q body=%s", recorder.Code, received.Mode, recorder.Body.String())
+	}
+	for _, body := range []string{
+		`{"code":"","mode":"check","args":["x"]}`,
+		`{"code":"","mode":"check","dumps":["ast"]}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/run", "application/json", body))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// A request may carry C sources for foreign func lessons. They are built with
+// the image's C toolchain into one library in its own directory, and the main
+// step links it by a name the runner chooses; learners never supply linker
+// arguments themselves.
+const (
+	cLibraryDirectoryName = "cffi"
+	cLibraryName          = "cffi"
+	cCompilerPath         = "/usr/bin/gcc"
+	cArchiverPath         = "/usr/bin/ar"
+	maxCLibrarySources    = 16
+	maxCSourcePathBytes   = 255
+
+	// packageOutputObject reports the compile half of a static C library,
+	// which is archived by a separate step.
+	packageOutputObject packageOutputType = "object"
+)
+
+type cLibraryRequest struct {
+	OutputType packageOutputType `json:"output_type"`
+	Sources    []packageSource   `json:"sources"`
+}
+
+func isCSourcePath(path string) bool {
+	stem, ok := strings.CutSuffix(path, ".c")
+	if !ok {
+		stem, ok = strings.CutSuffix(path, ".h")
+	}
+	return ok && stem != "" && len(path) <= maxCSourcePathBytes &&
+		strings.IndexFunc(stem, func(r rune) bool {
+			return (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') &&
+				(r < '0' || r > '9') && r != '_' && r != '-'
+		}) == -1
+}
+
+// parseCLibrary defaults the output type to a static archive, which needs
+// nothing at run time.
+func parseCLibrary(library *cLibraryRequest) error {
+	switch library.OutputType {
+	case "":
+		library.OutputType = packageOutputStaticlib
+	case packageOutputStaticlib, packageOutputDylib:
+	default:
+		return fmt.Errorf("c_library has unsupported output_type %q", library.OutputType)
+	}
+	if len(library.Sources) == 0 || len(library.Sources) > maxCLibrarySources {
+		return fmt.Errorf("c_library must have 1-%d sources", maxCLibrarySources)
+	}
+	paths := make(map[string]bool, len(library.Sources))
+	for _, source := range library.Sources {
+		if !isCSourcePath(source.Path) || paths[source.Path] {
+			return fmt.Errorf("c_library has invalid source path %q", source.Path)
+		}
+		paths[source.Path] = true
+	}
+	if len(cTranslationUnits(library)) == 0 {
+		return fmt.Errorf("c_library must contain a .c source")
+	}
+	return nil
+}
+
+func cLibraryDirectory(requestDirectory string) string {
+	return filepath.Join(requestDirectory, cLibraryDirectoryName)
+}
+
+func cTranslationUnits(library *cLibraryRequest) []string {
+	var units []string
+	for _, source := range library.Sources {
+		if strings.HasSuffix(source.Path, ".c") {
+			units = append(units, source.Path)
+		}
+	}
+	return units
+}
+
+func writeCLibrarySources(requestDirectory string, library *cLibraryRequest) error {
+	if library == nil {
+		return nil
+	}
+	directory := cLibraryDirectory(requestDirectory)
+	if err := os.Mkdir(directory, 0o700); err != nil {
+		return err
+	}
+	for _, source := range library.Sources {
+		if err := os.WriteFile(filepath.Join(directory, source.Path), []byte(source.Content), 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cLibraryBuildPlan compiles the translation units in the library directory.
+// A dylib is linked by gcc in the same step; a staticlib is archived by ar.
+// Every step runs as the learner: gcc reads any file an #include or .incbin
+// in the sources names, which must not reach what only the runner can read.
+func cLibraryBuildPlan(requestDirectory string, library *cLibraryRequest) []plannedBuildStep {
+	directory := cLibraryDirectory(requestDirectory)
+	units := cTranslationUnits(library)
+	flags := []string{"-std=gnu11", "-O2", "-fPIC", "-Wall"}
+	if library.OutputType == packageOutputDylib {
+		return []plannedBuildStep{{
+			step:             buildStep{Package: cLibraryName, OutputType: packageOutputDylib},
+			operation:        "compile C library",
+			executable:       cCompilerPath,
+			workingDirectory: directory,
+			arguments:        slices.Concat(flags, []string{"-shared", "-o", "lib" + cLibraryName + ".so"}, units),
+			runsLearnerCode:  true,
+		}}
+	}
+	objects := make([]string, 0, len(units))
+	for _, unit := range units {
+		objects = append(objects, strings.TrimSuffix(unit, ".c")+".o")
+	}
+	return []plannedBuildStep{
+		{
+			step:             buildStep{Package: cLibraryName, OutputType: packageOutputObject},
+			operation:        "compile C library",
+			executable:       cCompilerPath,
+			workingDirectory: directory,
+			arguments:        slices.Concat(flags, []string{"-c"}, units),
+			runsLearnerCode:  true,
+		},
+		{
+			step:             buildStep{Package: cLibraryName, OutputType: packageOutputStaticlib},
+			operation:        "archive C library",
+			executable:       cArchiverPath,
+			workingDirectory: directory,
+			// D keeps the archive free of timestamps and owners.
+			arguments:       slices.Concat([]string{"rcsD", "lib" + cLibraryName + ".a"}, objects),
+			runsLearnerCode: true,
+		},
+	}
+}
+
+// cLibraryLinkArguments come last on the main step so that Cangjie packages
+// with foreign functions resolve against the C archive.
+func cLibraryLinkArguments(requestDirectory string, library *cLibraryRequest) []string {
+	if library == nil {
+		return nil
+	}
+	return []string{"-L", cLibraryDirectory(requestDirectory), "-l" + cLibraryName}
+}
+
+// cLibraryEnvironment lets the learner binary load a C dylib at run time.
+func cLibraryEnvironment(environment []string, requestDirectory string, library *cLibraryRequest) []string {
+	if library == nil || library.OutputType != packageOutputDylib {
+		return environment
+	}
+	adjusted := slices.Clone(environment)
+	for index, entry := range adjusted {
+		if value, ok := strings.CutPrefix(entry, "LD_LIBRARY_PATH="); ok {
+			adjusted[index] = "LD_LIBRARY_PATH=" + cLibraryDirectory(requestDirectory) + ":" + value
+		}
+	}
+	return adjusted
+}
@@ -0,0 +1,282 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseRunRequestCLibrary(t *testing.T) {
+	in, err := parseRunRequest(
+		[]byte(`{"code":"","c_library":{"sources":[{"path":"add.c","content":"int add(int a, int b) { return a + b; }"},{"path":"add.h","content":""}]}}`),
+		"application/json",
+	)
+	if err != nil || in.CLibrary == nil || in.CLibrary.OutputType != packageOutputStaticlib || len(in.CLibrary.Sources) != 2 {
+		t.Fatalf("c_library = %+v, err = %v", in.CLibrary, err)
+	}
+	for _, body := range []string{
+		`{"code":"","c_library":null}`,
+		`{"code":"","c_library":{"sources":[]}}`,
+		`{"code":"","c_library":{"sources":[{"path":"add.h","content":""}]}}`,
+		`{"code":"","c_library":{"sources":[{"path":"../add.c","content":""}]}}`,
+		`{"code":"","c_library":{"sources":[{"path":"add.c","content":""},{"path":"add.c","content":""}]}}`,
+		`{"code":"","c_library":{"output_type":"exe","sources":[{"path":"add.c","content":""}]}}`,
+		`{"code":"","c_library":{"sources":[{"path":"add.c","content":""}],"flags":["-lssl"]}}`,
+		`{"code":"","files":[{"path":"cffi/add.c","content":""}]}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/run", "application/json", body))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestBuildPlanBuildsAndLinksCLibraryFirst(t *testing.T) {
+	library := &cLibraryRequest{
+		OutputType: packageOutputStaticlib,
+		Sources:    []packageSource{{Path: "add.c"}, {Path: "add.h"}, {Path: "mul.c"}},
+	}
+	plan := buildPlan("/playground/run-1", runReq{
+		Mode:           runModeSanitize,
+		MacroExpansion: true,
+		CLibrary:       library,
+		Packages:       []packageRequest{{Name: "util", OutputType: packageOutputStaticlib}},
+	})
+	if len(plan) != 4 || plan[0].executable != cCompilerPath || plan[1].executable != cArchiverPath {
+		t.Fatalf("plan = %+v", plan)
+	}
+	// The C steps hand the directory to the learner, who then owns it for
+	// the Cangjie steps as well.
+	for _, planned := range plan[2:] {
+		if !planned.runsLearnerCode {
+			t.Fatalf("step after the C library runs as the runner: %+v", planned)
+		}
+	}
+	for _, planned := range plan[:2] {
+		if planned.workingDirectory != "/playground/run-1/cffi" || !planned.runsLearnerCode ||
+			slices.ContainsFunc(planned.arguments, func(argument string) bool { return strings.HasPrefix(argument, "--") }) {
+			t.Fatalf("C step = %+v", planned)
+		}
+	}
+	if !slices.Equal(plan[1].arguments, []string{"rcsD", "libcffi.a", "add.o", "mul.o"}) {
+		t.Fatalf("archive arguments = %q", plan[1].arguments)
+	}
+	mainArguments := plan[3].arguments
+	link := slices.Index(mainArguments, "-lcffi")
+	if link < 0 || link < slices.Index(mainArguments, "-lutil") || mainArguments[link-1] != "/playground/run-1/cffi" {
+		t.Fatalf("main arguments = %q", mainArguments)
+	}
+
+	library.OutputType = packageOutputDylib
+	plan = buildPlan("/playground/run-1", runReq{CLibrary: library})
+	if len(plan) != 2 || plan[0].step.OutputType != packageOutputDylib ||
+		!slices.Contains(plan[0].arguments, "-shared") || slices.Contains(plan[0].arguments, "add.h") {
+		t.Fatalf("dylib plan = %+v", plan)
+	}
+	environment := cLibraryEnvironment([]string{"LD_LIBRARY_PATH=/lib"}, "/playground/run-1", library)
+	if environment[0] != "LD_LIBRARY_PATH=/playground/run-1/cffi:/lib" {
+		t.Fatalf("environment = %q", environment)
+	}
+}
+
+func TestCLibraryBuildPlanBuildsWithImageToolchain(t *testing.T) {
+	for _, tool := range []string{cCompilerPath, cArchiverPath} {
+		if _, err := os.Stat(tool); err != nil {
+			t.Skipf("%s is not installed", tool)
+		}
+	}
+	for _, outputType := range []packageOutputType{packageOutputStaticlib, packageOutputDylib} {
+		requestDirectory := t.TempDir()
+		library := &cLibraryRequest{OutputType: outputType, Sources: []packageSource{
+			{Path: "add.h", Content: "int add(int a, int b);\n"},
+			{Path: "add.c", Content: "#include \"add.h\"\nint add(int a, int b) { return a + b; }\n"},
+		}}
+		if err := writeCLibrarySources(requestDirectory, library); err != nil {
+			t.Fatal(err)
+		}
+		for _, planned := range cLibraryBuildPlan(requestDirectory, library) {
+			executable, err := filepath.EvalSymlinks(planned.executable)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := runProcess(context.Background(), processSpec{
+				executable:       executable,
+				arguments:        planned.arguments,
+				environment:      trustedToolEnvironment(requestDirectory),
+				workingDirectory: planned.workingDirectory,
+				timeout:          compileTimeout,
+			}, planned.operation)
+			if err != nil || result.exitCode != 0 {
+				t.Fatalf("%s: code=%d err=%v stderr=%s", planned.operation, result.exitCode, err, result.stderr.content)
+			}
+		}
+		product := "libcffi.a"
+		if outputType == packageOutputDylib {
+			product = "libcffi.so"
+		}
+		if _, err := os.Stat(filepath.Join(cLibraryDirectory(requestDirectory), product)); err != nil {
+			t.Fatalf("%s: %v", outputType, err)
+		}
+	}
+}
+
+func TestCLibraryCannotIncludeRunnerFiles(t *testing.T) {
+	if _, err := os.Stat(cCompilerPath); err != nil {
+		t.Skipf("%s is not installed", cCompilerPath)
+	}
+	useLearnerReachableLauncher(t)
+	root := learnerReachableTempDir(t)
+	secret := filepath.Join(root, "runner-secret.h")
+	if err := os.WriteFile(secret, []byte("int runner_secret = 42;\n"), 0o600); err != nil {
+		t.Fatalf("write runner secret: %v", err)
+	}
+	requestDirectory, err := os.MkdirTemp(root, "run-")
+	if err != nil {
+		t.Fatalf("create request directory: %v", err)
+	}
+	in := runReq{Code: "main() {}", CLibrary: &cLibraryRequest{
+		OutputType: packageOutputStaticlib,
+		Sources:    []packageSource{{Path: "leak.c", Content: "#include \"" + secret + "\"\n"}},
+	}}
+	if err := writeCLibrarySources(requestDirectory, in.CLibrary); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := compileRequest(context.Background(), requestDirectory, in, nextLearnerCredential())
+	if err != nil {
+		t.Fatalf("compile request: %v", err)
+	}
+	if msg.CompilerCode == 0 || len(msg.BuildSteps) != 1 ||
+		!strings.Contains(msg.CompilerOutput, "Permission denied") || strings.Contains(msg.CompilerOutput, "runner_secret") {
+		t.Fatalf("C library included a runner file: code=%d steps=%+v output=%q",
+			msg.CompilerCode, msg.BuildSteps, msg.CompilerOutput)
+	}
+}
+
+func TestDockerfileKeepsCCompilerFrontEnd(t *testing.T) {
+	dockerfile, err := os.ReadFile("../../Dockerfile")
+	if err != nil {
+		t.Fatalf("read Dockerfile: %v", err)
+	}
+	if strings.Contains(string(dockerfile), "-name 'cc1*'") {
+		t.Fatal("Dockerfile deletes cc1, which gcc needs to build C libraries")
+	}
+}
+
+// cLibraryProbeDirectoryEnvironment tells the c-library-build probe where the
+// test laid out its stand-in toolchain and playground.
+const cLibraryProbeDirectoryEnvironment = "CJ_RUNNER_TEST_PROBE_DIRECTORY"
+
+// runCLibraryBuildProbe builds a C library request from inside a runner that
+// has the image's identity and file capabilities, and prints the result.
+func runCLibraryBuildProbe() int {
+	root := os.Getenv(cLibraryProbeDirectoryEnvironment)
+	buildCompilerExecutable = filepath.Join(root, "cjc")
+	requestDirectory, err := os.MkdirTemp(filepath.Join(root, "playground"), "run-")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "create request directory: %v\n", err)
+		return 1
+	}
+	in := runReq{
+		Code: "main() {}",
+		CLibrary: &cLibraryRequest{OutputType: packageOutputStaticlib, Sources: []packageSource{
+			{Path: "add.c", Content: "int add(int a, int b) { return a + b; }\n"},
+		}},
+		Packages: []packageRequest{{Name: "util", OutputType: packageOutputStaticlib, Sources: []packageSource{
+			{Path: "util.cj", Content: "package util\n"},
+		}}},
+	}
+	if err := os.WriteFile(filepath.Join(requestDirectory, "main.cj"), []byte(in.Code), 0o600); err != nil {
+		fmt.Fprintf(os.Stderr, "write main source: %v\n", err)
+		return 1
+	}
+	if err := writePackageSources(requestDirectory, in.Packages); err != nil {
+		fmt.Fprintf(os.Stderr, "write package sources: %v\n", err)
+		return 1
+	}
+	if err := writeCLibrarySources(requestDirectory, in.CLibrary); err != nil {
+		fmt.Fprintf(os.Stderr, "write C sources: %v\n", err)
+		return 1
+	}
+	msg, err := compileRequest(context.Background(), requestDirectory, in, nextLearnerCredential())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "compile request: %v\n", err)
+		return 1
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(msg); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// TestCLibraryRequestBuildsAsTheImageRunner runs the build as the image does:
+// as an unprivileged runner whose binary carries file capabilities, which the
+// tools it starts do not inherit.
+func TestCLibraryRequestBuildsAsTheImageRunner(t *testing.T) {
+	if _, err := os.Stat(cCompilerPath); err != nil {
+		t.Skipf("%s is not installed", cCompilerPath)
+	}
+	useLearnerReachableLauncher(t)
+	launcher, err := sandboxLauncherExecutable()
+	if err != nil {
+		t.Fatalf("resolve launcher: %v", err)
+	}
+	if output, err := exec.Command(
+		"setcap", "cap_setuid,cap_setgid,cap_chown,cap_dac_override+ep", launcher,
+	).CombinedOutput(); err != nil {
+		t.Skipf("cannot grant the image's file capabilities: %v: %s", err, output)
+	}
+	const imageRunnerID = 65532
+	root := learnerReachableTempDir(t)
+	playground := filepath.Join(root, "playground")
+	if err := os.Mkdir(playground, 0o711); err != nil {
+		t.Fatalf("create playground: %v", err)
+	}
+	if err := os.Chown(playground, imageRunnerID, imageRunnerID); err != nil {
+		t.Fatalf("hand playground to the runner: %v", err)
+	}
+	// The stand-in needs the package directory, the main source and the C
+	// archive, all of which belong to the learner by the time it runs.
+	compiler := `#!/bin/sh
+case " $* " in *" -p "*) exec touch pkgs/libutil.a ;; esac
+cat main.cj cffi/libcffi.a > main
+`
+	if err := os.WriteFile(filepath.Join(root, "cjc"), []byte(compiler), 0o755); err != nil {
+		t.Fatalf("write compiler stand-in: %v", err)
+	}
+
+	probe := exec.Command(launcher)
+	probe.Env = []string{
+		"PATH=/usr/bin:/bin",
+		testProbeEnvironment + "=c-library-build",
+		cLibraryProbeDirectoryEnvironment + "=" + root,
+	}
+	probe.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{
+		Uid: imageRunnerID, Gid: imageRunnerID, Groups: []uint32{},
+	}}
+	var stderr strings.Builder
+	probe.Stderr = &stderr
+	output, err := probe.Output()
+	if err != nil {
+		t.Fatalf("build as the image runner: %v: %s", err, stderr.String())
+	}
+	var msg runMessage
+	if err := json.Unmarshal(output, &msg); err != nil {
+		t.Fatalf("decode build result %q: %v", output, err)
+	}
+	if msg.CompilerCode != 0 || len(msg.BuildSteps) != 4 {
+		t.Fatalf("C library request failed as the image runner: code=%d steps=%+v output=%q",
+			msg.CompilerCode, msg.BuildSteps, msg.CompilerOutput)
+	}
+}
@@ -0,0 +1,255 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runnerConfigFileVariable names an optional JSON file of limit settings.
+// Environment variables override the file, which overrides the defaults.
+// Secrets are read only from the environment.
+const runnerConfigFileVariable = "CJ_RUNNER_CONFIG_FILE"
+
+const maxRunnerConfigFileBytes = 64 * 1024
+
+// runnerLimits are the operator-tunable bounds of the service.
+type runnerLimits struct {
+	CompileTimeout time.Duration
+	RunTimeout     time.Duration
+	// Ceilings on the deadlines a request may ask for. Unset ceilings
+	// follow the default deadlines, so requests can only lower them.
+	MaxCompileTimeout time.Duration
+	MaxRunTimeout     time.Duration
+	// MaxOutputBytes caps each output field. It cannot exceed
+	// maxSerializedOutputBytes, which the response schemas fix.
+	MaxOutputBytes int
+	// MaxCombinedOutputBytes caps a program's stdout and stderr together.
+	// Unset, it leaves each channel its full MaxOutputBytes.
+	MaxCombinedOutputBytes int
+	// MaxRequestBytes may only lower maxRequestBodyBytes, because the
+	// gateway never forwards more.
+	MaxRequestBytes   int
+	MaxHeaderBytes    int
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+}
+
+func defaultRunnerLimits() runnerLimits {
+	return runnerLimits{
+		CompileTimeout:         compileTimeout,
+		RunTimeout:             runTimeout,
+		MaxCompileTimeout:      compileTimeout,
+		MaxRunTimeout:          runTimeout,
+		MaxOutputBytes:         maxSerializedOutputBytes,
+		MaxCombinedOutputBytes: 2 * maxSerializedOutputBytes,
+		MaxRequestBytes:        maxRequestBodyBytes,
+		MaxHeaderBytes:         maxHeaderBytes,
+		ReadHeaderTimeout:      readHeaderTimeout,
+		ReadTimeout:            readTimeout,
+		WriteTimeout:           writeTimeout,
+		IdleTimeout:            idleTimeout,
+	}
+}
+
+// orDefaults stands the default limits in for the zero value, which requests
+// built outside a server carry.
+func (l runnerLimits) orDefaults() runnerLimits {
+	if l == (runnerLimits{}) {
+		return defaultRunnerLimits()
+	}
+	return l
+}
+
+// limitSetting is one limit as the file key and environment variable spell
+// it, in milliseconds or bytes.
+type limitSetting struct {
+	key      string
+	min, max int64
+	get      func() int64
+	set      func(int64)
+}
+
+func (s limitSetting) environmentVariable() string {
+	return "CJ_RUNNER_" + strings.ToUpper(s.key)
+}
+
+func durationSetting(key string, field *time.Duration, min, max time.Duration) limitSetting {
+	return limitSetting{
+		key: key,
+		min: min.Milliseconds(),
+		max: max.Milliseconds(),
+		get: func() int64 { return field.Milliseconds() },
+		set: func(value int64) { *field = time.Duration(value) * time.Millisecond },
+	}
+}
+
+func byteSetting(key string, field *int, min, max int) limitSetting {
+	return limitSetting{
+		key: key,
+		min: int64(min),
+		max: int64(max),
+		get: func() int64 { return int64(*field) },
+		set: func(value int64) { *field = int(value) },
+	}
+}
+
+func (l *runnerLimits) settings() []limitSetting {
+	return []limitSetting{
+		durationSetting("compile_timeout_ms", &l.CompileTimeout, time.Second, maxCompileTimeoutCeiling),
+		durationSetting("run_timeout_ms", &l.RunTimeout, minTimeBudget, maxRunTimeoutCeiling),
+		durationSetting("max_compile_timeout_ms", &l.MaxCompileTimeout, time.Second, maxCompileTimeoutCeiling),
+		durationSetting("max_run_timeout_ms", &l.MaxRunTimeout, minTimeBudget, maxRunTimeoutCeiling),
+		byteSetting("max_output_bytes", &l.MaxOutputBytes, 1024, maxSerializedOutputBytes),
+		byteSetting("max_combined_output_bytes", &l.MaxCombinedOutputBytes, 1024, 2*maxSerializedOutputBytes),
+		byteSetting("max_request_bytes", &l.MaxRequestBytes, 1024, maxRequestBodyBytes),
+		byteSetting("max_header_bytes", &l.MaxHeaderBytes, 4*1024, 64*1024),
+		durationSetting("read_header_timeout_ms", &l.ReadHeaderTimeout, time.Second, time.Minute),
+		durationSetting("read_timeout_ms", &l.ReadTimeout, time.Second, time.Minute),
+		durationSetting("write_timeout_ms", &l.WriteTimeout, time.Second, 3*time.Minute),
+		durationSetting("idle_timeout_ms", &l.IdleTimeout, time.Second, 5*time.Minute),
+	}
+}
+
+// limitEnvironmentVariables are the variables loadRunnerLimits reads.
+func limitEnvironmentVariables() []string {
+	var limits runnerLimits
+	names := []string{runnerConfigFileVariable}
+	for _, setting := range limits.settings() {
+		names = append(names, setting.environmentVariable())
+	}
+	return names
+}
+
+// loadRunnerLimits layers the config file and the environment over the
+// defaults. Unknown file keys, values outside a setting's bounds and
+// inconsistent combinations all fail startup.
+func loadRunnerLimits(environment map[string]string) (runnerLimits, error) {
+	limits := defaultRunnerLimits()
+	settings := limits.settings()
+	configured := map[string]bool{}
+	if path := strings.TrimSpace(environment[runnerConfigFileVariable]); path != "" {
+		values, err := readRunnerConfigFile(path)
+		if err != nil {
+			return runnerLimits{}, fmt.Errorf("%s: %w", runnerConfigFileVariable, err)
+		}
+		for _, setting := range settings {
+			value, ok := values[setting.key]
+			if !ok {
+				continue
+			}
+			delete(values, setting.key)
+			if value < setting.min || value > setting.max {
+				return runnerLimits{}, fmt.Errorf("%s in %s must be %d-%d", setting.key, path, setting.min, setting.max)
+			}
+			setting.set(value)
+			configured[setting.key] = true
+		}
+		for key := range values {
+			return runnerLimits{}, fmt.Errorf("%s has unknown setting %q", path, key)
+		}
+	}
+	for _, setting := range settings {
+		raw := strings.TrimSpace(environment[setting.environmentVariable()])
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || value < setting.min || value > setting.max {
+			return runnerLimits{}, fmt.Errorf("%s must be %d-%d", setting.environmentVariable(), setting.min, setting.max)
+		}
+		setting.set(value)
+		configured[setting.key] = true
+	}
+	if !configured["max_compile_timeout_ms"] {
+		limits.MaxCompileTimeout = limits.CompileTimeout
+	}
+	if !configured["max_run_timeout_ms"] {
+		limits.MaxRunTimeout = limits.RunTimeout
+	}
+	if !configured["max_combined_output_bytes"] {
+		limits.MaxCombinedOutputBytes = 2 * limits.MaxOutputBytes
+	}
+	if err := limits.validate(); err != nil {
+		return runnerLimits{}, err
+	}
+	return limits, nil
+}
+
+func readRunnerConfigFile(path string) (map[string]int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, errors.New("config file must be a regular file")
+	}
+	data, err := io.ReadAll(io.LimitReader(file, maxRunnerConfigFileBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRunnerConfigFileBytes {
+		return nil, fmt.Errorf("config file exceeds %d bytes", maxRunnerConfigFileBytes)
+	}
+	var values map[string]int64
+	if err := decodeStrictJSON(data, &values); err != nil || values == nil {
+		return nil, errors.New("config file must be one JSON object of integer settings")
+	}
+	return values, nil
+}
+
+// validate checks the relations between limits that each bound alone cannot.
+func (l runnerLimits) validate() error {
+	if l.MaxCompileTimeout < l.CompileTimeout {
+		return errors.New("max_compile_timeout_ms must be at least compile_timeout_ms")
+	}
+	if l.MaxRunTimeout < l.RunTimeout {
+		return errors.New("max_run_timeout_ms must be at least run_timeout_ms")
+	}
+	if l.MaxCombinedOutputBytes > 2*l.MaxOutputBytes {
+		return errors.New("max_combined_output_bytes must not exceed twice max_output_bytes")
+	}
+	if l.WriteTimeout <= l.CompileTimeout+l.RunTimeout+coverageTimeout {
+		// Longer negotiated budgets move the write deadline out themselves.
+		return fmt.Errorf(
+			"write_timeout_ms must exceed compile_timeout_ms + run_timeout_ms + %d ms of coverage collection",
+			coverageTimeout.Milliseconds(),
+		)
+	}
+	if l.ReadHeaderTimeout > l.ReadTimeout {
+		return errors.New("read_header_timeout_ms must not exceed read_timeout_ms")
+	}
+	return nil
+}
+
+// describeRunnerConfig renders the effective settings for the startup log.
+// The shared token is reported only as present or absent.
+func describeRunnerConfig(config runnerConfig) string {
+	token := "<unset>"
+	if config.sharedToken != "" {
+		token = "<redacted>"
+	}
+	var text bytes.Buffer
+	fmt.Fprintf(&text, "shared_token=%s", token)
+	fmt.Fprintf(&text, " toolchain_lock_sha256=%s", cmp.Or(config.toolchainLockSha256, "<unset>"))
+	limits := config.limits
+	for _, setting := range limits.settings() {
+		fmt.Fprintf(&text, " %s=%d", setting.key, setting.get())
+	}
+	return text.String()
+}
@@ -0,0 +1,129 @@
+//go:build linux
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeRunnerConfigFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "runner.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadRunnerLimitsDefaults(t *testing.T) {
+	limits, err := loadRunnerLimits(map[string]string{})
+	if err != nil || limits != defaultRunnerLimits() {
+		t.Fatalf("limits = %+v, err = %v", limits, err)
+	}
+}
+
+func TestLoadRunnerLimitsLayersEnvironmentOverFile(t *testing.T) {
+	path := writeRunnerConfigFile(t, `{"run_timeout_ms":5000,"write_timeout_ms":40000,"max_output_bytes":4096}`)
+	limits, err := loadRunnerLimits(map[string]string{
+		runnerConfigFileVariable:   path,
+		"CJ_RUNNER_RUN_TIMEOUT_MS": "6000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.RunTimeout != 6*time.Second || limits.WriteTimeout != 40*time.Second ||
+		limits.MaxOutputBytes != 4096 || limits.CompileTimeout != compileTimeout {
+		t.Fatalf("limits = %+v", limits)
+	}
+	// Unset ceilings follow the effective limits.
+	if limits.MaxRunTimeout != 6*time.Second || limits.MaxCombinedOutputBytes != 8192 {
+		t.Fatalf("limits = %+v", limits)
+	}
+}
+
+func TestLoadRunnerLimitsRejectsInvalidSettings(t *testing.T) {
+	for name, test := range map[string]struct {
+		file        string
+		environment map[string]string
+	}{
+		"unknown file key":               {file: `{"run_timeout":5000}`},
+		"file value in seconds":          {file: `{"run_timeout_ms":"5s"}`},
+		"file value out of range":        {file: `{"max_output_bytes":2000000}`},
+		"file not an object":             {file: `[]`},
+		"trailing file data":             {file: `{} {}`},
+		"environment not integer":        {environment: map[string]string{"CJ_RUNNER_RUN_TIMEOUT_MS": "8s"}},
+		"environment out of range":       {environment: map[string]string{"CJ_RUNNER_MAX_REQUEST_BYTES": "1000000"}},
+		"write timeout too short":        {environment: map[string]string{"CJ_RUNNER_WRITE_TIMEOUT_MS": "20000"}},
+		"write timeout without coverage": {environment: map[string]string{"CJ_RUNNER_WRITE_TIMEOUT_MS": "25000"}},
+		"ceiling below deadline": {environment: map[string]string{
+			"CJ_RUNNER_RUN_TIMEOUT_MS":     "9000",
+			"CJ_RUNNER_MAX_RUN_TIMEOUT_MS": "8000",
+		}},
+		"header timeout above read timeout": {environment: map[string]string{
+			"CJ_RUNNER_READ_HEADER_TIMEOUT_MS": "20000",
+		}},
+		"combined output above both channels": {environment: map[string]string{
+			"CJ_RUNNER_MAX_OUTPUT_BYTES":          "4096",
+			"CJ_RUNNER_MAX_COMBINED_OUTPUT_BYTES": "10000",
+		}},
+	} {
+		environment := map[string]string{}
+		for key, value := range test.environment {
+			environment[key] = value
+		}
+		if test.file != "" {
+			environment[runnerConfigFileVariable] = writeRunnerConfigFile(t, test.file)
+		}
+		if limits, err := loadRunnerLimits(environment); err == nil {
+			t.Fatalf("%s: accepted %+v", name, limits)
+		}
+	}
+
+	if _, err := loadRunnerLimits(map[string]string{
+		runnerConfigFileVariable: filepath.Join(t.TempDir(), "missing.json"),
+	}); err == nil {
+		t.Fatal("missing config file was accepted")
+	}
+	if _, err := loadRunnerLimits(map[string]string{runnerConfigFileVariable: t.TempDir()}); err == nil {
+		t.Fatal("config directory was accepted")
+	}
+}
+
+func TestDescribeRunnerConfigRedactsSecrets(t *testing.T) {
+	config := runnerConfig{
+		sharedToken:         testSharedToken,
+		toolchainLockSha256: testToolchainLockSHA256,
+		limits:              defaultRunnerLimits(),
+	}
+	description := describeRunnerConfig(config)
+	if strings.Contains(description, testSharedToken) || !strings.Contains(description, "shared_token=<redacted>") ||
+		!strings.Contains(description, "run_timeout_ms=8000") ||
+		!strings.Contains(description, "toolchain_lock_sha256="+testToolchainLockSHA256) {
+		t.Fatalf("description = %s", description)
+	}
+	config.sharedToken = ""
+	if description := describeRunnerConfig(config); !strings.Contains(description, "shared_token=<unset>") {
+		t.Fatalf("description = %s", description)
+	}
+}
+
+func TestConfiguredRequestLimitIsEnforced(t *testing.T) {
+	limits := defaultRunnerLimits()
+	limits.MaxRequestBytes = 1024
+	handler := newRunnerHandler(runnerConfig{
+		sharedToken:         testSharedToken,
+		toolchainLockSha256: testToolchainLockSHA256,
+		limits:              limits,
+	}, testOperations())
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, runnerRequest(http.MethodPost, "/run", "text/plain", strings.Repeat("x", 2048)))
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d body = %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,151 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"time"
+)
+
+type coverageTarget string
+
+const (
+	coverageTargetProgram coverageTarget = "program"
+	// coverageTargetTests builds the package's @Test classes with --test and
+	// runs the generated test driver instead of main.
+	coverageTargetTests coverageTarget = "tests"
+)
+
+const (
+	cangjieCoveragePath = "/cangjie/tools/bin/cjcov"
+	coverageTimeout     = 10 * time.Second
+	// cjcov's Cobertura output is the only machine-readable form it offers.
+	coverageReportName     = "coverage.xml"
+	maxCoverageReportBytes = 16 * 1024 * 1024
+	maxCoverageLines       = 20_000
+)
+
+type coverageLine struct {
+	Line int   `json:"line"`
+	Hits int64 `json:"hits"`
+}
+
+type coverageFile struct {
+	File  string         `json:"file"`
+	Lines []coverageLine `json:"lines"`
+}
+
+// coberturaReport is the subset of the Cobertura schema cjcov fills in.
+type coberturaReport struct {
+	Packages []struct {
+		Classes []struct {
+			Filename string `xml:"filename,attr"`
+			Lines    []struct {
+				Number int   `xml:"number,attr"`
+				Hits   int64 `xml:"hits,attr"`
+			} `xml:"lines>line"`
+		} `xml:"classes>class"`
+	} `xml:"packages>package"`
+}
+
+func coverageArguments(target coverageTarget) []string {
+	if target == coverageTargetTests {
+		return []string{"--coverage", "--test"}
+	}
+	return []string{"--coverage"}
+}
+
+// coverageExecutable is the cjcov collectCoverage runs. Tests replace it with
+// a stand-in.
+var coverageExecutable = cangjieCoveragePath
+
+// collectCoverage post-processes the counters the instrumented program left in
+// the request directory. The directory is learner-controlled by now, so cjcov
+// runs under the learner's identity and the report is opened without
+// following links. The learner decides what cjcov finds: a killed program
+// writes no counters and a running one can delete or corrupt them. A cjcov
+// failure or an unusable report is therefore reported as empty, truncated
+// coverage; only a cjcov that cannot be started is the runner's fault.
+func collectCoverage(ctx context.Context, requestDirectory string, credential *syscall.Credential) ([]coverageFile, bool, error) {
+	result, err := runProcess(ctx, processSpec{
+		executable: coverageExecutable,
+		arguments: []string{
+			"--root=" + requestDirectory,
+			"--xml",
+			"--output=" + filepath.Join(requestDirectory, coverageReportName),
+		},
+		environment:      trustedToolEnvironment(requestDirectory),
+		workingDirectory: requestDirectory,
+		timeout:          coverageTimeout,
+		sandbox:          &learnerSandbox{credential: credential},
+	}, "collect coverage")
+	if err != nil {
+		return nil, false, err
+	}
+	if result.exitCode != 0 {
+		return []coverageFile{}, true, nil
+	}
+	root, err := os.Open(requestDirectory)
+	if err != nil {
+		return nil, false, infrastructureError("open coverage report", err)
+	}
+	defer root.Close()
+	report, err := openBeneath(root, coverageReportName)
+	if err != nil {
+		return []coverageFile{}, true, nil
+	}
+	defer report.Close()
+	if info, err := report.Stat(); err != nil || !info.Mode().IsRegular() {
+		return []coverageFile{}, true, nil
+	}
+	files, truncated, err := parseCoberturaReport(report)
+	if err != nil {
+		return []coverageFile{}, true, nil
+	}
+	return files, truncated, nil
+}
+
+// parseCoberturaReport merges the report's classes per source file and sorts
+// files and lines. Like cappedBuffer, the line limit drops data and flags it.
+func parseCoberturaReport(reader io.Reader) ([]coverageFile, bool, error) {
+	var report coberturaReport
+	if err := xml.NewDecoder(io.LimitReader(reader, maxCoverageReportBytes)).Decode(&report); err != nil {
+		return nil, false, err
+	}
+	byFile := map[string]*coverageFile{}
+	var names []string
+	for _, pkg := range report.Packages {
+		for _, class := range pkg.Classes {
+			file, ok := byFile[class.Filename]
+			if !ok {
+				file = &coverageFile{File: class.Filename, Lines: []coverageLine{}}
+				byFile[class.Filename] = file
+				names = append(names, class.Filename)
+			}
+			for _, line := range class.Lines {
+				file.Lines = append(file.Lines, coverageLine{Line: line.Number, Hits: line.Hits})
+			}
+		}
+	}
+	slices.Sort(names)
+	files := make([]coverageFile, 0, len(names))
+	truncated := false
+	remaining := maxCoverageLines
+	for _, name := range names {
+		file := byFile[name]
+		slices.SortFunc(file.Lines, func(a, b coverageLine) int { return a.Line - b.Line })
+		if len(file.Lines) > remaining {
+			file.Lines = file.Lines[:remaining]
+			truncated = true
+		}
+		remaining -= len(file.Lines)
+		files = append(files, *file)
+	}
+	return files, truncated, nil
+}
@@ -0,0 +1,158 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCoberturaReportMergesAndSortsLines(t *testing.T) {
+	report := `<?xml version="1.0"?>
+<coverage line-rate="0.5">
+  <packages>
+    <package name="default">
+      <classes>
+        <class name="main" filename="main.cj">
+          <lines><line number="4" hits="0"/><line number="2" hits="3"/></lines>
+        </class>
+        <class name="helper" filename="helper.cj">
+          <lines><line number="1" hits="1"/></lines>
+        </class>
+        <class name="main2" filename="main.cj">
+          <lines><line number="3" hits="12"/></lines>
+        </class>
+      </classes>
+    </package>
+  </packages>
+</coverage>`
+	files, truncated, err := parseCoberturaReport(strings.NewReader(report))
+	if err != nil || truncated {
+		t.Fatalf("parse: truncated=%t err=%v", truncated, err)
+	}
+	want := []coverageFile{
+		{File: "helper.cj", Lines: []coverageLine{{Line: 1, Hits: 1}}},
+		{File: "main.cj", Lines: []coverageLine{{Line: 2, Hits: 3}, {Line: 3, Hits: 12}, {Line: 4, Hits: 0}}},
+	}
+	if fmt.Sprint(files) != fmt.Sprint(want) {
+		t.Fatalf("coverage = %+v, want %+v", files, want)
+	}
+}
+
+func TestParseCoberturaReportCapsLines(t *testing.T) {
+	var lines strings.Builder
+	for line := 1; line <= maxCoverageLines+1; line++ {
+		fmt.Fprintf(&lines, `<line number="%d" hits="1"/>`, line)
+	}
+	report := `<coverage><packages><package><classes><class filename="main.cj"><lines>` +
+		lines.String() + `</lines></class></classes></package></packages></coverage>`
+	files, truncated, err := parseCoberturaReport(strings.NewReader(report))
+	if err != nil || !truncated || len(files) != 1 || len(files[0].Lines) != maxCoverageLines {
+		t.Fatalf("truncated=%t err=%v files=%d", truncated, err, len(files))
+	}
+}
+
+func TestBuildPlanInstrumentsCoverageBuilds(t *testing.T) {
+	program := buildPlan("/playground/run-1", runReq{Mode: runModeCoverage})[0].arguments
+	if !slices.Contains(program, "--coverage") || slices.Contains(program, "--test") {
+		t.Fatalf("program coverage arguments = %q", program)
+	}
+	tests := buildPlan("/playground/run-1", runReq{Mode: runModeCoverage, CoverageTarget: coverageTargetTests})[0].arguments
+	if !slices.Contains(tests, "--coverage") || !slices.Contains(tests, "--test") {
+		t.Fatalf("test coverage arguments = %q", tests)
+	}
+	if slices.Contains(buildPlan("/playground/run-1", runReq{})[0].arguments, "--coverage") {
+		t.Fatal("run mode build is instrumented")
+	}
+}
+
+func TestRunRequestCoverageMode(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseRun}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost, "/run", "application/json",
+		`{"code":"main() {}","mode":"coverage","coverage_target":"tests","stdin":"1"}`,
+	))
+	if recorder.Code != http.StatusOK || received.Mode != runModeCoverage ||
+		received.CoverageTarget != coverageTargetTests || received.Stdin != "1" {
+		t.Fatalf("status = %d received=%+v", recorder.Code, received)
+	}
+	for _, body := range []string{
+		`{"code":"","coverage_target":"program"}`,
+		`{"code":"","mode":"coverage","coverage_target":"branches"}`,
+		`{"code":"","mode":"check","coverage_target":"tests"}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/run", "application/json", body))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestTimedOutCoverageProgramReportsTruncatedCoverage(t *testing.T) {
+	useLearnerReachableLauncher(t)
+	root := learnerReachableTempDir(t)
+	requestDirectory, err := os.MkdirTemp(root, "run-")
+	if err != nil {
+		t.Fatalf("create request directory: %v", err)
+	}
+	program := filepath.Join(requestDirectory, "main")
+	if err := os.WriteFile(program, []byte("#!/bin/sh\nexec sleep 10\n"), 0o755); err != nil {
+		t.Fatalf("write program stand-in: %v", err)
+	}
+	credential := nextLearnerCredential()
+	if err := grantLearnerDirectory(requestDirectory, credential); err != nil {
+		t.Fatalf("grant request directory: %v", err)
+	}
+	result, err := runProcess(context.Background(), processSpec{
+		executable:       program,
+		workingDirectory: requestDirectory,
+		timeout:          300 * time.Millisecond,
+		sandbox:          &learnerSandbox{credential: credential},
+	}, "run learner binary")
+	if err != nil || !result.timedOut {
+		t.Fatalf("program result = %+v, %v", result, err)
+	}
+
+	cjcov := filepath.Join(root, "cjcov")
+	previous := coverageExecutable
+	coverageExecutable = cjcov
+	t.Cleanup(func() { coverageExecutable = previous })
+	for name, script := range map[string]string{
+		// The killed program flushed no counters, which cjcov rejects.
+		"no counters":    "#!/bin/sh\necho 'no .gcda files found' >&2\nexit 1\n",
+		"no report":      "#!/bin/sh\nexit 0\n",
+		"corrupt report": "#!/bin/sh\necho '<coverage' > coverage.xml\n",
+	} {
+		if err := os.WriteFile(cjcov, []byte(script), 0o755); err != nil {
+			t.Fatalf("write cjcov stand-in: %v", err)
+		}
+		_ = os.Remove(filepath.Join(requestDirectory, coverageReportName))
+		files, truncated, err := collectCoverage(context.Background(), requestDirectory, credential)
+		if err != nil || len(files) != 0 || !truncated {
+			t.Fatalf("%s: coverage = %+v truncated=%t err=%v", name, files, truncated, err)
+		}
+	}
+
+	// A cjcov that cannot be started is still the runner's fault.
+	coverageExecutable = filepath.Join(root, "missing-cjcov")
+	var infrastructureFailure *runnerInfrastructureError
+	if _, _, err := collectCoverage(context.Background(), requestDirectory, credential); !errors.As(err, &infrastructureFailure) {
+		t.Fatalf("missing cjcov error = %v", err)
+	}
+}
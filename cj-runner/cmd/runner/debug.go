@@ -0,0 +1,499 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+const (
+	cangjieDebuggerPath = "/cangjie/tools/bin/cjdb"
+	// The debugger replaces the run phase and shares its budget.
+	debugTimeout = runTimeout
+
+	debugScriptName     = "debug.cjdb"
+	debugStdinName      = "debug.stdin"
+	debugStdoutName     = "debug.stdout"
+	debugStderrName     = "debug.stderr"
+	defaultDebugStops   = 20
+	maxDebugStops       = 100
+	maxDebugBreakpoints = 32
+	maxDebugWatches     = 16
+	maxDebugWatchBytes  = 256
+	maxDebugFrames      = 32
+	maxDebugVariables   = 64
+	maxDebugValueBytes  = 1024
+
+	// debugFramePrefix marks the frame lines the script's frame-format
+	// produces, so backtraces parse without depending on cjdb's default layout.
+	debugFramePrefix = "@frame "
+)
+
+// debugInfoArguments make cjc emit the DWARF the debugger needs.
+var debugInfoArguments = []string{"-g"}
+
+type debugBreakpoint struct {
+	File string
+	Line int
+}
+
+type debugReq struct {
+	Code        string
+	Stdin       string
+	Breakpoints []debugBreakpoint
+	Watches     []string
+	MaxStops    int
+	// EveryLine replaces the breakpoints with one on every line of main.cj,
+	// which is how trace mode single-steps the learner's own code.
+	EveryLine bool
+	// Timeout replaces the server's run deadline when set.
+	Timeout time.Duration
+	// ProtocolVersion selects the shape of a compile failure, as on /run.
+	ProtocolVersion int
+	limits          runnerLimits
+}
+
+// build is the compile request behind a debug session.
+func (in debugReq) build() runReq {
+	return runReq{Code: in.Code, Mode: runModeDebug, ProtocolVersion: in.ProtocolVersion, limits: in.limits}
+}
+
+type debugFrame struct {
+	Index    int    `json:"index"`
+	Function string `json:"function,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+}
+
+type debugVariable struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type debugWatch struct {
+	Expression string `json:"expression"`
+	Type       string `json:"type,omitempty"`
+	Value      string `json:"value,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type debugStop struct {
+	Reason  string          `json:"reason"`
+	Frames  []debugFrame    `json:"frames"`
+	Locals  []debugVariable `json:"locals"`
+	Watches []debugWatch    `json:"watches,omitempty"`
+}
+
+// debugMessage reports the program like runMessage does. BinCode is null when
+// the program was still running at the stop limit or the deadline.
+type debugMessage struct {
+	Stops              []debugStop `json:"stops"`
+	StopsTruncated     bool        `json:"stops_truncated"`
+	TimedOut           bool        `json:"timed_out"`
+	BinStdout          string      `json:"bin_stdout"`
+	BinStdoutTruncated bool        `json:"bin_stdout_truncated"`
+	BinStderr          string      `json:"bin_stderr"`
+	BinStderrTruncated bool        `json:"bin_stderr_truncated"`
+	BinCode            *int        `json:"bin_code"`
+}
+
+type debugSession struct {
+	compile runMessage
+	message debugMessage
+}
+
+func parseDebugRequest(body []byte) (debugReq, error) {
+	var wire struct {
+		Code        json.RawMessage `json:"code"`
+		Stdin       json.RawMessage `json:"stdin"`
+		Breakpoints json.RawMessage `json:"breakpoints"`
+		Watch       json.RawMessage `json:"watch"`
+		MaxStops    json.RawMessage `json:"max_stops"`
+		Protocol    json.RawMessage `json:"protocol_version"`
+	}
+	if err := decodeStrictJSON(body, &wire); err != nil {
+		return debugReq{}, err
+	}
+	if wire.Code == nil {
+		return debugReq{}, errors.New("code is required")
+	}
+	in := debugReq{MaxStops: defaultDebugStops}
+	if err := decodeRequestField(wire.Code, &in.Code, "code must be a string"); err != nil {
+		return debugReq{}, err
+	}
+	if wire.Stdin != nil {
+		if err := decodeRequestField(wire.Stdin, &in.Stdin, "stdin must be a string"); err != nil {
+			return debugReq{}, err
+		}
+	}
+	if wire.Breakpoints != nil {
+		var locations []string
+		if err := decodeRequestField(wire.Breakpoints, &locations, "breakpoints must be an array of strings"); err != nil {
+			return debugReq{}, err
+		}
+		breakpoints, err := parseDebugBreakpoints(locations)
+		if err != nil {
+			return debugReq{}, err
+		}
+		in.Breakpoints = breakpoints
+	}
+	if wire.Watch != nil {
+		if err := decodeRequestField(wire.Watch, &in.Watches, "watch must be an array of strings"); err != nil {
+			return debugReq{}, err
+		}
+		if err := validateDebugWatches(in.Watches); err != nil {
+			return debugReq{}, err
+		}
+	}
+	if wire.MaxStops != nil {
+		if err := decodeRequestField(wire.MaxStops, &in.MaxStops, "max_stops must be an integer"); err != nil {
+			return debugReq{}, err
+		}
+		if in.MaxStops < 1 || in.MaxStops > maxDebugStops {
+			return debugReq{}, fmt.Errorf("max_stops must be 1-%d", maxDebugStops)
+		}
+	}
+	if wire.Protocol != nil {
+		// Support is checked with the header in negotiateProtocolVersion.
+		if err := decodeRequestField(wire.Protocol, &in.ProtocolVersion, "protocol_version must be an integer"); err != nil {
+			return debugReq{}, err
+		}
+		if in.ProtocolVersion < 1 {
+			return debugReq{}, errors.New("protocol_version must be positive")
+		}
+	}
+	return in, nil
+}
+
+// parseDebugBreakpoints accepts "file:line" locations in the request's only
+// source file.
+func parseDebugBreakpoints(locations []string) ([]debugBreakpoint, error) {
+	if len(locations) > maxDebugBreakpoints {
+		return nil, fmt.Errorf("breakpoints must contain at most %d entries", maxDebugBreakpoints)
+	}
+	breakpoints := make([]debugBreakpoint, 0, len(locations))
+	for _, location := range locations {
+		file, lineText, ok := strings.Cut(location, ":")
+		line, err := strconv.Atoi(lineText)
+		if !ok || file != "main.cj" || err != nil || line < 1 {
+			return nil, fmt.Errorf("breakpoint %q must be main.cj:<line>", location)
+		}
+		breakpoints = append(breakpoints, debugBreakpoint{File: file, Line: line})
+	}
+	return breakpoints, nil
+}
+
+// validateDebugWatches keeps each expression on one script line; a line
+// break would let a watch inject debugger commands.
+func validateDebugWatches(watches []string) error {
+	if len(watches) > maxDebugWatches {
+		return fmt.Errorf("watch must contain at most %d expressions", maxDebugWatches)
+	}
+	for _, watch := range watches {
+		if strings.TrimSpace(watch) == "" || len(watch) > maxDebugWatchBytes ||
+			strings.IndexFunc(watch, unicode.IsControl) != -1 {
+			return fmt.Errorf("watch expression %q is not allowed", watch)
+		}
+	}
+	return nil
+}
+
+// debugScript drives one batch session: launch, then for every stop record
+// the backtrace, locals and watches before continuing. The commands are
+// returned too, because cjdb echoes each one and the echoes delimit its
+// output.
+func debugScript(requestDirectory string, in debugReq) (string, []string) {
+	commands := []string{
+		"settings set auto-confirm true",
+		// Containers commonly refuse the personality change ASLR control needs.
+		"settings set target.disable-aslr false",
+		"settings set stop-line-count-before 0",
+		"settings set stop-line-count-after 0",
+		"settings set stop-disassembly-display never",
+		`settings set frame-format "` + debugFramePrefix +
+			`${frame.index}|{${function.name-without-args}}|{${line.file.fullpath}}|{${line.number}}\n"`,
+		"target create " + filepath.Join(requestDirectory, "main"),
+	}
+	if in.EveryLine {
+		commands = append(commands, "breakpoint set --file main.cj --source-pattern-regexp .")
+	}
+	for _, breakpoint := range in.Breakpoints {
+		commands = append(commands, fmt.Sprintf("breakpoint set --file %s --line %d", breakpoint.File, breakpoint.Line))
+	}
+	commands = append(commands, "process launch"+
+		" -i "+filepath.Join(requestDirectory, debugStdinName)+
+		" -o "+filepath.Join(requestDirectory, debugStdoutName)+
+		" -e "+filepath.Join(requestDirectory, debugStderrName))
+	for range in.MaxStops {
+		commands = append(commands, "thread backtrace", "frame variable")
+		for _, watch := range in.Watches {
+			commands = append(commands, "expression -- "+watch)
+		}
+		commands = append(commands, "continue")
+	}
+	commands = append(commands, "process kill")
+	return strings.Join(commands, "\n") + "\n", commands
+}
+
+var (
+	debugEchoLine     = regexp.MustCompile(`^\((?:cjdb|lldb)\) (.*)$`)
+	debugStopReason   = regexp.MustCompile(`stop reason = (.+)$`)
+	debugProcessExit  = regexp.MustCompile(`^Process \d+ exited with status = (-?\d+)`)
+	debugVariableLine = regexp.MustCompile(`^\((.+?)\) ([^\s=]+) = (.*)$`)
+	debugFrameLine    = regexp.MustCompile(`^[\s*]*` + debugFramePrefix + `(\d+)\|([^|]*)\|([^|]*)\|(\d*)$`)
+)
+
+// parseDebugTrace splits cjdb's output at the echoed commands and reads each
+// command's output as the script intended. Commands after the program exits
+// only print errors and are ignored, and lines longer than limit end the scan.
+func parseDebugTrace(output string, commands []string, requestDirectory string, limit int) ([]debugStop, *int) {
+	stops := []debugStop{}
+	var exitCode *int
+	command := ""
+	next, commandLine := 0, 0
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), limit)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := debugEchoLine.FindStringSubmatch(line); match != nil && next < len(commands) && match[1] == commands[next] {
+			command = commands[next]
+			next, commandLine = next+1, 0
+			continue
+		}
+		commandLine++
+		if exitCode != nil {
+			continue
+		}
+		switch {
+		case command == "continue" || strings.HasPrefix(command, "process launch"):
+			if match := debugProcessExit.FindStringSubmatch(line); match != nil {
+				code, _ := strconv.Atoi(match[1])
+				exitCode = &code
+			} else if match := debugStopReason.FindStringSubmatch(line); match != nil {
+				stops = append(stops, debugStop{Reason: match[1], Frames: []debugFrame{}, Locals: []debugVariable{}})
+			}
+		case len(stops) == 0:
+		case command == "thread backtrace":
+			stop := &stops[len(stops)-1]
+			if match := debugFrameLine.FindStringSubmatch(line); match != nil && len(stop.Frames) < maxDebugFrames {
+				stop.Frames = append(stop.Frames, parseDebugFrame(match, requestDirectory))
+			}
+		case command == "frame variable":
+			stop := &stops[len(stops)-1]
+			if match := debugVariableLine.FindStringSubmatch(line); match != nil {
+				if len(stop.Locals) < maxDebugVariables {
+					stop.Locals = append(stop.Locals, debugVariable{
+						Name:  match[2],
+						Type:  match[1],
+						Value: validUTF8Within(match[3], maxDebugValueBytes),
+					})
+				}
+			} else if len(stop.Locals) != 0 {
+				// Aggregates continue on the following lines.
+				last := &stop.Locals[len(stop.Locals)-1]
+				last.Value = validUTF8Within(last.Value+"\n"+line, maxDebugValueBytes)
+			}
+		case strings.HasPrefix(command, "expression -- "):
+			stop := &stops[len(stops)-1]
+			if commandLine == 1 {
+				stop.Watches = append(stop.Watches, parseDebugWatch(strings.TrimPrefix(command, "expression -- "), line))
+			} else {
+				last := &stop.Watches[len(stop.Watches)-1]
+				last.Value = validUTF8Within(last.Value+"\n"+line, maxDebugValueBytes)
+			}
+		}
+	}
+	return stops, exitCode
+}
+
+func parseDebugFrame(match []string, requestDirectory string) debugFrame {
+	index, _ := strconv.Atoi(match[1])
+	line, _ := strconv.Atoi(match[4])
+	file := match[3]
+	if relative, ok := strings.CutPrefix(file, requestDirectory+"/"); ok {
+		file = relative
+	}
+	return debugFrame{
+		Index:    index,
+		Function: validUTF8Within(match[2], maxDebugValueBytes),
+		File:     validUTF8Within(file, maxDebugValueBytes),
+		Line:     line,
+	}
+}
+
+// parseDebugWatch reads the first output line of an expression command,
+// "(Type) $0 = value" or "error: message".
+func parseDebugWatch(expression, line string) debugWatch {
+	watch := debugWatch{Expression: expression}
+	if message, ok := strings.CutPrefix(line, "error: "); ok {
+		watch.Error = validUTF8Within(message, maxDebugValueBytes)
+	} else if match := debugVariableLine.FindStringSubmatch(line); match != nil {
+		watch.Type = match[1]
+		watch.Value = validUTF8Within(match[3], maxDebugValueBytes)
+	} else {
+		watch.Value = validUTF8Within(line, maxDebugValueBytes)
+	}
+	return watch
+}
+
+func debugProgram(ctx context.Context, in debugReq) (debugSession, error) {
+	build := in.build()
+	srcDir, err := createRequestDirectory(build)
+	if err != nil {
+		return debugSession{compile: runMessage{Phase: runPhaseCompile}}, err
+	}
+	defer os.RemoveAll(srcDir)
+
+	credential := nextLearnerCredential()
+	msg, err := compileRequest(ctx, srcDir, build, credential)
+	if err != nil || msg.CompilerCode != 0 {
+		return debugSession{compile: msg}, err
+	}
+	if err := grantLearnerBuild(srcDir, build, credential); err != nil {
+		return debugSession{compile: msg}, err
+	}
+	message, err := runDebugger(ctx, cangjieDebuggerPath, srcDir, in, credential)
+	return debugSession{compile: msg, message: message}, err
+}
+
+// runDebugger runs cjdb in batch mode over the compiled program in a request
+// directory already granted to credential. The debugger and the program share
+// the learner identity: cjdb must trace the program, and everything it reads
+// back is learner-writable by then. Seccomp stays off because the filter
+// refuses ptrace.
+func runDebugger(
+	ctx context.Context,
+	debugger, requestDirectory string,
+	in debugReq,
+	credential *syscall.Credential,
+) (debugMessage, error) {
+	script, commands := debugScript(requestDirectory, in)
+	outputBytes := in.limits.orDefaults().MaxOutputBytes
+	if err := writeDebuggerInputs(requestDirectory, map[string]string{
+		debugScriptName: script,
+		debugStdinName:  in.Stdin,
+	}, credential); err != nil {
+		return debugMessage{}, infrastructureError("write debugger input", err)
+	}
+	result, err := runProcess(ctx, processSpec{
+		executable:       debugger,
+		arguments:        []string{"--batch", "--no-lldbinit", "--source", filepath.Join(requestDirectory, debugScriptName)},
+		environment:      runtimeEnvironment(requestDirectory),
+		workingDirectory: requestDirectory,
+		timeout:          cmp.Or(in.Timeout, in.limits.RunTimeout, debugTimeout),
+		output:           outputRetention{channelBytes: outputBytes},
+		sandbox:          &learnerSandbox{credential: credential},
+	}, "debug learner binary")
+	if err != nil {
+		return debugMessage{}, err
+	}
+	message := debugMessage{TimedOut: result.timedOut}
+	message.Stops, message.BinCode = parseDebugTrace(result.stdout.content, commands, requestDirectory, outputBytes)
+	message.StopsTruncated = result.stdout.truncated ||
+		(message.BinCode == nil && !result.timedOut && len(message.Stops) == in.MaxStops)
+
+	root, err := os.Open(requestDirectory)
+	if err != nil {
+		return debugMessage{}, infrastructureError("open debugger output", err)
+	}
+	defer root.Close()
+	stdout, err := readDebugOutput(root, debugStdoutName, outputBytes)
+	if err != nil {
+		return debugMessage{}, infrastructureError("read debugger output", err)
+	}
+	stderr, err := readDebugOutput(root, debugStderrName, outputBytes)
+	if err != nil {
+		return debugMessage{}, infrastructureError("read debugger output", err)
+	}
+	message.BinStdout, message.BinStdoutTruncated = stdout.content, stdout.truncated
+	message.BinStderr, message.BinStderrTruncated = stderr.content, stderr.truncated
+	return message, nil
+}
+
+// writeDebuggerInputs replaces the named files in the learner-owned request
+// directory without following links the learner may have left in their place.
+func writeDebuggerInputs(requestDirectory string, inputs map[string]string, owner *syscall.Credential) error {
+	root, err := os.Open(requestDirectory)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	for name, content := range inputs {
+		if err := syscall.Unlinkat(int(root.Fd()), name); err != nil && !errors.Is(err, syscall.ENOENT) {
+			return err
+		}
+		if err := createBeneath(root, name, []byte(content), owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDebugOutput reads a program output file with the run phase's cap of
+// limit bytes. A missing file means the program never started.
+func readDebugOutput(root *os.File, name string, limit int) (outputChannel, error) {
+	file, err := openBeneath(root, name)
+	if errors.Is(err, os.ErrNotExist) {
+		return outputChannel{}, nil
+	}
+	if err != nil {
+		return outputChannel{}, err
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err != nil || !info.Mode().IsRegular() {
+		return outputChannel{}, errors.New("program output is not a regular file")
+	}
+	buffer := &cappedBuffer{cap: limit}
+	if _, err := io.Copy(buffer, io.LimitReader(file, int64(limit)+1)); err != nil {
+		return outputChannel{}, err
+	}
+	return buffer.Result(), nil
+}
+
+func (s *runnerServer) handleDebug(w http.ResponseWriter, r *http.Request) {
+	body, _, ok := s.readToolRequest(w, r, true)
+	if !ok {
+		return
+	}
+	in, err := parseDebugRequest(body)
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			"invalid_json_body",
+			`JSON body must contain a string "code" field and only supported, well-typed debugger fields.`,
+		)
+		return
+	}
+	if !negotiateProtocolVersion(w, r, &in.ProtocolVersion) {
+		return
+	}
+	in.limits = s.config.limits
+	session, err := s.operations.debug(r.Context(), in)
+	if err != nil {
+		writeOperationError(w, r, err)
+		return
+	}
+	if session.compile.CompilerCode != 0 {
+		// Nothing ran; the compile diagnostics use the /run shape.
+		writeRunMessage(w, http.StatusUnprocessableEntity, in.build(), session.compile)
+		return
+	}
+	writeJSON(w, http.StatusOK, session.message)
+}
@@ -0,0 +1,185 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseDebugRequest(t *testing.T) {
+	in, err := parseDebugRequest([]byte(
+		`{"code":"main() {}","stdin":"1","breakpoints":["main.cj:3","main.cj:10"],"watch":["x + 1"],"max_stops":5}`,
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := debugReq{
+		Code:        "main() {}",
+		Stdin:       "1",
+		Breakpoints: []debugBreakpoint{{File: "main.cj", Line: 3}, {File: "main.cj", Line: 10}},
+		Watches:     []string{"x + 1"},
+		MaxStops:    5,
+	}
+	if fmt.Sprint(in) != fmt.Sprint(want) {
+		t.Fatalf("request = %+v, want %+v", in, want)
+	}
+	if in, err := parseDebugRequest([]byte(`{"code":""}`)); err != nil || in.MaxStops != defaultDebugStops {
+		t.Fatalf("default request = %+v, err = %v", in, err)
+	}
+}
+
+func TestDebugRejectsInvalidRequests(t *testing.T) {
+	for _, body := range []string{
+		`{"stdin":""}`,
+		`{"code":"","breakpoints":["lib.cj:3"]}`,
+		`{"code":"","breakpoints":["main.cj:0"]}`,
+		`{"code":"","breakpoints":["main.cj"]}`,
+		`{"code":"","watch":["x\nprocess kill"]}`,
+		`{"code":"","watch":[" "]}`,
+		`{"code":"","max_stops":0}`,
+		`{"code":"","max_stops":101}`,
+		`{"code":"","mode":"run"}`,
+		`{"code":"","protocol_version":0}`,
+		`{"code":"","protocol_version":9}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/debug", "application/json", body))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/debug", "text/plain", "main() {}"))
+	if recorder.Code != http.StatusUnsupportedMediaType ||
+		!strings.Contains(recorder.Body.String(), `"unsupported_media_type"`) {
+		t.Fatalf("text/plain status = %d; body=%s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestDebugReportsCompileFailureInRunShape(t *testing.T) {
+	operations := testOperations()
+	operations.debug = func(context.Context, debugReq) (debugSession, error) {
+		return debugSession{compile: runMessage{Phase: runPhaseCompile, CompilerOutput: "error", CompilerCode: 1}}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/debug", "application/json", `{"code":""}`))
+	var message runMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &message); err != nil ||
+		recorder.Code != http.StatusUnprocessableEntity || message.CompilerCode != 1 ||
+		strings.Contains(recorder.Body.String(), "protocol_version") {
+		t.Fatalf("status = %d body = %s", recorder.Code, recorder.Body.String())
+	}
+	headerRequest := runnerRequest(http.MethodPost, "/debug", "application/json", `{"code":""}`)
+	headerRequest.Header.Set(protocolVersionHeader, "2")
+	for _, request := range []*http.Request{
+		runnerRequest(http.MethodPost, "/debug", "application/json", `{"code":"","protocol_version":2}`),
+		headerRequest,
+	} {
+		recorder = httptest.NewRecorder()
+		testHandler(operations).ServeHTTP(recorder, request)
+		var versioned runMessageV2
+		if err := json.Unmarshal(recorder.Body.Bytes(), &versioned); err != nil ||
+			recorder.Code != http.StatusUnprocessableEntity || versioned.ProtocolVersion != 2 || versioned.CompilerCode != 1 {
+			t.Fatalf("v2 status = %d body = %s", recorder.Code, recorder.Body.String())
+		}
+	}
+
+	recorder = httptest.NewRecorder()
+	testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/debug", "application/json", `{"code":""}`))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), `"stops":[]`) {
+		t.Fatalf("status = %d body = %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestDebugScriptRecordsEveryStop(t *testing.T) {
+	script, commands := debugScript("/playground/run-1", debugReq{
+		Breakpoints: []debugBreakpoint{{File: "main.cj", Line: 4}},
+		Watches:     []string{"total"},
+		MaxStops:    2,
+	})
+	if !strings.Contains(script, "breakpoint set --file main.cj --line 4\n") ||
+		!strings.HasSuffix(script, "process kill\n") {
+		t.Fatalf("script = %q", script)
+	}
+	launch := slices.IndexFunc(commands, func(command string) bool { return strings.HasPrefix(command, "process launch") })
+	want := []string{
+		"thread backtrace", "frame variable", "expression -- total", "continue",
+		"thread backtrace", "frame variable", "expression -- total", "continue",
+		"process kill",
+	}
+	if launch < 0 || !slices.Equal(commands[launch+1:], want) {
+		t.Fatalf("commands = %q", commands)
+	}
+}
+
+func TestParseDebugTrace(t *testing.T) {
+	_, commands := debugScript("/playground/run-1", debugReq{Watches: []string{"total", "missing"}, MaxStops: 3})
+	var output strings.Builder
+	// Everything up to the launch is echoed; the rest is written out below.
+	for _, command := range commands {
+		fmt.Fprintf(&output, "(cjdb) %s\n", command)
+		if strings.HasPrefix(command, "process launch") {
+			break
+		}
+	}
+	output.WriteString(`Process 42 launched: '/playground/run-1/main' (x86_64)
+Process 42 stopped
+* thread #1, name = 'main', stop reason = breakpoint 1.1
+    @frame 0|default::add|/playground/run-1/main.cj|4
+(cjdb) thread backtrace
+* thread #1, name = 'main', stop reason = breakpoint 1.1
+  * @frame 0|default::add|/playground/run-1/main.cj|4
+    @frame 1|default::main|/playground/run-1/main.cj|9
+    @frame 2|||
+(cjdb) frame variable
+(Int64) a = 1
+(Point) p = {
+  x = 2
+}
+(cjdb) expression -- total
+(Int64) $0 = 3
+(cjdb) expression -- missing
+error: use of undeclared identifier 'missing'
+(cjdb) continue
+Process 42 resuming
+Process 42 exited with status = 7 (0x00000007)
+(cjdb) thread backtrace
+error: invalid thread
+(cjdb) frame variable
+error: invalid process
+`)
+	stops, exitCode := parseDebugTrace(output.String(), commands, "/playground/run-1", maxSerializedOutputBytes)
+	if exitCode == nil || *exitCode != 7 || len(stops) != 1 {
+		t.Fatalf("stops = %+v, exit = %v", stops, exitCode)
+	}
+	stop := stops[0]
+	wantFrames := []debugFrame{
+		{Index: 0, Function: "default::add", File: "main.cj", Line: 4},
+		{Index: 1, Function: "default::main", File: "main.cj", Line: 9},
+		{Index: 2},
+	}
+	if stop.Reason != "breakpoint 1.1" || !slices.Equal(stop.Frames, wantFrames) {
+		t.Fatalf("stop = %+v", stop)
+	}
+	wantLocals := []debugVariable{
+		{Name: "a", Type: "Int64", Value: "1"},
+		{Name: "p", Type: "Point", Value: "{\n  x = 2\n}"},
+	}
+	if !slices.Equal(stop.Locals, wantLocals) {
+		t.Fatalf("locals = %q", stop.Locals)
+	}
+	wantWatches := []debugWatch{
+		{Expression: "total", Type: "Int64", Value: "3"},
+		{Expression: "missing", Error: "use of undeclared identifier 'missing'"},
+	}
+	if !slices.Equal(stop.Watches, wantWatches) {
+		t.Fatalf("watches = %+v", stop.Watches)
+	}
+}
@@ -0,0 +1,288 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Formatting is an editor round trip, so it gets a deadline far below the
+	// compile budget. A formatter that overruns it is reported to the caller
+	// like a learner timeout rather than as an infrastructure failure.
+	formatTimeout = 3 * time.Second
+
+	diffPath             = "/usr/bin/diff"
+	formatSourceName     = "main.cj"
+	formattedSourceName  = "formatted.cj"
+	maxFormatDiagnostics = 64
+)
+
+type formatReq struct {
+	Code   string
+	Diff   bool
+	limits runnerLimits
+}
+
+type formatDiagnostic struct {
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+type formatMessage struct {
+	Formatted string `json:"formatted"`
+	Changed   bool   `json:"changed"`
+	// Diff is present whenever the request asked for it, even when empty.
+	Diff          *string `json:"diff,omitempty"`
+	DiffTruncated bool    `json:"diff_truncated,omitempty"`
+}
+
+// formatFailure is the error body of a formatter failure: the writeError body
+// with the formatter's diagnostics attached.
+type formatFailure struct {
+	Code        string             `json:"code"`
+	Error       string             `json:"error"`
+	Diagnostics []formatDiagnostic `json:"diagnostics"`
+}
+
+func writeFormatFailure(w http.ResponseWriter, status int, code, message string, diagnostics []formatDiagnostic) {
+	writeJSON(w, status, formatFailure{Code: code, Error: message, Diagnostics: diagnostics})
+}
+
+type formatResult struct {
+	message     formatMessage
+	diagnostics []formatDiagnostic
+	failed      bool
+	timedOut    bool
+}
+
+func parseFormatRequest(body []byte, mediaType string) (formatReq, error) {
+	if mediaType == "text/plain" {
+		return formatReq{Code: string(body)}, nil
+	}
+	var wire struct {
+		Code json.RawMessage `json:"code"`
+		Diff json.RawMessage `json:"diff"`
+	}
+	if err := decodeStrictJSON(body, &wire); err != nil {
+		return formatReq{}, err
+	}
+	if wire.Code == nil {
+		return formatReq{}, errors.New("code is required")
+	}
+	var in formatReq
+	if err := decodeRequestField(wire.Code, &in.Code, "code must be a string"); err != nil {
+		return formatReq{}, err
+	}
+	if wire.Diff != nil {
+		if err := decodeRequestField(wire.Diff, &in.Diff, "diff must be a boolean"); err != nil {
+			return formatReq{}, err
+		}
+	}
+	return in, nil
+}
+
+func formatSource(ctx context.Context, in formatReq) (formatResult, error) {
+	return runFormatter(ctx, cangjieFormatterPath, playgroundDirectory, in)
+}
+
+// runFormatter formats in.Code with the formatter binary in a scratch
+// directory below parent. cjfmt is trusted toolchain code and, like cjc, runs
+// under the runner identity.
+func runFormatter(ctx context.Context, formatter, parent string, in formatReq) (formatResult, error) {
+	directory, err := os.MkdirTemp(parent, "format-")
+	if err != nil {
+		return formatResult{}, infrastructureError("create format directory", err)
+	}
+	defer os.RemoveAll(directory)
+	if err := os.WriteFile(filepath.Join(directory, formatSourceName), []byte(in.Code), 0o600); err != nil {
+		return formatResult{}, infrastructureError("write format source", err)
+	}
+	outputBytes := in.limits.orDefaults().MaxOutputBytes
+
+	result, err := runProcess(ctx, processSpec{
+		executable:       formatter,
+		arguments:        []string{"-f", formatSourceName, "-o", formattedSourceName},
+		environment:      trustedToolEnvironment(directory),
+		workingDirectory: directory,
+		timeout:          formatTimeout,
+		output:           outputRetention{channelBytes: outputBytes},
+	}, "format")
+	if err != nil {
+		return formatResult{}, err
+	}
+	if result.timedOut {
+		return formatResult{timedOut: true}, nil
+	}
+	if result.exitCode != 0 {
+		output := combineOutputChannels(outputBytes, result.stdout, result.stderr)
+		return formatResult{failed: true, diagnostics: parseFormatDiagnostics(output.content, outputBytes)}, nil
+	}
+
+	formatted, err := readFormattedSource(filepath.Join(directory, formattedSourceName), outputBytes)
+	if errors.Is(err, errFormattedSourceTooLarge) {
+		// The source is the learner's; only its formatted form is too large.
+		return formatResult{failed: true, diagnostics: []formatDiagnostic{{Message: err.Error()}}}, nil
+	}
+	if err != nil {
+		return formatResult{}, infrastructureError("read formatted source", err)
+	}
+	message := formatMessage{Formatted: formatted, Changed: formatted != in.Code}
+	if in.Diff {
+		diff, truncated, err := unifiedDiff(ctx, directory, message.Changed, outputBytes)
+		if err != nil {
+			return formatResult{}, err
+		}
+		message.Diff, message.DiffTruncated = &diff, truncated
+	}
+	return formatResult{message: message}, nil
+}
+
+// errFormattedSourceTooLarge reports a formatted source above the output
+// limit. Unlike other output it cannot be cut short and still be useful.
+var errFormattedSourceTooLarge = errors.New("formatted source exceeds the output limit")
+
+func readFormattedSource(path string, limit int) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, int64(limit)+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > limit {
+		return "", fmt.Errorf("%w of %d bytes", errFormattedSourceTooLarge, limit)
+	}
+	return strings.ToValidUTF8(string(data), "\uFFFD"), nil
+}
+
+// unifiedDiff compares the source with its formatted form using diff(1),
+// labelled so the patch applies to the learner's file name. The patch is cut
+// at outputBytes.
+func unifiedDiff(ctx context.Context, directory string, changed bool, outputBytes int) (string, bool, error) {
+	if !changed {
+		return "", false, nil
+	}
+	result, err := runProcess(ctx, processSpec{
+		executable: diffPath,
+		arguments: []string{
+			"-u",
+			"--label", "a/" + formatSourceName,
+			"--label", "b/" + formatSourceName,
+			formatSourceName,
+			formattedSourceName,
+		},
+		environment:             trustedToolEnvironment(directory),
+		workingDirectory:        directory,
+		timeout:                 formatTimeout,
+		timeoutIsInfrastructure: true,
+		output:                  outputRetention{channelBytes: outputBytes},
+	}, "diff formatted source")
+	if err != nil {
+		return "", false, err
+	}
+	// diff exits 1 when the inputs differ and 2 on trouble.
+	if result.exitCode != 1 {
+		return "", false, infrastructureError(
+			"diff formatted source",
+			fmt.Errorf("diff exited with %d: %s", result.exitCode, result.stderr.content),
+		)
+	}
+	return result.stdout.content, result.stdout.truncated, nil
+}
+
+// parseFormatDiagnostics extracts locations from cjfmt's cjc-style reports:
+// an "error: message" line followed by a " ==> file:line:column:" locator.
+// Output the parser does not recognise is returned as a single message so
+// the caller never loses the formatter's explanation. Lines longer than limit
+// end the scan.
+func parseFormatDiagnostics(output string, limit int) []formatDiagnostic {
+	var diagnostics []formatDiagnostic
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), limit)
+	for scanner.Scan() && len(diagnostics) < maxFormatDiagnostics {
+		line := strings.TrimSpace(scanner.Text())
+		if message, ok := strings.CutPrefix(line, "error:"); ok {
+			diagnostics = append(diagnostics, formatDiagnostic{Message: strings.TrimSpace(message)})
+			continue
+		}
+		locator, ok := strings.CutPrefix(line, "==>")
+		if !ok || len(diagnostics) == 0 || diagnostics[len(diagnostics)-1].Line != 0 {
+			continue
+		}
+		fields := strings.Split(strings.TrimSuffix(strings.TrimSpace(locator), ":"), ":")
+		if len(fields) < 3 {
+			continue
+		}
+		lineNumber, lineErr := strconv.Atoi(fields[len(fields)-2])
+		column, columnErr := strconv.Atoi(fields[len(fields)-1])
+		if lineErr == nil && columnErr == nil {
+			diagnostics[len(diagnostics)-1].Line = lineNumber
+			diagnostics[len(diagnostics)-1].Column = column
+		}
+	}
+	if len(diagnostics) == 0 {
+		message := strings.TrimSpace(output)
+		if message == "" {
+			message = "cjfmt could not format the source."
+		}
+		diagnostics = append(diagnostics, formatDiagnostic{Message: message})
+	}
+	return diagnostics
+}
+
+func (s *runnerServer) handleFormat(w http.ResponseWriter, r *http.Request) {
+	body, mediaType, ok := s.readToolRequest(w, r, false)
+	if !ok {
+		return
+	}
+	in, err := parseFormatRequest(body, mediaType)
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			"invalid_json_body",
+			`JSON body must contain a string "code" field and an optional boolean "diff" field.`,
+		)
+		return
+	}
+	in.limits = s.config.limits
+	result, err := s.operations.format(r.Context(), in)
+	if err != nil {
+		writeOperationError(w, r, err)
+		return
+	}
+	switch {
+	case result.timedOut:
+		writeError(
+			w,
+			http.StatusUnprocessableEntity,
+			"format_timeout",
+			"Formatting exceeded the "+formatTimeout.String()+" deadline.",
+		)
+	case result.failed:
+		writeFormatFailure(
+			w,
+			http.StatusUnprocessableEntity,
+			"format_failed",
+			"Source could not be formatted.",
+			result.diagnostics,
+		)
+	default:
+		writeJSON(w, http.StatusOK, result.message)
+	}
+}
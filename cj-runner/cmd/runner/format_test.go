@@ -0,0 +1,180 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFakeFormatter installs a shell script that accepts cjfmt's -f/-o
+// arguments and collapses runs of spaces, or fails like cjfmt on "@".
+func writeFakeFormatter(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cjfmt")
+	script := `#!/bin/sh
+if grep -q @ "$2"; then
+	printf 'error: unexpected token @\n ==> main.cj:2:5:\n  |\n' >&2
+	exit 1
+fi
+sed 's/  */ /g' "$2" > "$4"
+`
+	if err := os.WriteFile(path, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunFormatterReturnsFormattedSourceAndDiff(t *testing.T) {
+	formatter := writeFakeFormatter(t)
+	result, err := runFormatter(context.Background(), formatter, t.TempDir(), formatReq{
+		Code: "main()  {\n    let x = 1\n}\n",
+		Diff: true,
+	})
+	if err != nil || result.failed || result.timedOut {
+		t.Fatalf("format: result=%+v err=%v", result, err)
+	}
+	message := result.message
+	if message.Formatted != "main() {\n let x = 1\n}\n" || !message.Changed || message.Diff == nil {
+		t.Fatalf("message = %+v", message)
+	}
+	for _, line := range []string{"--- a/main.cj", "+++ b/main.cj", "-main()  {", "+main() {"} {
+		if !strings.Contains(*message.Diff, line) {
+			t.Fatalf("diff lacks %q:\n%s", line, *message.Diff)
+		}
+	}
+
+	result, err = runFormatter(context.Background(), formatter, t.TempDir(), formatReq{Code: "main() {}\n", Diff: true})
+	if err != nil || result.message.Changed || result.message.Diff == nil || *result.message.Diff != "" {
+		t.Fatalf("unchanged source: result=%+v err=%v", result, err)
+	}
+}
+
+func TestRunFormatterReportsStructuredErrors(t *testing.T) {
+	result, err := runFormatter(context.Background(), writeFakeFormatter(t), t.TempDir(), formatReq{Code: "main() {\n    @\n}\n"})
+	if err != nil || !result.failed {
+		t.Fatalf("format: result=%+v err=%v", result, err)
+	}
+	want := formatDiagnostic{Line: 2, Column: 5, Message: "unexpected token @"}
+	if len(result.diagnostics) != 1 || result.diagnostics[0] != want {
+		t.Fatalf("diagnostics = %+v, want %+v", result.diagnostics, want)
+	}
+}
+
+func TestRunFormatterHonoursTheOutputLimit(t *testing.T) {
+	formatter := writeFakeFormatter(t)
+	limits := defaultRunnerLimits()
+	limits.MaxOutputBytes = 24
+	result, err := runFormatter(context.Background(), formatter, t.TempDir(), formatReq{
+		Code:   "a  b\n",
+		Diff:   true,
+		limits: limits,
+	})
+	if err != nil || result.failed || result.message.Diff == nil ||
+		!result.message.DiffTruncated || len(*result.message.Diff) > limits.MaxOutputBytes {
+		t.Fatalf("diff over the limit: result=%+v err=%v", result, err)
+	}
+
+	result, err = runFormatter(context.Background(), formatter, t.TempDir(), formatReq{
+		Code:   strings.Repeat("x", limits.MaxOutputBytes+1),
+		limits: limits,
+	})
+	if err != nil || !result.failed || len(result.diagnostics) != 1 ||
+		!strings.Contains(result.diagnostics[0].Message, "output limit") {
+		t.Fatalf("formatted source over the limit: result=%+v err=%v", result, err)
+	}
+}
+
+func TestParseFormatDiagnosticsKeepsUnrecognisedOutput(t *testing.T) {
+	diagnostics := parseFormatDiagnostics("cjfmt: internal failure\n", maxSerializedOutputBytes)
+	if len(diagnostics) != 1 || diagnostics[0].Message != "cjfmt: internal failure" || diagnostics[0].Line != 0 {
+		t.Fatalf("diagnostics = %+v", diagnostics)
+	}
+	diagnostics = parseFormatDiagnostics("error: first\n ==> main.cj:1:2:\nerror: second\n", maxSerializedOutputBytes)
+	if len(diagnostics) != 2 || diagnostics[0].Line != 1 || diagnostics[1].Message != "second" || diagnostics[1].Line != 0 {
+		t.Fatalf("diagnostics = %+v", diagnostics)
+	}
+}
+
+func TestFormatEndpoint(t *testing.T) {
+	var received formatReq
+	operations := testOperations()
+	operations.format = func(_ context.Context, in formatReq) (formatResult, error) {
+		received = in
+		diff := ""
+		return formatResult{message: formatMessage{Formatted: in.Code, Diff: &diff}}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost, "/format", "application/json", `{"code":"main() {}","diff":true}`,
+	))
+	if recorder.Code != http.StatusOK || received.Code != "main() {}" || !received.Diff ||
+		received.limits != defaultRunnerLimits() {
+		t.Fatalf("status = %d received=%+v body=%s", recorder.Code, received, recorder.Body.String())
+	}
+	var wire map[string]json.RawMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &wire); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if string(wire["diff"]) != `""` || string(wire["changed"]) != "false" {
+		t.Fatalf("response = %s", recorder.Body.String())
+	}
+
+	for _, tc := range []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{"text/plain", "main() {}", http.StatusOK},
+		{"application/json", `{"code":null}`, http.StatusBadRequest},
+		{"application/json", `{"code":"","diff":"yes"}`, http.StatusBadRequest},
+		{"application/json", `{"code":"","stdin":""}`, http.StatusBadRequest},
+		{"application/json", `{"code":""} {}`, http.StatusBadRequest},
+		{"application/xml", "<code/>", http.StatusUnsupportedMediaType},
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/format", tc.contentType, tc.body))
+		if recorder.Code != tc.status {
+			t.Fatalf("%s %s status = %d, want %d", tc.contentType, tc.body, recorder.Code, tc.status)
+		}
+	}
+
+	request := runnerRequest(http.MethodPost, "/format", "text/plain", "main() {}")
+	request.Header.Del("Authorization")
+	recorder = httptest.NewRecorder()
+	testHandler(testOperations()).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated status = %d", recorder.Code)
+	}
+}
+
+func TestFormatEndpointReportsFailures(t *testing.T) {
+	for _, tc := range []struct {
+		result formatResult
+		code   string
+	}{
+		{formatResult{failed: true, diagnostics: []formatDiagnostic{{Line: 1, Column: 1, Message: "bad"}}}, "format_failed"},
+		{formatResult{timedOut: true}, "format_timeout"},
+	} {
+		operations := testOperations()
+		operations.format = func(context.Context, formatReq) (formatResult, error) { return tc.result, nil }
+		recorder := httptest.NewRecorder()
+		testHandler(operations).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/format", "text/plain", "x"))
+		var failure formatFailure
+		if err := json.Unmarshal(recorder.Body.Bytes(), &failure); err != nil {
+			t.Fatalf("decode failure: %v", err)
+		}
+		if recorder.Code != http.StatusUnprocessableEntity || failure.Code != tc.code {
+			t.Fatalf("status = %d body=%s, want 422 %s", recorder.Code, recorder.Body.String(), tc.code)
+		}
+		if tc.code == "format_failed" && (len(failure.Diagnostics) != 1 || failure.Diagnostics[0].Line != 1) {
+			t.Fatalf("diagnostics = %+v", failure.Diagnostics)
+		}
+	}
+}
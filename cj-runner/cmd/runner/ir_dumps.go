@@ -0,0 +1,177 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+type irDumpKind string
+
+const (
+	irDumpAST      irDumpKind = "ast"
+	irDumpCHIR     irDumpKind = "chir"
+	irDumpLLVMIR   irDumpKind = "llvm_ir"
+	irDumpAssembly irDumpKind = "asm"
+)
+
+const (
+	// The main step keeps its intermediate object here for disassembly.
+	irTemporaryDirectoryName = "ir-temps"
+	objdumpPath              = "/usr/bin/objdump"
+	disassembleTimeout       = 5 * time.Second
+)
+
+// irDumpSuffixes names the text files each compiler dump option writes. cjc
+// places them in per-package subdirectories of the output directory, so they
+// are matched a few levels deep.
+var irDumpSuffixes = map[irDumpKind]string{
+	irDumpAST:    ".ast",
+	irDumpCHIR:   ".chirtxt",
+	irDumpLLVMIR: ".ll",
+}
+
+type irDump struct {
+	Kind      irDumpKind   `json:"kind"`
+	Files     []outputFile `json:"files"`
+	Truncated bool         `json:"truncated"`
+}
+
+func parseIRDumpKinds(kinds []irDumpKind) error {
+	if len(kinds) == 0 {
+		return errors.New("dumps must name at least one of ast, chir, llvm_ir or asm")
+	}
+	for index, kind := range kinds {
+		if _, ok := irDumpSuffixes[kind]; !ok && kind != irDumpAssembly {
+			return fmt.Errorf("unsupported dump %q", kind)
+		}
+		if slices.Contains(kinds[:index], kind) {
+			return fmt.Errorf("dump %q is requested twice", kind)
+		}
+	}
+	return nil
+}
+
+// irDumpArguments adds the dump options for the main build step.
+func irDumpArguments(requestDirectory string, kinds []irDumpKind) []string {
+	var arguments []string
+	for _, kind := range kinds {
+		switch kind {
+		case irDumpAST:
+			arguments = append(arguments, "--dump-ast")
+		case irDumpCHIR:
+			arguments = append(arguments, "--dump-chir")
+		case irDumpLLVMIR:
+			arguments = append(arguments, "--dump-ir")
+		case irDumpAssembly:
+			arguments = append(arguments, "--save-temps="+filepath.Join(requestDirectory, irTemporaryDirectoryName))
+		}
+	}
+	return arguments
+}
+
+func irDumpPatterns(suffix string) []string {
+	return []string{"*" + suffix, "*/*" + suffix, "*/*/*" + suffix}
+}
+
+// collectIRDumps gathers the requested dumps in request order. Each kind gets
+// an output file budget of outputBytes of its own; a kind the compiler did not
+// reach, for example assembly after a type error, is reported with no files.
+func collectIRDumps(
+	ctx context.Context,
+	requestDirectory string,
+	kinds []irDumpKind,
+	outputBytes int,
+	sandbox *learnerSandbox,
+) ([]irDump, error) {
+	dumps := make([]irDump, 0, len(kinds))
+	for _, kind := range kinds {
+		dump := irDump{Kind: kind}
+		var err error
+		if kind == irDumpAssembly {
+			dump.Files, dump.Truncated, err = disassembleObjects(ctx, requestDirectory, outputBytes, sandbox)
+		} else {
+			dump.Files, dump.Truncated, err = collectOutputFiles(
+				requestDirectory, irDumpPatterns(irDumpSuffixes[kind]), outputBytes,
+			)
+		}
+		if err != nil {
+			return dumps, infrastructureError("collect "+string(kind)+" dump", err)
+		}
+		if dump.Files == nil {
+			dump.Files = []outputFile{}
+		}
+		dumps = append(dumps, dump)
+	}
+	return dumps, nil
+}
+
+// disassembleObjects renders the saved object files of the main step. cjc has
+// no textual assembly output, so the view is objdump's disassembly of the code
+// the learner's own package contributed, without the linked runtime, in at
+// most outputBytes. A non-nil sandbox runs objdump as the learner that owns
+// the objects.
+func disassembleObjects(
+	ctx context.Context,
+	requestDirectory string,
+	outputBytes int,
+	sandbox *learnerSandbox,
+) ([]outputFile, bool, error) {
+	temporaryDirectory := filepath.Join(requestDirectory, irTemporaryDirectoryName)
+	objects, err := filepath.Glob(filepath.Join(temporaryDirectory, "*.o"))
+	if err != nil {
+		return nil, false, err
+	}
+	slices.Sort(objects)
+	if len(objects) == 0 {
+		return nil, false, nil
+	}
+	// Debian installs objdump as a link to its target-prefixed binary, and
+	// processCommand only executes regular files.
+	objdump, err := filepath.EvalSymlinks(objdumpPath)
+	if err != nil {
+		return nil, false, err
+	}
+	var files []outputFile
+	truncated := false
+	remaining := outputBytes
+	for _, object := range objects {
+		if remaining <= 0 {
+			truncated = true
+			break
+		}
+		// A relative operand keeps the request path out of the listing header.
+		result, err := runProcess(ctx, processSpec{
+			executable:              objdump,
+			arguments:               []string{"--disassemble", "--no-show-raw-insn", "--no-addresses", filepath.Base(object)},
+			environment:             trustedToolEnvironment(requestDirectory),
+			workingDirectory:        temporaryDirectory,
+			timeout:                 disassembleTimeout,
+			timeoutIsInfrastructure: true,
+			output:                  outputRetention{channelBytes: outputBytes},
+			sandbox:                 sandbox,
+		}, "disassemble object")
+		if err != nil {
+			return nil, false, err
+		}
+		if result.exitCode != 0 {
+			return nil, false, fmt.Errorf("objdump exited with %d: %s", result.exitCode, result.stderr.content)
+		}
+		content := validUTF8Within(result.stdout.content, remaining)
+		remaining -= len(content)
+		files = append(files, outputFile{
+			Path:      strings.TrimSuffix(filepath.Base(object), ".o") + ".s",
+			Encoding:  fileEncodingUTF8,
+			Content:   content,
+			Size:      int64(len(result.stdout.content)),
+			Truncated: result.stdout.truncated || len(content) != len(result.stdout.content),
+		})
+	}
+	return files, truncated, nil
+}
@@ -0,0 +1,129 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestIRDumpArgumentsTargetMainStepOnly(t *testing.T) {
+	in := runReq{
+		Mode:     runModeDump,
+		Dumps:    []irDumpKind{irDumpAST, irDumpCHIR, irDumpLLVMIR, irDumpAssembly},
+		Packages: []packageRequest{{Name: "util", OutputType: packageOutputStaticlib}},
+	}
+	plan := buildPlan("/playground/run-1", in)
+	for _, option := range []string{"--dump-ast", "--dump-chir", "--dump-ir"} {
+		if slices.Contains(plan[0].arguments, option) || !slices.Contains(plan[1].arguments, option) {
+			t.Fatalf("%s placement: package=%q main=%q", option, plan[0].arguments, plan[1].arguments)
+		}
+	}
+	if !slices.Contains(plan[1].arguments, "--save-temps=/playground/run-1/"+irTemporaryDirectoryName) {
+		t.Fatalf("main arguments = %q, want saved temporaries", plan[1].arguments)
+	}
+}
+
+func TestCollectIRDumpsKeepsRequestOrder(t *testing.T) {
+	directory := t.TempDir()
+	for path, content := range map[string]string{
+		"main_AST/main.ast":   "ast",
+		"main.ll":             "define void @main()",
+		"main_CHIR/x.chir":    "binary",
+		"main_CHIR/x.chirtxt": "chir",
+	} {
+		full := filepath.Join(directory, path)
+		if err := os.MkdirAll(filepath.Dir(full), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dumps, err := collectIRDumps(context.Background(), directory, []irDumpKind{irDumpLLVMIR, irDumpCHIR, irDumpAST, irDumpAssembly}, maxSerializedOutputBytes, nil)
+	if err != nil {
+		t.Fatalf("collect dumps: %v", err)
+	}
+	if len(dumps) != 4 {
+		t.Fatalf("dumps = %+v", dumps)
+	}
+	for index, want := range []string{"main.ll", "main_CHIR/x.chirtxt", "main_AST/main.ast"} {
+		if len(dumps[index].Files) != 1 || dumps[index].Files[0].Path != want {
+			t.Fatalf("%s files = %+v, want %s", dumps[index].Kind, dumps[index].Files, want)
+		}
+	}
+	if dumps[3].Kind != irDumpAssembly || dumps[3].Files == nil || len(dumps[3].Files) != 0 {
+		t.Fatalf("assembly without objects = %+v, want an empty file list", dumps[3])
+	}
+}
+
+func TestDisassembleObjectsOmitsRequestPath(t *testing.T) {
+	if _, err := os.Stat(objdumpPath); err != nil {
+		t.Skip("objdump is not installed")
+	}
+	directory := t.TempDir()
+	temporaryDirectory := filepath.Join(directory, irTemporaryDirectoryName)
+	if err := os.Mkdir(temporaryDirectory, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	source := filepath.Join(directory, "f.c")
+	if err := os.WriteFile(source, []byte("int f(int x) { return x + 1; }\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := exec.Command("gcc", "-c", source, "-o", filepath.Join(temporaryDirectory, "main.o")).CombinedOutput(); err != nil {
+		t.Skipf("cannot build a test object: %v: %s", err, output)
+	}
+	files, truncated, err := disassembleObjects(context.Background(), directory, maxSerializedOutputBytes, nil)
+	if err != nil || truncated {
+		t.Fatalf("disassemble: truncated=%t err=%v", truncated, err)
+	}
+	if len(files) != 1 || files[0].Path != "main.s" ||
+		!strings.Contains(files[0].Content, "<f>:") || strings.Contains(files[0].Content, directory) {
+		t.Fatalf("disassembly = %+v", files)
+	}
+}
+
+func TestRunRequestDumpMode(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseCompile}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost, "/run", "application/json", `{"code":"main() {}","mode":"dump","dumps":["chir","asm"]}`,
+	))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d; body=%s", recorder.Code, recorder.Body.String())
+	}
+	if received.Mode != runModeDump || !slices.Equal(received.Dumps, []irDumpKind{irDumpCHIR, irDumpAssembly}) {
+		t.Fatalf("operation received mode=%q dumps=%q", received.Mode, received.Dumps)
+	}
+
+	for _, body := range []string{
+		`{"code":"","mode":"dump"}`,
+		`{"code":"","mode":"dump","dumps":[]}`,
+		`{"code":"","dumps":["ast"]}`,
+		`{"code":"","mode":"dump","dumps":["ast","ast"]}`,
+		`{"code":"","mode":"dump","dumps":["tokens"]}`,
+		`{"code":"","mode":"dump","dumps":["ast"],"stdin":"x"}`,
+		`{"code":"","mode":"explain"}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(
+			recorder,
+			runnerRequest(http.MethodPost, "/run", "application/json", body),
+		)
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
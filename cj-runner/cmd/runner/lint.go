@@ -0,0 +1,269 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cangjieLinterPath = "/cangjie/tools/bin/cjlint"
+	lintTimeout       = 10 * time.Second
+	lintSourceName    = "main.cj"
+	// cjlint appends the format extension to the -o path.
+	lintReportStem        = "report"
+	lintReportName        = lintReportStem + ".json"
+	lintReportDirectory   = "lint-report"
+	maxLintFindings       = 500
+	maxLintReportBytes    = 8 * 1024 * 1024
+	maxLintFindingMessage = 4 * 1024
+)
+
+type lintReq struct {
+	Code   string
+	limits runnerLimits
+}
+
+type lintFinding struct {
+	RuleID    string `json:"rule_id"`
+	Severity  string `json:"severity"`
+	File      string `json:"file"`
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	EndLine   int    `json:"end_line,omitempty"`
+	EndColumn int    `json:"end_column,omitempty"`
+	Message   string `json:"message"`
+}
+
+// lintMessage follows runMessage: tool output is capped and flagged, and a
+// nonzero linter code is a learner result rather than a request failure.
+type lintMessage struct {
+	Findings              []lintFinding `json:"findings"`
+	FindingsTruncated     bool          `json:"findings_truncated"`
+	LinterOutput          string        `json:"linter_output"`
+	LinterOutputTruncated bool          `json:"linter_output_truncated"`
+	LinterCode            int           `json:"linter_code"`
+}
+
+// cjlintReportEntry is one element of cjlint's JSON report.
+type cjlintReportEntry struct {
+	File        string `json:"file"`
+	Line        int    `json:"line"`
+	Column      int    `json:"column"`
+	EndLine     int    `json:"endLine"`
+	EndColumn   int    `json:"endColumn"`
+	Description string `json:"description"`
+	DefectLevel string `json:"defectLevel"`
+	DefectType  string `json:"defectType"`
+}
+
+func parseLintRequest(body []byte, mediaType string) (lintReq, error) {
+	if mediaType == "text/plain" {
+		return lintReq{Code: string(body)}, nil
+	}
+	var wire struct {
+		Code json.RawMessage `json:"code"`
+	}
+	if err := decodeStrictJSON(body, &wire); err != nil {
+		return lintReq{}, err
+	}
+	if wire.Code == nil {
+		return lintReq{}, errors.New("code is required")
+	}
+	var in lintReq
+	if err := decodeRequestField(wire.Code, &in.Code, "code must be a string"); err != nil {
+		return lintReq{}, err
+	}
+	return in, nil
+}
+
+func lintSource(ctx context.Context, in lintReq) (lintMessage, error) {
+	return runLinter(ctx, cangjieLinterPath, playgroundDirectory, in)
+}
+
+// runLinter lints in.Code as a one-file package in a scratch directory below
+// parent. The report is written outside the linted directory.
+func runLinter(ctx context.Context, linter, parent string, in lintReq) (lintMessage, error) {
+	directory, err := os.MkdirTemp(parent, "lint-")
+	if err != nil {
+		return lintMessage{}, infrastructureError("create lint directory", err)
+	}
+	defer os.RemoveAll(directory)
+	sourceDirectory := filepath.Join(directory, "src")
+	reportDirectory := filepath.Join(directory, lintReportDirectory)
+	for _, path := range []string{sourceDirectory, reportDirectory} {
+		if err := os.Mkdir(path, 0o700); err != nil {
+			return lintMessage{}, infrastructureError("create lint directory", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(sourceDirectory, lintSourceName), []byte(in.Code), 0o600); err != nil {
+		return lintMessage{}, infrastructureError("write lint source", err)
+	}
+	outputBytes := in.limits.orDefaults().MaxOutputBytes
+
+	result, err := runProcess(ctx, processSpec{
+		executable: linter,
+		arguments: []string{
+			"-f", sourceDirectory,
+			"-r", "json",
+			"-o", filepath.Join(reportDirectory, lintReportStem),
+		},
+		environment:      trustedToolEnvironment(directory),
+		workingDirectory: directory,
+		timeout:          lintTimeout,
+		output:           outputRetention{channelBytes: outputBytes},
+	}, "lint")
+	if err != nil {
+		return lintMessage{}, err
+	}
+	output := combineOutputChannels(outputBytes, result.stdout, result.stderr)
+	msg := lintMessage{
+		LinterOutput:          output.content,
+		LinterOutputTruncated: output.truncated,
+		LinterCode:            result.exitCode,
+	}
+	if result.timedOut {
+		msg.Findings = []lintFinding{}
+		return msg, nil
+	}
+	report, err := os.Open(filepath.Join(reportDirectory, lintReportName))
+	switch {
+	case err == nil:
+		defer report.Close()
+		msg.Findings, msg.FindingsTruncated, err = readLintReport(report, sourceDirectory)
+		if err != nil {
+			return lintMessage{}, infrastructureError("parse lint report", err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		// Without a report, fall back to the findings cjlint printed.
+		msg.Findings, msg.FindingsTruncated = parseLintText(output.content, sourceDirectory, outputBytes)
+	default:
+		return lintMessage{}, infrastructureError("open lint report", err)
+	}
+	return msg, nil
+}
+
+// readLintReport streams the report array so a huge report only costs the
+// findings that are kept. A report cut off by maxLintReportBytes keeps the
+// findings decoded before the cut; only a malformed report is an error.
+func readLintReport(report io.Reader, sourceDirectory string) ([]lintFinding, bool, error) {
+	limited := &io.LimitedReader{R: report, N: maxLintReportBytes}
+	decoder := json.NewDecoder(limited)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return nil, false, errors.New("lint report is not a JSON array")
+	}
+	// cutOff reports whether a decode error came from the limit rather than
+	// from the report itself.
+	cutOff := func() bool {
+		if limited.N != 0 {
+			return false
+		}
+		n, _ := report.Read(make([]byte, 1))
+		return n != 0
+	}
+	findings := []lintFinding{}
+	for decoder.More() {
+		if len(findings) == maxLintFindings {
+			return findings, true, nil
+		}
+		var entry cjlintReportEntry
+		if err := decoder.Decode(&entry); err != nil {
+			if cutOff() {
+				return findings, true, nil
+			}
+			return nil, false, err
+		}
+		findings = append(findings, lintFinding{
+			RuleID:    entry.DefectType,
+			Severity:  strings.ToLower(entry.DefectLevel),
+			File:      lintRelativePath(entry.File, sourceDirectory),
+			Line:      entry.Line,
+			Column:    entry.Column,
+			EndLine:   entry.EndLine,
+			EndColumn: entry.EndColumn,
+			Message:   validUTF8Within(entry.Description, maxLintFindingMessage),
+		})
+	}
+	// More also stops at the end of input, so the array must still close.
+	if _, err := decoder.Token(); err != nil {
+		if cutOff() {
+			return findings, true, nil
+		}
+		return nil, false, err
+	}
+	return findings, false, nil
+}
+
+// lintTextFinding matches cjlint's console form,
+// "file:line:column: LEVEL: RULE.ID message".
+var lintTextFinding = regexp.MustCompile(`^(\S+\.cj):(\d+):(\d+):\s*(?:(\w+):\s*)?([A-Z][A-Z0-9]*(?:\.[A-Z0-9]+)+)\s+(.*)$`)
+
+func parseLintText(output, sourceDirectory string, limit int) ([]lintFinding, bool) {
+	findings := []lintFinding{}
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), limit)
+	for scanner.Scan() {
+		match := lintTextFinding.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if match == nil {
+			continue
+		}
+		if len(findings) == maxLintFindings {
+			return findings, true
+		}
+		line, _ := strconv.Atoi(match[2])
+		column, _ := strconv.Atoi(match[3])
+		findings = append(findings, lintFinding{
+			RuleID:   match[5],
+			Severity: strings.ToLower(match[4]),
+			File:     lintRelativePath(match[1], sourceDirectory),
+			Line:     line,
+			Column:   column,
+			Message:  validUTF8Within(match[6], maxLintFindingMessage),
+		})
+	}
+	return findings, false
+}
+
+// lintRelativePath hides the scratch directory from learners.
+func lintRelativePath(path, sourceDirectory string) string {
+	if relative, err := filepath.Rel(sourceDirectory, path); err == nil && filepath.IsAbs(path) &&
+		!strings.HasPrefix(relative, "..") {
+		return relative
+	}
+	return filepath.Base(path)
+}
+
+func (s *runnerServer) handleLint(w http.ResponseWriter, r *http.Request) {
+	body, mediaType, ok := s.readToolRequest(w, r, false)
+	if !ok {
+		return
+	}
+	in, err := parseLintRequest(body, mediaType)
+	if err != nil {
+		writeError(
+			w,
+			http.StatusBadRequest,
+			"invalid_json_body",
+			`JSON body must contain only a string "code" field.`,
+		)
+		return
+	}
+	in.limits = s.config.limits
+	message, err := s.operations.lint(r.Context(), in)
+	if err != nil {
+		writeOperationError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, message)
+}
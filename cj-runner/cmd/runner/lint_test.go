@@ -0,0 +1,133 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFakeLinter installs a script that accepts cjlint's -f/-r/-o arguments.
+// With report it writes a JSON report for the linted file; otherwise it only
+// prints the finding, as cjlint does for its console format.
+func writeFakeLinter(t *testing.T, report bool) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cjlint")
+	script := `#!/bin/sh
+printf '%s/main.cj:2:5: MANDATORY: G.VAR.01 prefer let over var\n' "$2"
+`
+	if report {
+		script += `printf '[{"file":"%s/main.cj","line":2,"column":5,"endLine":2,"endColumn":12,` +
+			`"analyzerName":"x","description":"prefer let over var","defectLevel":"MANDATORY",` +
+			`"defectType":"G.VAR.01","language":"cangjie"}]' "$2" > "$6.json"
+`
+	}
+	script += "exit 1\n"
+	if err := os.WriteFile(path, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunLinterParsesReport(t *testing.T) {
+	want := lintFinding{
+		RuleID:    "G.VAR.01",
+		Severity:  "mandatory",
+		File:      "main.cj",
+		Line:      2,
+		Column:    5,
+		EndLine:   2,
+		EndColumn: 12,
+		Message:   "prefer let over var",
+	}
+	message, err := runLinter(context.Background(), writeFakeLinter(t, true), t.TempDir(), lintReq{Code: "main() {\n    var x = 1\n}\n"})
+	if err != nil {
+		t.Fatalf("lint: %v", err)
+	}
+	if message.LinterCode != 1 || len(message.Findings) != 1 || message.Findings[0] != want || message.FindingsTruncated {
+		t.Fatalf("message = %+v", message)
+	}
+
+	message, err = runLinter(context.Background(), writeFakeLinter(t, false), t.TempDir(), lintReq{Code: "main() {}"})
+	want.EndLine, want.EndColumn = 0, 0
+	if err != nil || len(message.Findings) != 1 || message.Findings[0] != want {
+		t.Fatalf("text fallback: message=%+v err=%v", message, err)
+	}
+	if strings.Contains(message.Findings[0].File, "/") {
+		t.Fatalf("finding exposes scratch path %q", message.Findings[0].File)
+	}
+}
+
+func TestReadLintReportCapsFindings(t *testing.T) {
+	entries := make([]string, maxLintFindings+1)
+	for index := range entries {
+		entries[index] = fmt.Sprintf(`{"file":"/src/main.cj","line":%d,"defectType":"G.X.01"}`, index+1)
+	}
+	findings, truncated, err := readLintReport(strings.NewReader("["+strings.Join(entries, ",")+"]"), "/src")
+	if err != nil || !truncated || len(findings) != maxLintFindings {
+		t.Fatalf("findings=%d truncated=%t err=%v", len(findings), truncated, err)
+	}
+	if _, _, err := readLintReport(strings.NewReader(`{"file":"x"}`), "/src"); err == nil {
+		t.Fatal("non-array report was accepted")
+	}
+}
+
+func TestReadLintReportKeepsFindingsBeforeTheByteLimit(t *testing.T) {
+	description := strings.Repeat("x", 64*1024)
+	entries := make([]string, maxLintReportBytes/len(description)+2)
+	for index := range entries {
+		entries[index] = fmt.Sprintf(`{"file":"/src/main.cj","line":%d,"defectType":"G.X.01","description":%q}`, index+1, description)
+	}
+	findings, truncated, err := readLintReport(strings.NewReader("["+strings.Join(entries, ",")+"]"), "/src")
+	if err != nil || !truncated || len(findings) == 0 || len(findings) >= len(entries) {
+		t.Fatalf("findings=%d truncated=%t err=%v", len(findings), truncated, err)
+	}
+	for _, report := range []string{`[{"file":"/src/main.cj","line":`, `[{"file":"/src/main.cj"}`} {
+		if _, _, err := readLintReport(strings.NewReader(report), "/src"); err == nil {
+			t.Fatalf("malformed report %s within the limit was accepted", report)
+		}
+	}
+}
+
+func TestLintEndpoint(t *testing.T) {
+	var received lintReq
+	operations := testOperations()
+	operations.lint = func(_ context.Context, in lintReq) (lintMessage, error) {
+		received = in
+		return lintMessage{Findings: []lintFinding{{RuleID: "G.VAR.01", Line: 1}}, LinterCode: 1}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/lint", "application/json", `{"code":"var x = 1"}`))
+	if recorder.Code != http.StatusOK || received.Code != "var x = 1" || received.limits != defaultRunnerLimits() {
+		t.Fatalf("status = %d received=%+v body=%s", recorder.Code, received, recorder.Body.String())
+	}
+	var wire map[string]json.RawMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &wire); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	for _, field := range []string{"findings", "findings_truncated", "linter_output", "linter_output_truncated", "linter_code"} {
+		if _, ok := wire[field]; !ok {
+			t.Fatalf("lint response omits %s: %s", field, recorder.Body.String())
+		}
+	}
+
+	for _, body := range []string{`{"code":"","diff":true}`, `{"code":1}`, `{}`} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/lint", "application/json", body))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+	recorder = httptest.NewRecorder()
+	testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodGet, "/lint", "", ""))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("GET status = %d", recorder.Code)
+	}
+}
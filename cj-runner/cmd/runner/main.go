@@ -1,9 +1,15 @@
 // cj-runner is the Cangjie compile/run process embedded in a single-use Modal
 // container. Modal owns the request isolation and resource boundary; this
-// process only validates input, invokes the compiler and learner executable,
-// caps output, and enforces wall-clock deadlines.
+// process only validates input, invokes the compiler, runs the learner
+// executable under a dedicated unprivileged identity, caps output, and
+// enforces wall-clock deadlines.
 // The endpoint is POST /run ({code,stdin} JSON or raw), returning the canonical
-// RunMessage JSON shape. Formatting runs locally in the browser through WASM.
+// RunMessage JSON shape; POST /artifacts compiles the same body and streams the
+// build products. POST /format runs cjfmt for clients without the browser's
+// WASM formatter, POST /lint reports cjlint findings, and POST /debug runs the
+// program under cjdb with breakpoints. GET /capabilities lists the protocol
+// versions and features this runner supports, and GET /openapi.json describes
+// the API.
 //
 //go:build linux
 
@@ -18,11 +24,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log"
 	"mime"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
@@ -31,8 +39,38 @@ import (
 )
 
 type runReq struct {
-	Code  string `json:"code"`
-	Stdin string `json:"stdin"`
+	Code          string `json:"code"`
+	Stdin         string `json:"stdin"`
+	Seccomp       bool   `json:"seccomp"`
+	Deterministic bool   `json:"deterministic"`
+	// RuntimeOptions holds validated, canonical Cangjie runtime variables.
+	RuntimeOptions map[string]string `json:"runtime_options"`
+	Args           []string          `json:"args"`
+	Env            map[string]string `json:"env"`
+	Files          []seedFile        `json:"-"`
+	OutputFiles    []string          `json:"output_files"`
+	Packages       []packageRequest  `json:"packages"`
+	MacroExpansion bool              `json:"macro_expansion"`
+	Mode           runMode           `json:"mode"`
+	Dumps          []irDumpKind      `json:"dumps"`
+	CoverageTarget coverageTarget    `json:"coverage_target"`
+	Sanitizer      sanitizerKind     `json:"sanitizer"`
+	CLibrary       *cLibraryRequest  `json:"c_library"`
+	Benchmark      *benchmarkRequest `json:"benchmark"`
+	TraceSteps     int               `json:"trace_steps"`
+	// Zero budgets use compileTimeout and runTimeout.
+	CompileTimeoutMs int `json:"compile_timeout_ms"`
+	RunTimeoutMs     int `json:"run_timeout_ms"`
+	// OutputBudget narrows how much program output is kept; nil keeps the
+	// server's limits.
+	OutputBudget *outputBudget `json:"output_budget"`
+	// Transcript asks for stdout and stderr interleaved as they arrived.
+	Transcript bool `json:"transcript"`
+	// ProtocolVersion is the response protocol the client opted into; zero
+	// keeps the v1 shape.
+	ProtocolVersion int `json:"protocol_version"`
+	// limits are the server's; the zero value stands for the defaults.
+	limits runnerLimits
 }
 
 type runPhase string
@@ -40,6 +78,71 @@ type runPhase string
 const (
 	runPhaseCompile runPhase = "compile"
 	runPhaseRun     runPhase = "run"
+	// runPhaseCheck marks a check-mode response, which never reaches codegen.
+	runPhaseCheck runPhase = "check"
+)
+
+// runMode selects how far a request goes. The zero value behaves as run.
+type runMode string
+
+const (
+	runModeRun   runMode = "run"
+	runModeDump  runMode = "dump"
+	runModeCheck runMode = "check"
+	// runModeCoverage runs an instrumented build and reports line hits.
+	runModeCoverage runMode = "coverage"
+	// runModeSanitize runs a sanitizer build and parses its reports.
+	runModeSanitize runMode = "sanitize"
+	// runModeBenchmark runs an optimised build repeatedly and reports timing
+	// statistics.
+	runModeBenchmark runMode = "benchmark"
+	// runModeDebug builds with debug info for POST /debug; /run does not
+	// accept it.
+	runModeDebug runMode = "debug"
+	// runModeTrace runs the debug build under cjdb and records every line it
+	// executes.
+	runModeTrace runMode = "trace"
+)
+
+// runRequestModes are the modes /run accepts.
+var runRequestModes = []runMode{
+	runModeRun, runModeDump, runModeCheck, runModeCoverage, runModeSanitize, runModeBenchmark, runModeTrace,
+}
+
+// runsProgram reports whether the mode reaches the run phase.
+func (m runMode) runsProgram() bool {
+	return m == "" || m == runModeRun || m == runModeCoverage || m == runModeSanitize ||
+		m == runModeBenchmark || m == runModeTrace
+}
+
+// sanitizer is the requested sanitizer of a sanitize-mode request.
+func (in runReq) sanitizer() sanitizerKind {
+	if in.Sanitizer == "" {
+		return sanitizerAddress
+	}
+	return in.Sanitizer
+}
+
+// benchmark is the iteration plan of a benchmark-mode request.
+func (in runReq) benchmark() benchmarkRequest {
+	if in.Benchmark == nil {
+		return defaultBenchmarkRequest()
+	}
+	return *in.Benchmark
+}
+
+// traceSteps is the step budget of a trace-mode request.
+func (in runReq) traceSteps() int {
+	if in.TraceSteps == 0 {
+		return defaultTraceSteps
+	}
+	return in.TraceSteps
+}
+
+type terminationReason string
+
+const (
+	terminationBlockedSyscall terminationReason = "blocked_syscall"
 )
 
 type runMessage struct {
@@ -52,6 +155,32 @@ type runMessage struct {
 	BinStderr               string   `json:"bin_stderr"`
 	BinStderrTruncated      bool     `json:"bin_stderr_truncated"`
 	BinCode                 *int     `json:"bin_code"`
+	// Optional fields are omitted unless the request opted into the feature
+	// that produces them, so the default response keeps its exact shape.
+	TerminationReason    terminationReason `json:"termination_reason,omitempty"`
+	DeterministicKnobs   []string          `json:"deterministic_knobs,omitempty"`
+	RuntimeOptions       map[string]string `json:"runtime_options,omitempty"`
+	OutputFiles          []outputFile      `json:"output_files,omitempty"`
+	OutputFilesTruncated bool              `json:"output_files_truncated,omitempty"`
+	BuildSteps           []buildStep       `json:"build_steps,omitempty"`
+	// Macro expansions reuse the output file shape and budget.
+	MacroExpansions          []outputFile      `json:"macro_expansions,omitempty"`
+	MacroExpansionsTruncated bool              `json:"macro_expansions_truncated,omitempty"`
+	IRDumps                  []irDump          `json:"ir_dumps,omitempty"`
+	Coverage                 []coverageFile    `json:"coverage,omitempty"`
+	CoverageTruncated        bool              `json:"coverage_truncated,omitempty"`
+	SanitizerReports         []sanitizerReport `json:"sanitizer_reports,omitempty"`
+	Benchmark                *benchmarkResult  `json:"benchmark,omitempty"`
+	Trace                    []traceStep       `json:"trace,omitempty"`
+	TraceTruncated           bool              `json:"trace_truncated,omitempty"`
+	TimeBudget               *timeBudget       `json:"time_budget,omitempty"`
+	OutputBudget             *outputBudget     `json:"output_budget,omitempty"`
+	// Omitted byte counts are reported only to requests with an output
+	// budget; an absent count means nothing was left out.
+	BinStdoutOmittedBytes int64             `json:"bin_stdout_omitted_bytes,omitempty"`
+	BinStderrOmittedBytes int64             `json:"bin_stderr_omitted_bytes,omitempty"`
+	Transcript            []transcriptChunk `json:"transcript,omitempty"`
+	TranscriptTruncated   bool              `json:"transcript_truncated,omitempty"`
 }
 
 const (
@@ -71,9 +200,11 @@ const (
 	minSharedTokenBytes = 32
 	maxSharedTokenBytes = 512
 
+	// writeTimeout must outlast a full compile, run and coverage collection at
+	// the default budgets.
 	readHeaderTimeout = 5 * time.Second
 	readTimeout       = 7 * time.Second
-	writeTimeout      = 24 * time.Second
+	writeTimeout      = 34 * time.Second
 	idleTimeout       = 30 * time.Second
 	maxHeaderBytes    = 16 * 1024
 )
@@ -83,7 +214,9 @@ const toolchainLockHeader = "X-Playground-Cangjie-Toolchain-Lock-Sha256"
 const toolchainMismatchHeader = "X-Playground-Cangjie-Toolchain-Status"
 
 const (
+	playgroundDirectory        = "/playground"
 	cangjieCompilerPath        = "/cangjie/bin/cjc"
+	cangjieFormatterPath       = "/cangjie/tools/bin/cjfmt"
 	cangjieToolchainLockPath   = "/usr/share/playground-cj/cangjie-toolchain.lock.json"
 	cangjieToolchainMarkerPath = "/cangjie/.playground-cj-toolchain-lock.sha256"
 )
@@ -91,6 +224,7 @@ const (
 type runnerConfig struct {
 	sharedToken         string
 	toolchainLockSha256 string
+	limits              runnerLimits
 }
 
 type cangjieToolchainLock struct {
@@ -117,7 +251,11 @@ type cangjieToolchainLock struct {
 }
 
 type runnerOperations struct {
-	compileAndRun func(context.Context, string, string) (runMessage, error)
+	compileAndRun  func(context.Context, runReq) (runMessage, error)
+	buildArtifacts func(context.Context, runReq) (artifactBuild, error)
+	format         func(context.Context, formatReq) (formatResult, error)
+	lint           func(context.Context, lintReq) (lintMessage, error)
+	debug          func(context.Context, debugReq) (debugSession, error)
 }
 
 type runnerServer struct {
@@ -128,6 +266,8 @@ type runnerServer struct {
 type outputChannel struct {
 	content   string
 	truncated bool
+	// omittedBytes counts the raw bytes the content leaves out.
+	omittedBytes int64
 }
 
 type processSpec struct {
@@ -138,13 +278,28 @@ type processSpec struct {
 	timeout                 time.Duration
 	timeoutIsInfrastructure bool
 	stdin                   string
+	sandbox                 *learnerSandbox
+	// output is how much of stdout and stderr to keep; the zero value keeps
+	// the start of each up to maxSerializedOutputBytes.
+	output outputRetention
+	// transcript also records both channels interleaved, within the same
+	// retention.
+	transcript bool
 }
 
 type processResult struct {
-	stdout   outputChannel
-	stderr   outputChannel
-	exitCode int
-	timedOut bool
+	stdout              outputChannel
+	stderr              outputChannel
+	transcript          []transcriptChunk
+	transcriptTruncated bool
+	exitCode            int
+	timedOut            bool
+	terminationReason   terminationReason
+	// Resource usage is only measured for processes that exited on their own.
+	// The peak resident set includes the sandbox launcher, which execs in place.
+	wallTime        time.Duration
+	cpuTime         time.Duration
+	peakMemoryBytes int64
 }
 
 type runnerInfrastructureError struct {
@@ -166,51 +321,154 @@ func infrastructureError(operation string, cause error) error {
 
 // cappedBuffer keeps at most cap raw bytes then drops the rest, so a print-bomb
 // cannot OOM the runner. Truncation is protocol metadata, never in-band text.
+// With a tail window the last tailCap of those bytes come from the end of the
+// output, so a crash report after a flood still survives. A shared pool caps
+// the head windows of the channels it is given to together.
 type cappedBuffer struct {
-	mu        sync.Mutex
-	buf       bytes.Buffer
-	cap       int
-	truncated bool
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	tail    []byte
+	cap     int
+	tailCap int
+	pool    *outputPool
+	written int64
 }
 
 func (c *cappedBuffer) Write(p []byte) (int, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if r := c.cap - c.buf.Len(); r <= 0 {
-		c.truncated = true
-		return len(p), nil
-	} else if len(p) > r {
-		c.buf.Write(p[:r])
-		c.truncated = true
-		return len(p), nil
+	c.written += int64(len(p))
+	room := max(c.cap-max(c.tailCap, 0)-c.buf.Len(), 0)
+	head := c.pool.take(min(room, len(p)))
+	c.buf.Write(p[:head])
+	c.keepTail(p[head:])
+	return len(p), nil
+}
+
+// keepTail appends p to the tail window. The window is compacted only once it
+// holds twice its size, so a flood of small writes costs constant time per
+// byte.
+func (c *cappedBuffer) keepTail(p []byte) {
+	if c.tailCap <= 0 || len(p) == 0 {
+		return
+	}
+	if len(p) >= c.tailCap {
+		c.tail = append(c.tail[:0], p[len(p)-c.tailCap:]...)
+		return
 	}
-	return c.buf.Write(p)
+	if len(c.tail)+len(p) > 2*c.tailCap {
+		c.tail = append(c.tail[:0], c.tail[len(c.tail)-(c.tailCap-len(p)):]...)
+	}
+	c.tail = append(c.tail, p...)
 }
 
 func (c *cappedBuffer) Len() int {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.buf.Len()
+	return c.buf.Len() + min(len(c.tail), max(c.tailCap, 0))
 }
 
 func (c *cappedBuffer) Result() outputChannel {
 	c.mu.Lock()
-	maxBytes := c.cap
-	truncated := c.truncated
-	rawOutput := c.buf.String()
+	maxBytes := max(c.cap, 0)
+	written := c.written
+	head := c.buf.String()
+	tail := string(c.tail[len(c.tail)-min(len(c.tail), max(c.tailCap, 0)):])
 	c.mu.Unlock()
 
-	if maxBytes < 0 {
-		maxBytes = 0
+	if written == int64(len(head)+len(tail)) {
+		head, tail = head+tail, ""
+	} else {
+		// Nothing joins the windows any more, so neither keeps a rune
+		// that the gap split.
+		head = head[:completeRunesEnd(head)]
+		tail = tail[splitRuneBytes(tail):]
+	}
+	tailContent, tailUsed := validOutputSuffix(tail, maxBytes)
+	headContent, headUsed := validOutputPrefix(head, maxBytes-len(tailContent))
+	omitted := written - int64(headUsed+tailUsed)
+	return outputChannel{content: headContent + tailContent, truncated: omitted > 0, omittedBytes: omitted}
+}
+
+// completeRunesEnd is the length of value without a trailing incomplete rune.
+func completeRunesEnd(value string) int {
+	for start := len(value) - 1; start >= 0 && start >= len(value)-utf8.UTFMax; start-- {
+		if utf8.RuneStart(value[start]) {
+			if !utf8.FullRuneInString(value[start:]) {
+				return start
+			}
+			break
+		}
+	}
+	return len(value)
+}
+
+// splitRuneBytes counts the continuation bytes value starts with.
+func splitRuneBytes(value string) int {
+	count := 0
+	for count < len(value) && count < utf8.UTFMax-1 && !utf8.RuneStart(value[count]) {
+		count++
+	}
+	return count
+}
+
+// validOutputPrefix returns the longest start of raw that fits in maxBytes
+// once invalid bytes are replaced as strings.ToValidUTF8 replaces them, with
+// the number of raw bytes it covers.
+func validOutputPrefix(raw string, maxBytes int) (string, int) {
+	if len(raw) <= maxBytes && utf8.ValidString(raw) {
+		return raw, len(raw)
+	}
+	var content strings.Builder
+	used := 0
+	for used < len(raw) {
+		r, size := utf8.DecodeRuneInString(raw[used:])
+		piece := raw[used : used+size]
+		if r == utf8.RuneError && size == 1 {
+			piece = "\uFFFD"
+			for used+size < len(raw) {
+				if r, n := utf8.DecodeRuneInString(raw[used+size:]); r != utf8.RuneError || n != 1 {
+					break
+				}
+				size++
+			}
+		}
+		if content.Len()+len(piece) > maxBytes {
+			break
+		}
+		content.WriteString(piece)
+		used += size
 	}
+	return content.String(), used
+}
 
-	validOutput := strings.ToValidUTF8(rawOutput, "\uFFFD")
-	if len(validOutput) > maxBytes {
-		truncated = true
-		validOutput = validUTF8Within(validOutput, maxBytes)
+// validOutputSuffix is validOutputPrefix for the end of raw.
+func validOutputSuffix(raw string, maxBytes int) (string, int) {
+	if len(raw) <= maxBytes && utf8.ValidString(raw) {
+		return raw, len(raw)
+	}
+	content := make([]byte, min(maxBytes, 3*len(raw)))
+	start, end := len(content), len(raw)
+	for end > 0 {
+		r, size := utf8.DecodeLastRuneInString(raw[:end])
+		piece := raw[end-size : end]
+		if r == utf8.RuneError && size == 1 {
+			piece = "\uFFFD"
+			for size < end {
+				if r, n := utf8.DecodeLastRuneInString(raw[:end-size]); r != utf8.RuneError || n != 1 {
+					break
+				}
+				size++
+			}
+		}
+		if len(piece) > start {
+			break
+		}
+		start -= copy(content[start-len(piece):], piece)
+		end -= size
 	}
-	return outputChannel{content: validOutput, truncated: truncated}
+	return string(content[start:]), len(raw) - end
 }
 
 func validUTF8Within(value string, maxBytes int) string {
@@ -240,47 +498,112 @@ func trustedToolEnvironment(requestDirectory string) []string {
 	}
 }
 
-func compileAndRun(ctx context.Context, code, stdin string) (runMessage, error) {
-	msg := runMessage{Phase: runPhaseCompile}
+// createRequestDirectory makes a fresh request directory holding main.cj and
+// any declared package sources. The caller owns its removal.
+func createRequestDirectory(in runReq) (string, error) {
+	srcDir, err := os.MkdirTemp(playgroundDirectory, "run-")
+	if err != nil {
+		return "", infrastructureError("create compile request directory", err)
+	}
+	sourcePath := filepath.Join(srcDir, "main.cj")
+	if err := os.WriteFile(sourcePath, []byte(in.Code), 0o600); err != nil {
+		_ = os.RemoveAll(srcDir)
+		return "", infrastructureError("write compile source", err)
+	}
+	if err := writePackageSources(srcDir, in.Packages); err != nil {
+		_ = os.RemoveAll(srcDir)
+		return "", infrastructureError("write package sources", err)
+	}
+	if err := writeCLibrarySources(srcDir, in.CLibrary); err != nil {
+		_ = os.RemoveAll(srcDir)
+		return "", infrastructureError("write C library sources", err)
+	}
+	return srcDir, nil
+}
 
-	srcDir, err := os.MkdirTemp("/playground", "run-")
+func compileAndRun(ctx context.Context, in runReq) (runMessage, error) {
+	if in.Mode == runModeSanitize && !sanitizerAvailable(in.sanitizer()) {
+		return runMessage{Phase: runPhaseCompile}, errSanitizerUnavailable
+	}
+	srcDir, err := createRequestDirectory(in)
 	if err != nil {
-		return msg, infrastructureError("create compile request directory", err)
+		return runMessage{Phase: runPhaseCompile}, err
 	}
 	defer os.RemoveAll(srcDir)
 
-	sourcePath := filepath.Join(srcDir, "main.cj")
-	if err := os.WriteFile(sourcePath, []byte(code), 0o600); err != nil {
-		return msg, infrastructureError("write compile source", err)
-	}
-
-	compileResult, err := runProcess(ctx, processSpec{
-		executable:              cangjieCompilerPath,
-		arguments:               compilerArguments(srcDir),
-		environment:             trustedToolEnvironment(srcDir),
-		workingDirectory:        srcDir,
-		timeout:                 compileTimeout,
-		timeoutIsInfrastructure: true,
-	}, "compile")
+	// The compiler is trusted toolchain code and keeps an unfiltered syscall
+	// surface, and the runner identity until a build step runs learner code;
+	// only learner code is confined.
+	sandbox := &learnerSandbox{
+		seccomp:     in.Seccomp,
+		disableASLR: in.Deterministic,
+		credential:  nextLearnerCredential(),
+	}
+	msg, err := compileRequest(ctx, srcDir, in, sandbox.credential)
 	if err != nil {
 		return msg, err
 	}
-	compilerOutput := combineOutputChannels(compileResult.stdout, compileResult.stderr)
-	msg.CompilerOutput = compilerOutput.content
-	msg.CompilerOutputTruncated = compilerOutput.truncated
-	msg.CompilerCode = compileResult.exitCode
-	if compileResult.exitCode != 0 {
+	switch in.Mode {
+	case runModeDump:
+		// Dumps are collected even after a failed build: the front-end dumps
+		// are often exactly what explains the failure.
+		msg.IRDumps, err = collectIRDumps(
+			ctx, srcDir, in.Dumps, in.serverLimits().MaxOutputBytes, buildToolSandbox(in, sandbox.credential),
+		)
+		return msg, err
+	case runModeCheck:
+		msg.Phase = runPhaseCheck
+		return msg, nil
+	}
+	if msg.CompilerCode != 0 {
 		return msg, nil
 	}
 
 	msg.Phase = runPhaseRun
-	runResult, err := runProcess(ctx, processSpec{
+	if err := grantLearnerBuild(srcDir, in, sandbox.credential); err != nil {
+		return msg, err
+	}
+	if err := seedRequestFiles(srcDir, in.Files, sandbox.credential); errors.Is(err, errSeedFileConflict) {
+		return msg, err
+	} else if err != nil {
+		return msg, infrastructureError("seed request files", err)
+	}
+	environment := packageLibraryEnvironment(runtimeEnvironment(srcDir), srcDir, in.Packages)
+	environment = cLibraryEnvironment(environment, srcDir, in.CLibrary)
+	if in.Mode == runModeSanitize {
+		environment = sanitizerLibraryEnvironment(environment, in.sanitizer())
+	}
+	if in.Deterministic {
+		environment = append(environment, deterministicEnvironment...)
+		msg.DeterministicKnobs = deterministicKnobs()
+	}
+	if len(in.RuntimeOptions) != 0 {
+		environment = append(environment, runtimeOptionEnvironment(in.RuntimeOptions)...)
+		msg.RuntimeOptions = in.RuntimeOptions
+	}
+	environment = append(environment, programEnvironment(in.Env)...)
+	runSpec := processSpec{
 		executable:       filepath.Join(srcDir, "main"),
-		environment:      runtimeEnvironment(srcDir),
+		arguments:        in.Args,
+		environment:      environment,
 		workingDirectory: srcDir,
-		timeout:          runTimeout,
-		stdin:            stdin,
-	}, "run learner binary")
+		timeout:          in.runTimeout(),
+		output:           in.outputRetention(),
+		transcript:       in.Transcript,
+		stdin:            in.Stdin,
+		sandbox:          sandbox,
+	}
+	var runResult processResult
+	switch in.Mode {
+	case runModeBenchmark:
+		var benchmark benchmarkResult
+		runResult, benchmark, err = runBenchmark(ctx, runSpec, in.benchmark())
+		msg.Benchmark = &benchmark
+	case runModeTrace:
+		runResult, msg.Trace, msg.TraceTruncated, err = runTrace(ctx, cangjieDebuggerPath, srcDir, in, sandbox.credential)
+	default:
+		runResult, err = runProcess(ctx, runSpec, "run learner binary")
+	}
 	if err != nil {
 		return msg, err
 	}
@@ -288,7 +611,120 @@ func compileAndRun(ctx context.Context, code, stdin string) (runMessage, error)
 	msg.BinStdoutTruncated = runResult.stdout.truncated
 	msg.BinStderr = runResult.stderr.content
 	msg.BinStderrTruncated = runResult.stderr.truncated
+	if in.OutputBudget != nil {
+		msg.BinStdoutOmittedBytes = runResult.stdout.omittedBytes
+		msg.BinStderrOmittedBytes = runResult.stderr.omittedBytes
+	}
+	if in.Transcript {
+		msg.Transcript, msg.TranscriptTruncated = runResult.transcript, runResult.transcriptTruncated
+	}
 	msg.BinCode = &runResult.exitCode
+	msg.TerminationReason = runResult.terminationReason
+	if in.Mode == runModeCoverage {
+		// Counters are flushed at exit, so a failing program still reports
+		// what it reached; a killed one reports empty, truncated coverage.
+		msg.Coverage, msg.CoverageTruncated, err = collectCoverage(ctx, srcDir, sandbox.credential)
+		if err != nil {
+			return msg, err
+		}
+	}
+	if in.Mode == runModeSanitize {
+		msg.SanitizerReports = parseSanitizerReports(runResult.stderr.content, srcDir, in.serverLimits().MaxOutputBytes)
+	}
+	if len(in.OutputFiles) != 0 {
+		msg.OutputFiles, msg.OutputFilesTruncated, err = collectOutputFiles(
+			srcDir, in.OutputFiles, in.serverLimits().MaxOutputBytes,
+		)
+		if err != nil {
+			return msg, infrastructureError("collect output files", err)
+		}
+	}
+	return msg, nil
+}
+
+// compileRequest runs the request's build steps in order and reports the
+// compiler outcome; a nonzero CompilerCode is a learner result, not an error.
+// The first failing step ends the build, and all steps share one deadline.
+// Steps that run learner code, and every step after them, run under
+// credential, which then owns the request directory.
+func compileRequest(
+	ctx context.Context,
+	srcDir string,
+	in runReq,
+	credential *syscall.Credential,
+) (runMessage, error) {
+	requestCtx := ctx
+	ctx, cancel := context.WithTimeout(ctx, in.compileTimeout())
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	msg := runMessage{Phase: runPhaseCompile}
+	var outputs []outputChannel
+	granted := false
+	for _, planned := range buildPlan(srcDir, in) {
+		executable, workingDirectory := buildCompilerExecutable, srcDir
+		if planned.executable != "" {
+			// Debian installs the C tools as links, and processCommand only
+			// executes regular files.
+			resolved, err := filepath.EvalSymlinks(planned.executable)
+			if err != nil {
+				return msg, infrastructureError(planned.operation, err)
+			}
+			executable, workingDirectory = resolved, planned.workingDirectory
+		}
+		stepCtx, spec := ctx, processSpec{
+			executable:              executable,
+			arguments:               planned.arguments,
+			environment:             trustedToolEnvironment(srcDir),
+			workingDirectory:        workingDirectory,
+			timeout:                 in.compileTimeout(),
+			timeoutIsInfrastructure: true,
+			output:                  outputRetention{channelBytes: in.serverLimits().MaxOutputBytes},
+		}
+		if planned.runsLearnerCode {
+			// Only trusted tools have touched the directory so far, so it can
+			// still be granted without racing the learner.
+			if !granted {
+				if err := grantLearnerDirectory(srcDir, credential); err != nil {
+					return msg, infrastructureError("grant learner request directory", err)
+				}
+				granted = true
+			}
+			// Learner code that never returns is a learner timeout, so the step
+			// gets the rest of the shared deadline as its own.
+			stepCtx = requestCtx
+			spec.timeout = time.Until(deadline).Round(time.Millisecond)
+			spec.timeoutIsInfrastructure = false
+			spec.sandbox = &learnerSandbox{credential: credential}
+		}
+		compileResult, err := runProcess(stepCtx, spec, planned.operation)
+		if err != nil {
+			return msg, err
+		}
+		outputs = append(outputs, compileResult.stdout, compileResult.stderr)
+		msg.CompilerCode = compileResult.exitCode
+		if len(in.Packages) != 0 || in.CLibrary != nil {
+			planned.step.CompilerCode = compileResult.exitCode
+			msg.BuildSteps = append(msg.BuildSteps, planned.step)
+		}
+		if compileResult.exitCode != 0 {
+			break
+		}
+	}
+	compilerOutput := combineOutputChannels(in.serverLimits().MaxOutputBytes, outputs...)
+	msg.CompilerOutput = compilerOutput.content
+	msg.CompilerOutputTruncated = compilerOutput.truncated
+	if in.MacroExpansion {
+		// Expansions are most useful when the expanded code fails to compile,
+		// so they are collected whatever the outcome of the build.
+		var err error
+		msg.MacroExpansions, msg.MacroExpansionsTruncated, err = collectOutputFiles(
+			srcDir, macroExpansionPatterns, in.serverLimits().MaxOutputBytes,
+		)
+		if err != nil {
+			return msg, infrastructureError("collect macro expansions", err)
+		}
+	}
 	return msg, nil
 }
 
@@ -315,16 +751,42 @@ func runProcess(
 		return processResult{}, infrastructureError(operation+" command", err)
 	}
 
-	stdout := &cappedBuffer{cap: maxSerializedOutputBytes}
-	stderr := &cappedBuffer{cap: maxSerializedOutputBytes}
+	stdout, stderr := spec.output.buffers()
 	cmd.Stdout, cmd.Stderr = stdout, stderr
+	var transcript *transcriptRecorder
+	if spec.transcript {
+		transcript = &transcriptRecorder{limit: spec.output.transcriptBytes()}
+		cmd.Stdout = io.MultiWriter(stdout, transcript.writer(transcriptStdout))
+		cmd.Stderr = io.MultiWriter(stderr, transcript.writer(transcriptStderr))
+	}
 	if spec.stdin != "" {
 		cmd.Stdin = strings.NewReader(spec.stdin)
 	}
+	var sandboxStatus *os.File
+	if spec.sandbox != nil {
+		reader, writer, err := os.Pipe()
+		if err != nil {
+			return processResult{}, infrastructureError(operation+" sandbox status", err)
+		}
+		defer reader.Close()
+		defer writer.Close()
+		cmd.ExtraFiles = []*os.File{writer}
+		sandboxStatus = reader
+	}
 
+	if transcript != nil {
+		// The pipes are only read once the process starts.
+		transcript.started = time.Now()
+	}
 	if err := cmd.Start(); err != nil {
 		return processResult{}, infrastructureError(operation+" start", err)
 	}
+	started := time.Now()
+	if spec.sandbox != nil {
+		// Only the child may hold the write end, or a successful exec could
+		// never be told apart from a launcher that is still running.
+		_ = cmd.ExtraFiles[0].Close()
+	}
 	done := make(chan error, 1)
 	go func() { done <- cmd.Wait() }()
 
@@ -339,12 +801,14 @@ func runProcess(
 			return processResult{}, infrastructureError(operation, context.DeadlineExceeded)
 		}
 		_, _ = stderr.Write([]byte("\n[killed: exceeded " + spec.timeout.String() + " wall clock]"))
-		return processResult{
+		result := processResult{
 			stdout:   stdout.Result(),
 			stderr:   stderr.Result(),
 			exitCode: -1,
 			timedOut: true,
-		}, nil
+		}
+		result.transcript, result.transcriptTruncated = transcript.result()
+		return result, nil
 	case waitErr := <-done:
 		if cmd.ProcessState == nil {
 			return processResult{}, infrastructureError(
@@ -358,11 +822,29 @@ func runProcess(
 				errors.New("process output pipes did not close within wait deadline"),
 			)
 		}
-		return processResult{
-			stdout:   stdout.Result(),
-			stderr:   stderr.Result(),
-			exitCode: cmd.ProcessState.ExitCode(),
-		}, nil
+		if sandboxStatus != nil {
+			if err := readSandboxStatus(sandboxStatus); err != nil {
+				return processResult{}, infrastructureError(operation, err)
+			}
+		}
+		reason := sandboxTerminationReason(spec.sandbox, cmd.ProcessState)
+		if reason == terminationBlockedSyscall {
+			_, _ = stderr.Write([]byte("\n[killed: blocked system call]"))
+		}
+		result := processResult{
+			stdout:            stdout.Result(),
+			stderr:            stderr.Result(),
+			exitCode:          cmd.ProcessState.ExitCode(),
+			terminationReason: reason,
+			wallTime:          time.Since(started),
+			cpuTime:           cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime(),
+		}
+		result.transcript, result.transcriptTruncated = transcript.result()
+		if usage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+			// Linux reports ru_maxrss in kibibytes.
+			result.peakMemoryBytes = usage.Maxrss * 1024
+		}
+		return result, nil
 	}
 }
 
@@ -386,10 +868,22 @@ func processCommand(ctx context.Context, spec processSpec) (*exec.Cmd, error) {
 			return nil, fmt.Errorf("invalid process environment entry %q", entry)
 		}
 	}
-	cmd := exec.CommandContext(ctx, spec.executable, spec.arguments...)
+	executable, arguments := spec.executable, spec.arguments
+	if spec.sandbox != nil {
+		launcher, err := sandboxLauncherExecutable()
+		if err != nil {
+			return nil, fmt.Errorf("resolve sandbox launcher: %w", err)
+		}
+		executable = launcher
+		arguments = spec.sandbox.launcherArguments(spec.executable, spec.arguments)
+	}
+	cmd := exec.CommandContext(ctx, executable, arguments...)
 	cmd.Env = spec.environment
 	cmd.Dir = spec.workingDirectory
 	configureCommandLifecycle(cmd)
+	if spec.sandbox != nil && spec.sandbox.credential != nil {
+		cmd.SysProcAttr.Credential = spec.sandbox.credential
+	}
 	return cmd, nil
 }
 
@@ -420,15 +914,31 @@ func runtimeEnvironment(requestDirectory string) []string {
 	}
 }
 
-func combineOutputChannels(channels ...outputChannel) outputChannel {
+// deterministicEnvironment pins the environment-controlled nondeterminism the
+// Cangjie runtime reads: the local time zone and the scheduler's processor
+// count. The standard library exposes no seed or clock override, so Random and
+// DateTime.now() stay live and are deliberately not reported as pinned.
+var deterministicEnvironment = []string{
+	"TZ=UTC",
+	"cjProcessorNum=1",
+}
+
+// deterministicKnobs lists what a deterministic run actually applied, in the
+// order the response reports them.
+func deterministicKnobs() []string {
+	knobs := append([]string{}, deterministicEnvironment...)
+	return append(knobs, "aslr=disabled")
+}
+
+func combineOutputChannels(limit int, channels ...outputChannel) outputChannel {
 	var builder strings.Builder
-	builder.Grow(maxSerializedOutputBytes)
+	builder.Grow(limit)
 	truncated := false
 	for _, channel := range channels {
 		if channel.truncated {
 			truncated = true
 		}
-		remaining := maxSerializedOutputBytes - builder.Len()
+		remaining := limit - builder.Len()
 		if remaining <= 0 {
 			if channel.content != "" {
 				truncated = true
@@ -696,17 +1206,27 @@ func loadRunnerConfig(environment map[string]string) (runnerConfig, error) {
 		)
 	}
 
+	limits, err := loadRunnerLimits(environment)
+	if err != nil {
+		return runnerConfig{}, err
+	}
+
 	return runnerConfig{
 		sharedToken: token,
+		limits:      limits,
 	}, nil
 }
 
 func environment() map[string]string {
-	return map[string]string{
+	values := map[string]string{
 		"CJ_RUNNER_ENV":              os.Getenv("CJ_RUNNER_ENV"),
 		"CJ_RUNNER_SHARED_TOKEN":     os.Getenv("CJ_RUNNER_SHARED_TOKEN"),
 		"CJ_RUNNER_ISOLATION_DRIVER": os.Getenv("CJ_RUNNER_ISOLATION_DRIVER"),
 	}
+	for _, name := range limitEnvironmentVariables() {
+		values[name] = os.Getenv(name)
+	}
+	return values
 }
 
 func newRunnerHandler(config runnerConfig, operations runnerOperations) http.Handler {
@@ -715,11 +1235,32 @@ func newRunnerHandler(config runnerConfig, operations runnerOperations) http.Han
 		operations: operations,
 	}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/run", server.handleRun)
-	mux.HandleFunc("/", handleHealth)
+	for _, route := range runnerRoutes {
+		mux.HandleFunc(route.pattern, func(w http.ResponseWriter, r *http.Request) {
+			route.handler(server, w, r)
+		})
+	}
 	return mux
 }
 
+type runnerRoute struct {
+	pattern string
+	handler func(*runnerServer, http.ResponseWriter, *http.Request)
+}
+
+// runnerRoutes are the routes the runner serves. openAPIDocument describes
+// each of them, which openapi_test.go checks.
+var runnerRoutes = []runnerRoute{
+	{"/run", (*runnerServer).handleRun},
+	{"/artifacts", (*runnerServer).handleArtifacts},
+	{"/format", (*runnerServer).handleFormat},
+	{"/lint", (*runnerServer).handleLint},
+	{"/debug", (*runnerServer).handleDebug},
+	{"/capabilities", (*runnerServer).handleCapabilities},
+	{"/openapi.json", (*runnerServer).handleOpenAPI},
+	{"/", func(_ *runnerServer, w http.ResponseWriter, r *http.Request) { handleHealth(w, r) }},
+}
+
 func (s *runnerServer) authenticate(w http.ResponseWriter, r *http.Request) bool {
 	values := r.Header.Values("Authorization")
 	if len(values) != 1 {
@@ -769,6 +1310,15 @@ func (s *runnerServer) verifyToolchainExpectation(
 	return true
 }
 
+func requireGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet {
+		return true
+	}
+	w.Header().Set("Allow", http.MethodGet)
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Only GET requests are supported.")
+	return false
+}
+
 func requirePost(w http.ResponseWriter, r *http.Request) bool {
 	if r.Method == http.MethodPost {
 		return true
@@ -778,7 +1328,7 @@ func requirePost(w http.ResponseWriter, r *http.Request) bool {
 	return false
 }
 
-func parseRequestMediaType(r *http.Request, allowJSON bool) (string, bool) {
+func parseRequestMediaType(r *http.Request, jsonOnly bool) (string, bool) {
 	value := r.Header.Get("Content-Type")
 	if value == "" {
 		return "", false
@@ -788,7 +1338,7 @@ func parseRequestMediaType(r *http.Request, allowJSON bool) (string, bool) {
 		return "", false
 	}
 	mediaType = strings.ToLower(mediaType)
-	if mediaType != "text/plain" && (!allowJSON || mediaType != "application/json") {
+	if mediaType != "application/json" && (jsonOnly || mediaType != "text/plain") {
 		return "", false
 	}
 	for name, value := range parameters {
@@ -803,11 +1353,11 @@ func parseRequestMediaType(r *http.Request, allowJSON bool) (string, bool) {
 	return mediaType, true
 }
 
-func readBoundedBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
-	if r.ContentLength > maxRequestBodyBytes {
-		return nil, &http.MaxBytesError{Limit: maxRequestBodyBytes}
+func readBoundedBody(w http.ResponseWriter, r *http.Request, limit int) ([]byte, error) {
+	if r.ContentLength > int64(limit) {
+		return nil, &http.MaxBytesError{Limit: int64(limit)}
 	}
-	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodyBytes)
+	r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
 	defer r.Body.Close()
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
@@ -827,7 +1377,7 @@ func writeBodyReadError(w http.ResponseWriter, r *http.Request, err error) {
 			w,
 			http.StatusRequestEntityTooLarge,
 			"request_body_too_large",
-			fmt.Sprintf("Request body exceeds the %d-byte limit.", maxRequestBodyBytes),
+			fmt.Sprintf("Request body exceeds the %d-byte limit.", tooLarge.Limit),
 		)
 	case r.Context().Err() != nil:
 		writeError(w, 499, "request_cancelled", "Request was cancelled.")
@@ -850,7 +1400,7 @@ func parseRunRequest(body []byte, mediaType string) (runReq, error) {
 		return runReq{}, errors.New("request body must be a JSON object")
 	}
 	for key := range wire {
-		if key != "code" && key != "stdin" {
+		if _, known := runRequestFields[key]; !known && key != "code" {
 			return runReq{}, fmt.Errorf("unknown field %q", key)
 		}
 	}
@@ -866,37 +1416,251 @@ func parseRunRequest(body []byte, mediaType string) (runReq, error) {
 	if err := json.Unmarshal(rawCode, &in.Code); err != nil {
 		return runReq{}, errors.New("code must be a string")
 	}
-	if rawStdin, ok := wire["stdin"]; ok {
-		if bytes.Equal(bytes.TrimSpace(rawStdin), []byte("null")) {
-			return runReq{}, errors.New("stdin must be a string")
-		}
-		if err := json.Unmarshal(rawStdin, &in.Stdin); err != nil {
-			return runReq{}, errors.New("stdin must be a string")
+	for key, raw := range wire {
+		if decode, optional := runRequestFields[key]; optional {
+			if err := decode(raw, &in); err != nil {
+				return runReq{}, err
+			}
 		}
 	}
+	if _, pinned := in.RuntimeOptions["cjProcessorNum"]; pinned && in.Deterministic {
+		return runReq{}, errors.New("deterministic mode already pins cjProcessorNum")
+	}
+	if err := validateProgramInputSize(in.Args, in.Env); err != nil {
+		return runReq{}, err
+	}
+	if err := validateRunMode(in); err != nil {
+		return runReq{}, err
+	}
 	return in, nil
 }
 
-func (s *runnerServer) handleRun(w http.ResponseWriter, r *http.Request) {
+// validateRunMode checks the fields that only make sense in one mode. Modes
+// other than run never start the program, so run-phase options are refused
+// rather than silently ignored.
+func validateRunMode(in runReq) error {
+	if in.Mode == runModeDump && len(in.Dumps) == 0 {
+		return errors.New("dump mode requires dumps")
+	}
+	if in.Mode != runModeDump && len(in.Dumps) != 0 {
+		return errors.New("dumps require dump mode")
+	}
+	if !in.Mode.runsProgram() && in.hasRunPhaseOptions() {
+		return fmt.Errorf("mode %q does not run the program", in.Mode)
+	}
+	if in.Mode != runModeCoverage && in.CoverageTarget != "" {
+		return errors.New("coverage_target requires coverage mode")
+	}
+	if in.Mode != runModeSanitize && in.Sanitizer != "" {
+		return errors.New("sanitizer requires sanitize mode")
+	}
+	if in.Mode != runModeBenchmark && in.Benchmark != nil {
+		return errors.New("benchmark requires benchmark mode")
+	}
+	if in.Mode != runModeTrace && in.TraceSteps != 0 {
+		return errors.New("trace_steps requires trace mode")
+	}
+	// The debugger launches the program itself with only stdin redirected,
+	// and ptrace is outside the seccomp allowlist.
+	if in.Mode == runModeTrace && (in.Seccomp || in.Deterministic || len(in.RuntimeOptions) != 0 ||
+		len(in.Args) != 0 || len(in.Env) != 0 || in.OutputBudget != nil || in.Transcript) {
+		return errors.New("trace mode supports only stdin, files and output_files")
+	}
+	return nil
+}
+
+// runRequestFields decodes the optional JSON fields of a run request.
+var runRequestFields = map[string]func(json.RawMessage, *runReq) error{
+	"stdin": func(raw json.RawMessage, in *runReq) error {
+		return decodeRequestField(raw, &in.Stdin, "stdin must be a string")
+	},
+	"seccomp": func(raw json.RawMessage, in *runReq) error {
+		return decodeRequestField(raw, &in.Seccomp, "seccomp must be a boolean")
+	},
+	"deterministic": func(raw json.RawMessage, in *runReq) error {
+		return decodeRequestField(raw, &in.Deterministic, "deterministic must be a boolean")
+	},
+	"runtime_options": func(raw json.RawMessage, in *runReq) error {
+		var options map[string]string
+		if err := decodeRequestField(raw, &options, "runtime_options must be an object of strings"); err != nil {
+			return err
+		}
+		normalized, err := parseRuntimeOptions(options)
+		if err != nil {
+			return err
+		}
+		in.RuntimeOptions = normalized
+		return nil
+	},
+	"args": func(raw json.RawMessage, in *runReq) error {
+		if err := decodeRequestField(raw, &in.Args, "args must be an array of strings"); err != nil {
+			return err
+		}
+		return validateProgramArguments(in.Args)
+	},
+	"env": func(raw json.RawMessage, in *runReq) error {
+		if err := decodeRequestField(raw, &in.Env, "env must be an object of strings"); err != nil {
+			return err
+		}
+		return validateProgramEnvironment(in.Env)
+	},
+	"files": func(raw json.RawMessage, in *runReq) error {
+		var files []inputFile
+		if err := decodeRequestField(raw, &files, "files must be an array of file objects"); err != nil {
+			return err
+		}
+		seeds, err := parseInputFiles(files)
+		if err != nil {
+			return err
+		}
+		in.Files = seeds
+		return nil
+	},
+	"output_files": func(raw json.RawMessage, in *runReq) error {
+		if err := decodeRequestField(raw, &in.OutputFiles, "output_files must be an array of strings"); err != nil {
+			return err
+		}
+		return parseOutputFilePatterns(in.OutputFiles)
+	},
+	"packages": func(raw json.RawMessage, in *runReq) error {
+		if err := decodeRequestField(raw, &in.Packages, "packages must be an array of package objects"); err != nil {
+			return err
+		}
+		return parseBuildPackages(in.Packages)
+	},
+	"macro_expansion": func(raw json.RawMessage, in *runReq) error {
+		return decodeRequestField(raw, &in.MacroExpansion, "macro_expansion must be a boolean")
+	},
+	"mode": func(raw json.RawMessage, in *runReq) error {
+		if err := decodeRequestField(raw, &in.Mode, "mode must be a string"); err != nil {
+			return err
+		}
+		if !slices.Contains(runRequestModes, in.Mode) {
+			return fmt.Errorf("unsupported mode %q", in.Mode)
+		}
+		return nil
+	},
+	"coverage_target": func(raw json.RawMessage, in *runReq) error {
+		if err := decodeRequestField(raw, &in.CoverageTarget, "coverage_target must be a string"); err != nil {
+			return err
+		}
+		switch in.CoverageTarget {
+		case coverageTargetProgram, coverageTargetTests:
+			return nil
+		}
+		return fmt.Errorf("unsupported coverage_target %q", in.CoverageTarget)
+	},
+	"sanitizer": func(raw json.RawMessage, in *runReq) error {
+		if err := decodeRequestField(raw, &in.Sanitizer, "sanitizer must be a string"); err != nil {
+			return err
+		}
+		if _, ok := sanitizerRuntimeDirectories[in.Sanitizer]; !ok {
+			return fmt.Errorf("unsupported sanitizer %q", in.Sanitizer)
+		}
+		return nil
+	},
+	"c_library": func(raw json.RawMessage, in *runReq) error {
+		if err := decodeRequestField(raw, &in.CLibrary, "c_library must be a C library object"); err != nil {
+			return err
+		}
+		return parseCLibrary(in.CLibrary)
+	},
+	"benchmark": func(raw json.RawMessage, in *runReq) error {
+		// Omitted members keep their defaults.
+		benchmark := defaultBenchmarkRequest()
+		if err := decodeRequestField(raw, &benchmark, "benchmark must be an object of integers"); err != nil {
+			return err
+		}
+		in.Benchmark = &benchmark
+		return parseBenchmarkRequest(benchmark)
+	},
+	"trace_steps": func(raw json.RawMessage, in *runReq) error {
+		if err := decodeRequestField(raw, &in.TraceSteps, "trace_steps must be an integer"); err != nil {
+			return err
+		}
+		if in.TraceSteps < 1 || in.TraceSteps > maxTraceSteps {
+			return fmt.Errorf("trace_steps must be 1-%d", maxTraceSteps)
+		}
+		return nil
+	},
+	"protocol_version": func(raw json.RawMessage, in *runReq) error {
+		// Support is checked with the header in negotiateProtocolVersion, so
+		// both spellings fail the same way.
+		if err := decodeRequestField(raw, &in.ProtocolVersion, "protocol_version must be an integer"); err != nil {
+			return err
+		}
+		if in.ProtocolVersion < 1 {
+			return errors.New("protocol_version must be positive")
+		}
+		return nil
+	},
+	// Ceilings are checked with the headers in negotiateTimeBudget.
+	"compile_timeout_ms": func(raw json.RawMessage, in *runReq) error {
+		return decodeTimeBudgetField(raw, &in.CompileTimeoutMs, "compile_timeout_ms")
+	},
+	"run_timeout_ms": func(raw json.RawMessage, in *runReq) error {
+		return decodeTimeBudgetField(raw, &in.RunTimeoutMs, "run_timeout_ms")
+	},
+	"transcript": func(raw json.RawMessage, in *runReq) error {
+		return decodeRequestField(raw, &in.Transcript, "transcript must be a boolean")
+	},
+	// Maxima are checked in negotiateOutputBudget.
+	"output_budget": func(raw json.RawMessage, in *runReq) error {
+		if err := decodeRequestField(raw, &in.OutputBudget, "output_budget must be an object of integers"); err != nil {
+			return err
+		}
+		return parseOutputBudget(*in.OutputBudget)
+	},
+	"dumps": func(raw json.RawMessage, in *runReq) error {
+		if err := decodeRequestField(raw, &in.Dumps, "dumps must be an array of strings"); err != nil {
+			return err
+		}
+		return parseIRDumpKinds(in.Dumps)
+	},
+}
+
+// decodeRequestField rejects explicit nulls so a present optional field always
+// carries a value of its declared type.
+func decodeRequestField(raw json.RawMessage, value any, message string) error {
+	if bytes.Equal(bytes.TrimSpace(raw), []byte("null")) ||
+		decodeStrictJSON(raw, value) != nil {
+		return errors.New(message)
+	}
+	return nil
+}
+
+// readToolRequest applies the shared admission checks of the toolchain
+// endpoints and returns the body with its media type. Routes whose fields
+// have no text/plain form pass jsonOnly. It writes the error response itself
+// on failure.
+func (s *runnerServer) readToolRequest(w http.ResponseWriter, r *http.Request, jsonOnly bool) ([]byte, string, bool) {
 	if !requirePost(w, r) ||
 		!s.authenticate(w, r) ||
 		!s.verifyToolchainExpectation(w, r) {
-		return
+		return nil, "", false
 	}
-	mediaType, ok := parseRequestMediaType(r, true)
+	mediaType, ok := parseRequestMediaType(r, jsonOnly)
 	if !ok {
-		writeError(
-			w,
-			http.StatusUnsupportedMediaType,
-			"unsupported_media_type",
-			"Content-Type must be text/plain or application/json with UTF-8 content.",
-		)
-		return
+		message := "Content-Type must be text/plain or application/json with UTF-8 content."
+		if jsonOnly {
+			message = "Content-Type must be application/json with UTF-8 content."
+		}
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", message)
+		return nil, "", false
 	}
-	body, err := readBoundedBody(w, r)
+	body, err := readBoundedBody(w, r, s.config.limits.MaxRequestBytes)
 	if err != nil {
 		writeBodyReadError(w, r, err)
-		return
+		return nil, "", false
+	}
+	return body, mediaType, true
+}
+
+// readRunRequest admits and decodes a body for the compile endpoints.
+func (s *runnerServer) readRunRequest(w http.ResponseWriter, r *http.Request) (runReq, bool) {
+	body, mediaType, ok := s.readToolRequest(w, r, false)
+	if !ok {
+		return runReq{}, false
 	}
 	in, err := parseRunRequest(body, mediaType)
 	if err != nil {
@@ -904,16 +1668,51 @@ func (s *runnerServer) handleRun(w http.ResponseWriter, r *http.Request) {
 			w,
 			http.StatusBadRequest,
 			"invalid_json_body",
-			`JSON body must contain only a string "code" field and an optional string "stdin" field.`,
+			`JSON body must contain a string "code" field and only supported, well-typed optional fields.`,
+		)
+		return runReq{}, false
+	}
+	in.limits = s.config.limits
+	if !negotiateProtocolVersion(w, r, &in.ProtocolVersion) || !s.negotiateTimeBudget(w, r, &in) ||
+		!negotiateOutputBudget(w, in) {
+		return runReq{}, false
+	}
+	return in, true
+}
+
+func (s *runnerServer) handleRun(w http.ResponseWriter, r *http.Request) {
+	in, ok := s.readRunRequest(w, r)
+	if !ok {
+		return
+	}
+	message, err := s.operations.compileAndRun(r.Context(), in)
+	if errors.Is(err, errSanitizerUnavailable) {
+		writeError(
+			w,
+			http.StatusUnprocessableEntity,
+			"sanitizer_unavailable",
+			"The installed toolchain does not support the "+string(in.sanitizer())+" sanitizer.",
 		)
 		return
 	}
-	message, err := s.operations.compileAndRun(r.Context(), in.Code, in.Stdin)
+	if errors.Is(err, errSeedFileConflict) {
+		writeError(w, http.StatusBadRequest, "invalid_json_body", "A seeded file collides with a build output.")
+		return
+	}
 	if err != nil {
 		writeOperationError(w, r, err)
 		return
 	}
-	writeJSON(w, http.StatusOK, message)
+	if in.hasTimeBudget() {
+		message.TimeBudget = &timeBudget{
+			CompileMs: in.compileTimeout().Milliseconds(),
+			RunMs:     in.runTimeout().Milliseconds(),
+		}
+	}
+	if in.OutputBudget != nil {
+		message.OutputBudget = in.outputRetention().budget()
+	}
+	writeRunMessage(w, http.StatusOK, in, message)
 }
 
 func writeOperationError(w http.ResponseWriter, r *http.Request, err error) {
@@ -968,15 +1767,15 @@ func writeJSON(w http.ResponseWriter, status int, value any) {
 	_ = json.NewEncoder(w).Encode(value)
 }
 
-func newHTTPServer(address string, handler http.Handler) *http.Server {
+func newHTTPServer(address string, handler http.Handler, limits runnerLimits) *http.Server {
 	return &http.Server{
 		Addr:              address,
 		Handler:           handler,
-		ReadHeaderTimeout: readHeaderTimeout,
-		ReadTimeout:       readTimeout,
-		WriteTimeout:      writeTimeout,
-		IdleTimeout:       idleTimeout,
-		MaxHeaderBytes:    maxHeaderBytes,
+		ReadHeaderTimeout: limits.ReadHeaderTimeout,
+		ReadTimeout:       limits.ReadTimeout,
+		WriteTimeout:      limits.WriteTimeout,
+		IdleTimeout:       limits.IdleTimeout,
+		MaxHeaderBytes:    limits.MaxHeaderBytes,
 	}
 }
 
@@ -985,6 +1784,9 @@ func runnerListenAddress(port string) string {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == sandboxLauncherArgument {
+		os.Exit(runSandboxLauncher(os.Args[2:]))
+	}
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8000"
@@ -1003,10 +1805,18 @@ func main() {
 		panic("locked Cangjie toolchain unavailable: " + err.Error())
 	}
 	config.toolchainLockSha256 = toolchainLockSHA256
+	if err := verifyLearnerSandbox(context.Background()); err != nil {
+		panic("learner sandbox unavailable: " + err.Error())
+	}
+	log.Printf("cj-runner configuration: %s", describeRunnerConfig(config))
 	handler := newRunnerHandler(config, runnerOperations{
-		compileAndRun: compileAndRun,
+		compileAndRun:  compileAndRun,
+		buildArtifacts: buildArtifacts,
+		format:         formatSource,
+		lint:           lintSource,
+		debug:          debugProgram,
 	})
-	server := newHTTPServer(runnerListenAddress(port), handler)
+	server := newHTTPServer(runnerListenAddress(port), handler, config.limits)
 	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		panic(err)
 	}
@@ -12,6 +12,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"regexp"
 	"slices"
 	"strings"
 	"sync"
@@ -24,6 +25,20 @@ import (
 const testSharedToken = "0123456789abcdef0123456789abcdef"
 const testToolchainLockSHA256 = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
 
+// testProbeEnvironment turns the test binary into a learner stand-in so the
+// sandbox can be exercised without a Cangjie toolchain.
+const testProbeEnvironment = "CJ_RUNNER_TEST_PROBE"
+
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == sandboxLauncherArgument {
+		os.Exit(runSandboxLauncher(os.Args[2:]))
+	}
+	if probe := os.Getenv(testProbeEnvironment); probe != "" {
+		os.Exit(runTestProbe(probe))
+	}
+	os.Exit(m.Run())
+}
+
 func TestDockerfilePinsAndVerifiesRunnerSupplyChain(t *testing.T) {
 	dockerfile, err := os.ReadFile("../../Dockerfile")
 	if err != nil {
@@ -64,6 +79,8 @@ func TestDockerfilePinsAndVerifiesRunnerSupplyChain(t *testing.T) {
 		"COPY cangjie-toolchain.lock.json install-cangjie-toolchain.sh",
 		"install-cangjie-toolchain.sh",
 		"USER 65532:65532",
+		"setcap cap_setuid,cap_setgid,cap_chown,cap_dac_override+ep /usr/local/bin/cj-runner",
+		"chmod 0711 /playground",
 	} {
 		if !strings.Contains(content, required) {
 			t.Fatalf("Dockerfile omits pinned supply-chain requirement %q", required)
@@ -96,25 +113,73 @@ func TestDockerfilePinsAndVerifiesRunnerSupplyChain(t *testing.T) {
 	}
 }
 
+// dockerfileKeptTools returns the tools/bin executables the image keeps.
+func dockerfileKeptTools(t *testing.T) []string {
+	t.Helper()
+	dockerfile, err := os.ReadFile("../../Dockerfile")
+	if err != nil {
+		t.Fatalf("read Dockerfile: %v", err)
+	}
+	match := regexp.MustCompile(`tools/bin"/\*; do case "\$\(basename "\$t"\)" in ([^)]*)\)`).FindSubmatch(dockerfile)
+	if match == nil {
+		t.Fatal("Dockerfile does not trim tools/bin with a keep list")
+	}
+	return strings.Split(string(match[1]), "|")
+}
+
+func TestDockerfileKeepsServedToolchainTools(t *testing.T) {
+	kept := dockerfileKeptTools(t)
+	for _, tool := range []string{
+		filepath.Base(cangjieFormatterPath),
+		filepath.Base(cangjieLinterPath),
+		filepath.Base(cangjieCoveragePath),
+		filepath.Base(cangjieDebuggerPath),
+	} {
+		if !slices.Contains(kept, tool) {
+			t.Fatalf("Dockerfile keeps tools %q, want %q", kept, tool)
+		}
+	}
+}
+
 func testOperations() runnerOperations {
 	return runnerOperations{
-		compileAndRun: func(_ context.Context, code, stdin string) (runMessage, error) {
+		compileAndRun: func(_ context.Context, in runReq) (runMessage, error) {
 			binCode := 0
 			return runMessage{
 				Phase:          runPhaseRun,
-				CompilerOutput: code,
+				CompilerOutput: in.Code,
 				CompilerCode:   0,
-				BinStdout:      stdin,
+				BinStdout:      in.Stdin,
 				BinStderr:      "runtime diagnostic",
 				BinCode:        &binCode,
 			}, nil
 		},
+		buildArtifacts: func(_ context.Context, in runReq) (artifactBuild, error) {
+			return artifactBuild{
+				message: runMessage{Phase: runPhaseCompile, CompilerOutput: in.Code},
+				files: []artifactFile{{
+					path: "main",
+					kind: "executable",
+					mode: 0o755,
+					data: []byte("\x7fELF"),
+				}},
+			}, nil
+		},
+		format: func(_ context.Context, in formatReq) (formatResult, error) {
+			return formatResult{message: formatMessage{Formatted: in.Code}}, nil
+		},
+		lint: func(context.Context, lintReq) (lintMessage, error) {
+			return lintMessage{Findings: []lintFinding{}}, nil
+		},
+		debug: func(context.Context, debugReq) (debugSession, error) {
+			return debugSession{message: debugMessage{Stops: []debugStop{}}}, nil
+		},
 	}
 }
 
 func TestRunResponseIdentifiesCompileFailureWithoutBinaryExitCode(t *testing.T) {
 	operations := testOperations()
-	operations.compileAndRun = func(_ context.Context, _, _ string) (runMessage, error) {
+	operations.compileAndRun = func(context.Context, runReq) (runMessage, error) {
 		return runMessage{
 			Phase:          runPhaseCompile,
 			CompilerOutput: "compile failed",
@@ -174,7 +239,7 @@ func TestRunResponseIdentifiesCompileFailureWithoutBinaryExitCode(t *testing.T)
 
 func TestRunResponseIdentifiesRunStageFailureWithExitCode(t *testing.T) {
 	operations := testOperations()
-	operations.compileAndRun = func(_ context.Context, _, _ string) (runMessage, error) {
+	operations.compileAndRun = func(context.Context, runReq) (runMessage, error) {
 		binCode := -1
 		return runMessage{
 			Phase:        runPhaseRun,
@@ -449,6 +514,7 @@ func testHandler(operations runnerOperations) http.Handler {
 	return newRunnerHandler(runnerConfig{
 		sharedToken:         testSharedToken,
 		toolchainLockSha256: testToolchainLockSHA256,
+		limits:              defaultRunnerLimits(),
 	}, operations)
 }
 
@@ -862,7 +928,7 @@ func TestRunnerReturnsNon2xxForInfrastructureFailures(t *testing.T) {
 			name: "compile infrastructure failure",
 			path: "/run",
 			operations: runnerOperations{
-				compileAndRun: func(context.Context, string, string) (runMessage, error) {
+				compileAndRun: func(context.Context, runReq) (runMessage, error) {
 					return runMessage{}, infrastructureError(
 						"create compile request directory",
 						errors.New("storage unavailable"),
@@ -895,7 +961,7 @@ func TestRunnerReturnsNon2xxForInfrastructureFailures(t *testing.T) {
 func TestRunnerSerializesRequiredOutOfBandTruncationFlags(t *testing.T) {
 	binCode := 0
 	operations := testOperations()
-	operations.compileAndRun = func(context.Context, string, string) (runMessage, error) {
+	operations.compileAndRun = func(context.Context, runReq) (runMessage, error) {
 		return runMessage{
 			Phase:                   runPhaseRun,
 			CompilerOutput:          "compiler",
@@ -948,7 +1014,7 @@ func TestRunnerSerializesRequiredOutOfBandTruncationFlags(t *testing.T) {
 func TestRunnerPassesRequestContextToOperations(t *testing.T) {
 	var received context.Context
 	operations := testOperations()
-	operations.compileAndRun = func(ctx context.Context, _, _ string) (runMessage, error) {
+	operations.compileAndRun = func(ctx context.Context, _ runReq) (runMessage, error) {
 		received = ctx
 		return runMessage{}, nil
 	}
@@ -964,7 +1030,7 @@ func TestRunnerPassesRequestContextToOperations(t *testing.T) {
 }
 
 func TestHTTPServerHasResourceTimeouts(t *testing.T) {
-	server := newHTTPServer("127.0.0.1:0", http.NewServeMux())
+	server := newHTTPServer("127.0.0.1:0", http.NewServeMux(), defaultRunnerLimits())
 	if server.ReadHeaderTimeout != readHeaderTimeout ||
 		server.ReadTimeout != readTimeout ||
 		server.WriteTimeout != writeTimeout ||
@@ -0,0 +1,503 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// runnerErrorStatuses maps every code writeError emits to its HTTP status.
+// openapi_test.go checks the calls in this package against it.
+var runnerErrorStatuses = map[string]int{
+	"artifacts_too_large":           http.StatusUnprocessableEntity,
+	"format_failed":                 http.StatusUnprocessableEntity,
+	"format_timeout":                http.StatusUnprocessableEntity,
+	"invalid_time_budget":           http.StatusBadRequest,
+	"invalid_json_body":             http.StatusBadRequest,
+	"invalid_output_budget":         http.StatusBadRequest,
+	"invalid_request_body":          http.StatusBadRequest,
+	"method_not_allowed":            http.StatusMethodNotAllowed,
+	"not_acceptable":                http.StatusNotAcceptable,
+	"not_found":                     http.StatusNotFound,
+	"request_body_too_large":        http.StatusRequestEntityTooLarge,
+	"request_cancelled":             499,
+	"runner_infrastructure_failure": http.StatusServiceUnavailable,
+	"runner_internal_error":         http.StatusInternalServerError,
+	"runner_toolchain_mismatch":     http.StatusServiceUnavailable,
+	"sanitizer_unavailable":         http.StatusUnprocessableEntity,
+	"unauthorized":                  http.StatusUnauthorized,
+	"unsupported_media_type":        http.StatusUnsupportedMediaType,
+	"unsupported_protocol_version":  http.StatusBadRequest,
+}
+
+// toolErrorCodes are the errors every authenticated POST route can answer
+// with.
+var toolErrorCodes = []string{
+	"invalid_json_body", "invalid_request_body", "method_not_allowed", "request_body_too_large",
+	"request_cancelled", "runner_infrastructure_failure", "runner_internal_error",
+	"runner_toolchain_mismatch", "unauthorized", "unsupported_media_type",
+}
+
+// compileErrorCodes add the negotiation of the routes that take a RunRequest.
+var compileErrorCodes = slices.Concat(toolErrorCodes, []string{
+	"invalid_output_budget", "invalid_time_budget", "unsupported_protocol_version",
+})
+
+// runErrorCodes are the errors POST /run can answer with.
+var runErrorCodes = slices.Concat(compileErrorCodes, []string{"sanitizer_unavailable"})
+
+// errorDetailTypes maps the codes whose error body carries fields beside code
+// and error to the type written for them.
+var errorDetailTypes = map[string]reflect.Type{
+	"format_failed": reflect.TypeFor[formatFailure](),
+}
+
+// schemaEnums lists the accepted values of the string types that carry one.
+var schemaEnums = map[reflect.Type][]string{
+	reflect.TypeFor[runPhase]():          {string(runPhaseCompile), string(runPhaseRun), string(runPhaseCheck)},
+	reflect.TypeFor[runMode]():           enumValues(runRequestModes),
+	reflect.TypeFor[terminationReason](): {string(terminationBlockedSyscall)},
+	reflect.TypeFor[coverageTarget]():    {string(coverageTargetProgram), string(coverageTargetTests)},
+	reflect.TypeFor[sanitizerKind]():     sortedKeys(sanitizerRuntimeDirectories),
+	reflect.TypeFor[irDumpKind]():        sortedKeys(irDumpSuffixes),
+	reflect.TypeFor[transcriptChannel](): {string(transcriptStdout), string(transcriptStderr)},
+}
+
+func enumValues[T ~string](values []T) []string {
+	names := make([]string, 0, len(values))
+	for _, value := range values {
+		names = append(names, string(value))
+	}
+	return names
+}
+
+func sortedKeys[K ~string, V any](values map[K]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, string(key))
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// schemaBuilder derives JSON Schema components from the Go types the handlers
+// encode and decode, so the document cannot describe fields that the wire
+// does not carry.
+type schemaBuilder struct {
+	components map[string]any
+}
+
+// reference returns a $ref to the component for t, building it on first use.
+// Response objects require every field that is not omitempty; request
+// objects require none, because the decoders default omitted fields.
+func (b *schemaBuilder) reference(name string, t reflect.Type, request bool) map[string]any {
+	if _, built := b.components[name]; !built {
+		b.components[name] = b.object(t, request)
+	}
+	return map[string]any{"$ref": "#/components/schemas/" + name}
+}
+
+func (b *schemaBuilder) object(t reflect.Type, request bool) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	var addFields func(reflect.Type)
+	addFields = func(t reflect.Type) {
+		for i := range t.NumField() {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if field.Anonymous && tag == "" {
+				addFields(field.Type)
+				continue
+			}
+			name, options, _ := strings.Cut(tag, ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			omitted := options == "omitempty"
+			properties[name] = b.schema(field.Type, omitted, request)
+			if !request && !omitted {
+				required = append(required, name)
+			}
+		}
+	}
+	addFields(t)
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
+
+// schema describes a value of type t. Response pointers that are never
+// omitted are nullable, as encoding/json writes nil ones as null; requests
+// reject null.
+func (b *schemaBuilder) schema(t reflect.Type, omitted, request bool) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		element := b.schema(t.Elem(), true, request)
+		if omitted || request {
+			return element
+		}
+		if kind, ok := element["type"].(string); ok {
+			element["type"] = []string{kind, "null"}
+			return element
+		}
+		return map[string]any{"anyOf": []any{element, map[string]any{"type": "null"}}}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		if values, ok := schemaEnums[t]; ok {
+			return map[string]any{"type": "string", "enum": values}
+		}
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem(), true, request)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem(), true, request)}
+	case reflect.Struct:
+		return b.reference(componentName(t.Name()), t, request)
+	}
+	panic("openapi: unsupported type " + t.String())
+}
+
+func componentName(typeName string) string {
+	first, size := utf8.DecodeRuneInString(typeName)
+	return string(unicode.ToUpper(first)) + typeName[size:]
+}
+
+// errorResponses describes the error bodies of an operation, one response per
+// status with the codes that status carries. Codes with extra fields get
+// their own body schema alongside the plain code and error object.
+func (b *schemaBuilder) errorResponses(codes []string) map[string]any {
+	byStatus := map[int][]string{}
+	for _, code := range codes {
+		status := runnerErrorStatuses[code]
+		byStatus[status] = append(byStatus[status], code)
+	}
+	responses := map[string]any{}
+	for status, statusCodes := range byStatus {
+		slices.Sort(statusCodes)
+		description := http.StatusText(status)
+		if status == 499 {
+			description = "Client Closed Request"
+		}
+		var plainCodes []string
+		var alternatives []any
+		for _, code := range statusCodes {
+			detail, ok := errorDetailTypes[code]
+			if !ok {
+				plainCodes = append(plainCodes, code)
+				continue
+			}
+			alternatives = append(alternatives, b.errorDetailReference(detail))
+		}
+		if len(plainCodes) != 0 {
+			alternatives = append([]any{map[string]any{
+				"type":     "object",
+				"required": []string{"code", "error"},
+				"properties": map[string]any{
+					"code":  map[string]any{"type": "string", "enum": plainCodes},
+					"error": map[string]any{"type": "string"},
+				},
+				"additionalProperties": false,
+			}}, alternatives...)
+		}
+		schema := alternatives[0].(map[string]any)
+		if len(alternatives) > 1 {
+			schema = map[string]any{"oneOf": alternatives}
+		}
+		responses[strconv.Itoa(status)] = jsonResponse(description, schema)
+	}
+	return responses
+}
+
+// errorDetailReference builds the component of a detailed error body, whose
+// code is limited to the codes written with that type.
+func (b *schemaBuilder) errorDetailReference(t reflect.Type) map[string]any {
+	name := componentName(t.Name())
+	reference := b.reference(name, t, false)
+	var codes []string
+	for code, detail := range errorDetailTypes {
+		if detail == t {
+			codes = append(codes, code)
+		}
+	}
+	slices.Sort(codes)
+	b.components[name].(map[string]any)["properties"].(map[string]any)["code"] =
+		map[string]any{"type": "string", "enum": codes}
+	return reference
+}
+
+func jsonResponse(description string, schema map[string]any) map[string]any {
+	return map[string]any{
+		"description": description,
+		"content":     map[string]any{"application/json": map[string]any{"schema": schema}},
+	}
+}
+
+func withResponses(responses map[string]any, extra map[string]any) map[string]any {
+	for status, response := range extra {
+		responses[status] = response
+	}
+	return responses
+}
+
+// openAPIDocument describes every route in runnerRoutes in OpenAPI 3.1.
+// HEAD / answers as GET / without a body.
+func openAPIDocument() map[string]any {
+	builder := &schemaBuilder{components: map[string]any{}}
+	runRequest := builder.object(reflect.TypeFor[runReq](), true)
+	// Seed files travel as inputFile objects and are decoded into seedFile.
+	runRequest["properties"].(map[string]any)["files"] = builder.schema(reflect.TypeFor[[]inputFile](), true, true)
+	runRequest["properties"].(map[string]any)["protocol_version"] = map[string]any{
+		"type": "integer", "enum": supportedProtocolVersions,
+	}
+	runRequest["required"] = []string{"code"}
+	builder.components["RunRequest"] = runRequest
+	runMessageV1 := builder.reference("RunMessage", reflect.TypeFor[runMessage](), false)
+	runMessageV2 := builder.reference("RunMessageV2", reflect.TypeFor[runMessageV2](), false)
+	builder.components["RunMessageV2"].(map[string]any)["properties"].(map[string]any)["protocol_version"] =
+		map[string]any{"const": protocolVersion2}
+	runMessages := []any{runMessageV1, runMessageV2}
+	capabilities := builder.reference("Capabilities", reflect.TypeFor[runnerCapabilities](), false)
+	builder.components["ErrorCode"] = map[string]any{"type": "string", "enum": sortedKeys(runnerErrorStatuses)}
+	// The tool routes decode their bodies field by field, so their request
+	// schemas are written out here.
+	builder.components["FormatRequest"] = map[string]any{
+		"type":     "object",
+		"required": []string{"code"},
+		"properties": map[string]any{
+			"code": map[string]any{"type": "string"},
+			"diff": map[string]any{"type": "boolean"},
+		},
+		"additionalProperties": false,
+	}
+	builder.components["LintRequest"] = map[string]any{
+		"type":                 "object",
+		"required":             []string{"code"},
+		"properties":           map[string]any{"code": map[string]any{"type": "string"}},
+		"additionalProperties": false,
+	}
+	builder.components["DebugRequest"] = map[string]any{
+		"type":     "object",
+		"required": []string{"code"},
+		"properties": map[string]any{
+			"code":  map[string]any{"type": "string"},
+			"stdin": map[string]any{"type": "string"},
+			"breakpoints": map[string]any{
+				"type":     "array",
+				"maxItems": maxDebugBreakpoints,
+				"items":    map[string]any{"type": "string", "pattern": `^main\.cj:[1-9][0-9]*$`},
+			},
+			"watch": map[string]any{
+				"type":     "array",
+				"maxItems": maxDebugWatches,
+				"items":    map[string]any{"type": "string", "minLength": 1, "maxLength": maxDebugWatchBytes},
+			},
+			"max_stops": map[string]any{"type": "integer", "minimum": 1, "maximum": maxDebugStops},
+			"protocol_version": map[string]any{
+				"type": "integer", "enum": supportedProtocolVersions,
+			},
+		},
+		"additionalProperties": false,
+	}
+	formatMessage := builder.reference("FormatMessage", reflect.TypeFor[formatMessage](), false)
+	lintMessage := builder.reference("LintMessage", reflect.TypeFor[lintMessage](), false)
+	debugMessage := builder.reference("DebugMessage", reflect.TypeFor[debugMessage](), false)
+
+	authenticated := []any{map[string]any{"bearer": []string{}}}
+	toolchainLock := map[string]any{
+		"name": toolchainLockHeader, "in": "header",
+		"schema": map[string]any{"type": "string", "pattern": "^[0-9a-f]{64}$"},
+	}
+	protocolVersion := map[string]any{
+		"name": protocolVersionHeader, "in": "header",
+		"schema": map[string]any{"type": "integer", "enum": supportedProtocolVersions},
+	}
+	compileParameters := []any{
+		protocolVersion,
+		map[string]any{
+			"name": compileTimeoutHeader, "in": "header",
+			"schema": map[string]any{"type": "integer", "minimum": minTimeBudget.Milliseconds()},
+		},
+		map[string]any{
+			"name": runTimeoutHeader, "in": "header",
+			"schema": map[string]any{"type": "integer", "minimum": minTimeBudget.Milliseconds()},
+		},
+		toolchainLock,
+	}
+	sourceBody := func(schema string) map[string]any {
+		return map[string]any{
+			"required": true,
+			"content": map[string]any{
+				"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/" + schema}},
+				"text/plain":       map[string]any{"schema": map[string]any{"type": "string"}},
+			},
+		}
+	}
+	// A failed compile answers the compile routes with the /run shape.
+	withCompileFailure := func(responses map[string]any) map[string]any {
+		alternatives := slices.Clone(runMessages)
+		if existing, ok := responses["422"].(map[string]any); ok {
+			schema := existing["content"].(map[string]any)["application/json"].(map[string]any)["schema"].(map[string]any)
+			alternatives = append([]any{schema}, alternatives...)
+		}
+		responses["422"] = jsonResponse("The program did not compile, or the request failed as described.", map[string]any{
+			"oneOf": alternatives,
+		})
+		return responses
+	}
+
+	return map[string]any{
+		"openapi": "3.1.0",
+		"info": map[string]any{
+			"title":   "cj-runner",
+			"version": strconv.Itoa(protocolVersion2),
+		},
+		"paths": map[string]any{
+			"/run": map[string]any{
+				"post": map[string]any{
+					"operationId": "run",
+					"security":    authenticated,
+					"parameters":  compileParameters,
+					"requestBody": sourceBody("RunRequest"),
+					"responses": withResponses(builder.errorResponses(runErrorCodes), map[string]any{
+						"200": jsonResponse("Compile diagnostics and, when it ran, the program's output.", map[string]any{
+							"oneOf": runMessages,
+						}),
+					}),
+				},
+			},
+			"/artifacts": map[string]any{
+				"post": map[string]any{
+					"operationId": "artifacts",
+					"security":    authenticated,
+					"parameters": append(slices.Clone(compileParameters), map[string]any{
+						"name": "Accept", "in": "header",
+						"schema": map[string]any{"type": "string"},
+					}),
+					"requestBody": sourceBody("RunRequest"),
+					"responses": withResponses(
+						withCompileFailure(builder.errorResponses(append(slices.Clone(compileErrorCodes), "artifacts_too_large", "not_acceptable"))),
+						map[string]any{
+							"200": map[string]any{
+								"description": "The build products and their manifest as one archive.",
+								"content": map[string]any{
+									artifactMediaTar: map[string]any{"schema": map[string]any{"type": "string"}},
+									artifactMediaZip: map[string]any{"schema": map[string]any{"type": "string"}},
+								},
+							},
+						},
+					),
+				},
+			},
+			"/format": map[string]any{
+				"post": map[string]any{
+					"operationId": "format",
+					"security":    authenticated,
+					"parameters":  []any{toolchainLock},
+					"requestBody": sourceBody("FormatRequest"),
+					"responses": withResponses(
+						builder.errorResponses(append(slices.Clone(toolErrorCodes), "format_failed", "format_timeout")),
+						map[string]any{"200": jsonResponse("The formatted source.", formatMessage)},
+					),
+				},
+			},
+			"/lint": map[string]any{
+				"post": map[string]any{
+					"operationId": "lint",
+					"security":    authenticated,
+					"parameters":  []any{toolchainLock},
+					"requestBody": sourceBody("LintRequest"),
+					"responses": withResponses(builder.errorResponses(toolErrorCodes), map[string]any{
+						"200": jsonResponse("The linter findings.", lintMessage),
+					}),
+				},
+			},
+			"/debug": map[string]any{
+				"post": map[string]any{
+					"operationId": "debug",
+					"security":    authenticated,
+					"parameters":  []any{protocolVersion, toolchainLock},
+					"requestBody": map[string]any{
+						"required": true,
+						"content": map[string]any{
+							"application/json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/DebugRequest"}},
+						},
+					},
+					"responses": withResponses(withCompileFailure(builder.errorResponses(
+						append(slices.Clone(toolErrorCodes), "unsupported_protocol_version"),
+					)), map[string]any{
+						"200": jsonResponse("The debugger stops and the program's output.", debugMessage),
+					}),
+				},
+			},
+			"/capabilities": map[string]any{
+				"get": map[string]any{
+					"operationId": "capabilities",
+					"security":    authenticated,
+					"responses": withResponses(builder.errorResponses([]string{"method_not_allowed", "unauthorized"}), map[string]any{
+						"200": jsonResponse("Supported protocol versions and features.", capabilities),
+					}),
+				},
+			},
+			"/openapi.json": map[string]any{
+				"get": map[string]any{
+					"operationId": "openapi",
+					"security":    authenticated,
+					"responses": withResponses(builder.errorResponses([]string{"method_not_allowed", "unauthorized"}), map[string]any{
+						"200": jsonResponse("This document.", map[string]any{"type": "object"}),
+					}),
+				},
+			},
+			"/": map[string]any{
+				"get": map[string]any{
+					"operationId": "health",
+					"responses": withResponses(builder.errorResponses([]string{"method_not_allowed", "not_found"}), map[string]any{
+						"200": map[string]any{
+							"description": "The runner is accepting requests.",
+							"content": map[string]any{
+								"text/plain": map[string]any{"schema": map[string]any{"const": "ok"}},
+							},
+						},
+					}),
+				},
+			},
+		},
+		"components": map[string]any{
+			"schemas": builder.components,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+var openAPIDocumentJSON = sync.OnceValue(func() []byte {
+	document, err := json.Marshal(openAPIDocument())
+	if err != nil {
+		panic("openapi: " + err.Error())
+	}
+	return document
+})
+
+func (s *runnerServer) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) || !s.authenticate(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, json.RawMessage(openAPIDocumentJSON()))
+}
@@ -0,0 +1,433 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// validateSchema checks value against the JSON Schema subset the generated
+// document uses.
+func validateSchema(document map[string]any, schema map[string]any, value any, path string) error {
+	if reference, ok := schema["$ref"].(string); ok {
+		resolved := any(document)
+		for _, segment := range strings.Split(strings.TrimPrefix(reference, "#/"), "/") {
+			resolved = resolved.(map[string]any)[segment]
+		}
+		return validateSchema(document, resolved.(map[string]any), value, path)
+	}
+	if alternatives, ok := schema["oneOf"].([]any); ok {
+		matches := 0
+		for _, alternative := range alternatives {
+			if validateSchema(document, alternative.(map[string]any), value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s matches %d oneOf alternatives", path, matches)
+		}
+		return nil
+	}
+	if alternatives, ok := schema["anyOf"].([]any); ok {
+		for _, alternative := range alternatives {
+			if validateSchema(document, alternative.(map[string]any), value, path) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s matches no anyOf alternative", path)
+	}
+	if constant, ok := schema["const"]; ok && value != constant {
+		return fmt.Errorf("%s = %v, want %v", path, value, constant)
+	}
+	if values, ok := schema["enum"].([]any); ok && !slices.Contains(values, value) {
+		return fmt.Errorf("%s = %v, not in %v", path, value, values)
+	}
+	if kinds, ok := schema["type"]; ok {
+		accepted := []any{kinds}
+		if list, ok := kinds.([]any); ok {
+			accepted = list
+		}
+		if !slices.ContainsFunc(accepted, func(kind any) bool { return jsonTypeMatches(kind.(string), value) }) {
+			return fmt.Errorf("%s = %v, want type %v", path, value, kinds)
+		}
+	}
+	switch value := value.(type) {
+	case map[string]any:
+		properties, _ := schema["properties"].(map[string]any)
+		required, _ := schema["required"].([]any)
+		for _, name := range required {
+			if _, ok := value[name.(string)]; !ok {
+				return fmt.Errorf("%s lacks required %s", path, name)
+			}
+		}
+		for name, member := range value {
+			memberSchema, declared := properties[name].(map[string]any)
+			if !declared {
+				additional, ok := schema["additionalProperties"].(map[string]any)
+				if !ok {
+					if schema["additionalProperties"] == false {
+						return fmt.Errorf("%s has undeclared %s", path, name)
+					}
+					continue
+				}
+				memberSchema = additional
+			}
+			if err := validateSchema(document, memberSchema, member, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case []any:
+		items, _ := schema["items"].(map[string]any)
+		for index, item := range value {
+			if err := validateSchema(document, items, item, fmt.Sprintf("%s[%d]", path, index)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func jsonTypeMatches(kind string, value any) bool {
+	switch value := value.(type) {
+	case nil:
+		return kind == "null"
+	case bool:
+		return kind == "boolean"
+	case string:
+		return kind == "string"
+	case float64:
+		return kind == "number" || (kind == "integer" && value == float64(int64(value)))
+	case []any:
+		return kind == "array"
+	case map[string]any:
+		return kind == "object"
+	}
+	return false
+}
+
+func servedOpenAPIDocument(t *testing.T) map[string]any {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodGet, "/openapi.json", "", ""))
+	var document map[string]any
+	if err := json.Unmarshal(recorder.Body.Bytes(), &document); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d body = %s", recorder.Code, recorder.Body.String())
+	}
+	if document["openapi"] != "3.1.0" {
+		t.Fatalf("openapi = %v", document["openapi"])
+	}
+	return document
+}
+
+func TestHandlerResponsesMatchOpenAPIDocument(t *testing.T) {
+	document := servedOpenAPIDocument(t)
+	infrastructureFailure := testOperations()
+	infrastructureFailure.compileAndRun = func(context.Context, runReq) (runMessage, error) {
+		return runMessage{}, infrastructureError("create request directory", os.ErrPermission)
+	}
+	compileFailure := testOperations()
+	compileFailure.compileAndRun = func(context.Context, runReq) (runMessage, error) {
+		return runMessage{Phase: runPhaseCompile, CompilerOutput: "error", CompilerCode: 1}, nil
+	}
+	optionalFields := testOperations()
+	optionalFields.compileAndRun = func(context.Context, runReq) (runMessage, error) {
+		binCode := 0
+		return runMessage{
+			Phase:     runPhaseRun,
+			BinCode:   &binCode,
+			Benchmark: &benchmarkResult{Runs: 1, WallTimeMs: &benchmarkStatistics{Min: 1}},
+			Trace:     []traceStep{{Line: 1, Frames: []debugFrame{{Index: 0}}, Locals: []debugVariable{}}},
+		}, nil
+	}
+	unavailableSanitizer := testOperations()
+	unavailableSanitizer.compileAndRun = func(context.Context, runReq) (runMessage, error) {
+		return runMessage{}, errSanitizerUnavailable
+	}
+	toolFailures := testOperations()
+	toolFailures.buildArtifacts = func(context.Context, runReq) (artifactBuild, error) {
+		return artifactBuild{message: runMessage{Phase: runPhaseCompile, CompilerCode: 1}}, nil
+	}
+	toolFailures.format = func(context.Context, formatReq) (formatResult, error) {
+		return formatResult{failed: true, diagnostics: []formatDiagnostic{{Line: 1, Message: "bad"}}}, nil
+	}
+	toolFailures.debug = func(context.Context, debugReq) (debugSession, error) {
+		return debugSession{compile: runMessage{Phase: runPhaseCompile, CompilerCode: 1}}, nil
+	}
+	oversizedArtifacts := testOperations()
+	oversizedArtifacts.buildArtifacts = func(context.Context, runReq) (artifactBuild, error) {
+		return artifactBuild{}, errArtifactsTooLarge
+	}
+	exercised := map[string]bool{}
+	for _, test := range []struct {
+		name       string
+		operations runnerOperations
+		request    *http.Request
+		wantStatus int
+	}{
+		{"run", testOperations(), runnerRequest(http.MethodPost, "/run", "text/plain", "main() {}"), http.StatusOK},
+		{"run v2", testOperations(), runnerRequest(http.MethodPost, "/run", "application/json",
+			`{"code":"main() {}","protocol_version":2}`), http.StatusOK},
+		{"compile failure", compileFailure, runnerRequest(http.MethodPost, "/run", "text/plain", "main("), http.StatusOK},
+		{"optional fields", optionalFields, runnerRequest(http.MethodPost, "/run", "text/plain", ""), http.StatusOK},
+		{"invalid body", testOperations(), runnerRequest(http.MethodPost, "/run", "application/json", `{}`), http.StatusBadRequest},
+		{"unsupported protocol", testOperations(), runnerRequest(http.MethodPost, "/run", "application/json",
+			`{"code":"","protocol_version":9}`), http.StatusBadRequest},
+		{"wrong method", testOperations(), runnerRequest(http.MethodGet, "/run", "", ""), http.StatusMethodNotAllowed},
+		{"media type", testOperations(), runnerRequest(http.MethodPost, "/run", "text/html", ""), http.StatusUnsupportedMediaType},
+		{"too large", testOperations(), runnerRequest(http.MethodPost, "/run", "text/plain",
+			strings.Repeat("a", maxRequestBodyBytes+1)), http.StatusRequestEntityTooLarge},
+		{"sanitizer", unavailableSanitizer, runnerRequest(http.MethodPost, "/run", "application/json",
+			`{"code":"","mode":"sanitize"}`), http.StatusUnprocessableEntity},
+		{"infrastructure", infrastructureFailure, runnerRequest(http.MethodPost, "/run", "text/plain", ""),
+			http.StatusServiceUnavailable},
+		{"artifacts", testOperations(), runnerRequest(http.MethodPost, "/artifacts", "text/plain", "main() {}"), http.StatusOK},
+		{"artifacts compile failure", toolFailures, runnerRequest(http.MethodPost, "/artifacts", "application/json",
+			`{"code":"main(","protocol_version":2}`), http.StatusUnprocessableEntity},
+		{"artifacts too large", oversizedArtifacts, runnerRequest(http.MethodPost, "/artifacts", "text/plain", ""),
+			http.StatusUnprocessableEntity},
+		{"format", testOperations(), runnerRequest(http.MethodPost, "/format", "application/json",
+			`{"code":"main() {}","diff":true}`), http.StatusOK},
+		{"format failure", toolFailures, runnerRequest(http.MethodPost, "/format", "text/plain", "main("),
+			http.StatusUnprocessableEntity},
+		{"lint", testOperations(), runnerRequest(http.MethodPost, "/lint", "text/plain", "main() {}"), http.StatusOK},
+		{"debug", testOperations(), runnerRequest(http.MethodPost, "/debug", "application/json",
+			`{"code":"main() {}","breakpoints":["main.cj:1"]}`), http.StatusOK},
+		{"debug media type", testOperations(), runnerRequest(http.MethodPost, "/debug", "text/plain", "main() {}"),
+			http.StatusUnsupportedMediaType},
+		{"debug compile failure", toolFailures, runnerRequest(http.MethodPost, "/debug", "application/json",
+			`{"code":"main(","protocol_version":2}`), http.StatusUnprocessableEntity},
+		{"capabilities", testOperations(), runnerRequest(http.MethodGet, "/capabilities", "", ""), http.StatusOK},
+		{"openapi", testOperations(), runnerRequest(http.MethodGet, "/openapi.json", "", ""), http.StatusOK},
+		{"health route", testOperations(), runnerRequest(http.MethodGet, "/", "", ""), http.StatusOK},
+		{"unknown route", testOperations(), runnerRequest(http.MethodGet, "/missing", "", ""), http.StatusNotFound},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			testHandler(test.operations).ServeHTTP(recorder, test.request)
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", recorder.Code, test.wantStatus, recorder.Body.String())
+			}
+			path := test.request.URL.Path
+			if path == "/missing" {
+				path = "/"
+			}
+			exercised[path] = true
+			operation, ok := document["paths"].(map[string]any)[path].(map[string]any)
+			if !ok {
+				t.Fatalf("document has no path %s", path)
+			}
+			// Each route documents one operation, which also describes its
+			// wrong-method response.
+			var responses map[string]any
+			for _, documented := range operation {
+				responses = documented.(map[string]any)["responses"].(map[string]any)
+			}
+			response, ok := responses[strconv.Itoa(recorder.Code)].(map[string]any)
+			if !ok {
+				t.Fatalf("%s does not document status %d", path, recorder.Code)
+			}
+			mediaType, _, _ := strings.Cut(recorder.Header().Get("Content-Type"), ";")
+			content, ok := response["content"].(map[string]any)[mediaType].(map[string]any)
+			if !ok {
+				t.Fatalf("status %d does not document %s", recorder.Code, mediaType)
+			}
+			var body any = recorder.Body.String()
+			if mediaType == "application/json" {
+				if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := validateSchema(document, content["schema"].(map[string]any), body, "body"); err != nil {
+				t.Fatalf("%v: %s", err, recorder.Body.String())
+			}
+		})
+	}
+	// Every route the mux serves is documented and exercised above.
+	for _, route := range runnerRoutes {
+		if _, ok := document["paths"].(map[string]any)[route.pattern]; !ok {
+			t.Errorf("document has no path %s", route.pattern)
+		}
+		if !exercised[route.pattern] {
+			t.Errorf("no response of %s is checked against the document", route.pattern)
+		}
+	}
+}
+
+func TestDetailedErrorBodiesAreDocumented(t *testing.T) {
+	builder := &schemaBuilder{components: map[string]any{}}
+	responses := builder.errorResponses([]string{"format_failed", "format_timeout"})
+	encoded, err := json.Marshal(map[string]any{
+		"components": map[string]any{"schemas": builder.components},
+		"responses":  responses,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document map[string]any
+	if err := json.Unmarshal(encoded, &document); err != nil {
+		t.Fatal(err)
+	}
+	response := document["responses"].(map[string]any)["422"].(map[string]any)
+	schema := response["content"].(map[string]any)["application/json"].(map[string]any)["schema"].(map[string]any)
+	for _, write := range []func(http.ResponseWriter){
+		func(w http.ResponseWriter) {
+			writeFormatFailure(w, http.StatusUnprocessableEntity, "format_failed", "bad", []formatDiagnostic{{Line: 1}})
+		},
+		func(w http.ResponseWriter) {
+			writeError(w, http.StatusUnprocessableEntity, "format_timeout", "slow")
+		},
+	} {
+		recorder := httptest.NewRecorder()
+		write(recorder)
+		var body any
+		if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if err := validateSchema(document, schema, body, "body"); err != nil {
+			t.Fatalf("%v: %s", err, recorder.Body.String())
+		}
+	}
+}
+
+func TestOpenAPIListsEveryWriteErrorCode(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	emitted := map[string]bool{}
+	fileSet := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		file, err := parser.ParseFile(fileSet, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(file, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok || len(call.Args) < 4 {
+				return true
+			}
+			if function, ok := call.Fun.(*ast.Ident); !ok ||
+				(function.Name != "writeError" && function.Name != "writeFormatFailure") {
+				return true
+			}
+			literal, ok := call.Args[2].(*ast.BasicLit)
+			if !ok {
+				t.Errorf("%s: writeError code is not a literal", fileSet.Position(call.Pos()))
+				return true
+			}
+			code, _ := strconv.Unquote(literal.Value)
+			emitted[code] = true
+			status, ok := runnerErrorStatuses[code]
+			if !ok {
+				t.Errorf("%s: code %q is not in runnerErrorStatuses", fileSet.Position(call.Pos()), code)
+				return true
+			}
+			want := strconv.Itoa(status)
+			if text := http.StatusText(status); text != "" {
+				want = "http.Status" + strings.NewReplacer(" ", "", "-", "").Replace(text)
+			}
+			if got := expressionText(call.Args[1]); got != want {
+				t.Errorf("%s: code %q has status %s, documented as %s", fileSet.Position(call.Pos()), code, got, want)
+			}
+			return true
+		})
+	}
+	for code := range runnerErrorStatuses {
+		if !emitted[code] {
+			t.Errorf("documented code %q is never emitted", code)
+		}
+	}
+	document := openAPIDocument()
+	catalog := document["components"].(map[string]any)["schemas"].(map[string]any)["ErrorCode"].(map[string]any)
+	if !slices.Equal(catalog["enum"].([]string), sortedKeys(runnerErrorStatuses)) {
+		t.Fatalf("ErrorCode = %v", catalog["enum"])
+	}
+}
+
+// expressionText renders a status argument as written, such as
+// http.StatusBadRequest.
+func expressionText(expression ast.Expr) string {
+	switch expression := expression.(type) {
+	case *ast.SelectorExpr:
+		return expressionText(expression.X) + "." + expression.Sel.Name
+	case *ast.Ident:
+		return expression.Name
+	case *ast.BasicLit:
+		return expression.Value
+	}
+	return fmt.Sprintf("%T", expression)
+}
+
+// typeScriptConstantList returns the quoted or numeric members of the list
+// that follows declaration in runner-contract.ts.
+func typeScriptConstantList(t *testing.T, contract []byte, declaration string) []string {
+	t.Helper()
+	list := regexp.MustCompile(`(?s)` + regexp.QuoteMeta(declaration) + `\(?\[(.*?)\](?: as const|\))?\n`).FindSubmatch(contract)
+	if list == nil {
+		t.Fatalf("runner contract has no %s", declaration)
+	}
+	var members []string
+	for _, match := range regexp.MustCompile(`'([a-z_]+)'|\b([0-9]+)\b`).FindAllSubmatch(list[1], -1) {
+		members = append(members, string(match[1])+string(match[2]))
+	}
+	slices.Sort(members)
+	return members
+}
+
+func TestOpenAPIRunMessageMatchesTypeScriptContract(t *testing.T) {
+	contract, err := os.ReadFile("../../../src/lib/runner-contract.ts")
+	if err != nil {
+		t.Fatalf("read runner contract: %v", err)
+	}
+	schemas := openAPIDocument()["components"].(map[string]any)["schemas"].(map[string]any)
+	runMessage := schemas["RunMessage"].(map[string]any)
+	required := slices.Clone(runMessage["required"].([]string))
+	slices.Sort(required)
+	if fields := typeScriptConstantList(t, contract, "const RUN_RESPONSE_FIELDS = new Set("); !slices.Equal(fields, required) {
+		t.Fatalf("RunMessage requires %q, runner-contract.ts expects %q", required, fields)
+	}
+
+	var optional []string
+	for name := range runMessage["properties"].(map[string]any) {
+		if !slices.Contains(required, name) {
+			optional = append(optional, name)
+		}
+	}
+	slices.Sort(optional)
+	// Map entries are [name, validator] pairs; only the names are quoted.
+	fields := typeScriptConstantList(t, contract, "const OPTIONAL_RUN_RESPONSE_FIELDS = new Map<string, (value: unknown) => boolean>(")
+	if !slices.Equal(fields, optional) {
+		t.Fatalf("RunMessage has optional %q, runner-contract.ts accepts %q", optional, fields)
+	}
+
+	phases := slices.Sorted(slices.Values(runMessage["properties"].(map[string]any)["phase"].(map[string]any)["enum"].([]string)))
+	if contractPhases := typeScriptConstantList(t, contract, "export const RUNNER_EXECUTION_PHASES = "); !slices.Equal(contractPhases, phases) {
+		t.Fatalf("RunMessage phases are %q, runner-contract.ts expects %q", phases, contractPhases)
+	}
+
+	var versions []string
+	for _, version := range supportedProtocolVersions {
+		versions = append(versions, strconv.Itoa(version))
+	}
+	slices.Sort(versions)
+	if contractVersions := typeScriptConstantList(t, contract, "export const RUNNER_PROTOCOL_VERSIONS = "); !slices.Equal(contractVersions, versions) {
+		t.Fatalf("runner supports protocol versions %q, runner-contract.ts expects %q", versions, contractVersions)
+	}
+}
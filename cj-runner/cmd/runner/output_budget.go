@@ -0,0 +1,118 @@
+//go:build linux
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// outputBudget is how much of the program's stdout and stderr a request
+// keeps, within the server's maxima. Zero members keep the server's limit;
+// a tail window keeps the end of a channel that overflows as well as its
+// start.
+type outputBudget struct {
+	ChannelBytes  int `json:"channel_bytes"`
+	CombinedBytes int `json:"combined_bytes"`
+	TailBytes     int `json:"tail_bytes"`
+}
+
+func parseOutputBudget(budget outputBudget) error {
+	if budget.ChannelBytes < 0 || budget.CombinedBytes < 0 || budget.TailBytes < 0 {
+		return errors.New("output_budget members must not be negative")
+	}
+	return nil
+}
+
+// outputRetention is how much of its output a process keeps. Sizes are raw
+// bytes; replacing invalid UTF-8 never lets a channel's content exceed
+// channelBytes.
+type outputRetention struct {
+	// channelBytes caps each channel, head and tail window together.
+	channelBytes int
+	// combinedBytes caps stdout and stderr together; zero leaves only the
+	// per-channel cap.
+	combinedBytes int
+	// tailBytes of each channel are kept from its end.
+	tailBytes int
+}
+
+// outputRetention is how much program output the request keeps.
+func (in runReq) outputRetention() outputRetention {
+	limits := in.serverLimits()
+	retention := outputRetention{
+		channelBytes:  limits.MaxOutputBytes,
+		combinedBytes: limits.MaxCombinedOutputBytes,
+	}
+	if budget := in.OutputBudget; budget != nil {
+		retention.channelBytes = cmp.Or(budget.ChannelBytes, retention.channelBytes)
+		retention.combinedBytes = cmp.Or(budget.CombinedBytes, retention.combinedBytes)
+		retention.tailBytes = budget.TailBytes
+	}
+	return retention
+}
+
+// budget reports the retention as the response's output_budget.
+func (r outputRetention) budget() *outputBudget {
+	return &outputBudget{ChannelBytes: r.channelBytes, CombinedBytes: r.combinedBytes, TailBytes: r.tailBytes}
+}
+
+// buffers returns the stdout and stderr buffers of one process. Both tail
+// windows are set aside from the combined budget, and the channels compete
+// for the rest in the order they write.
+func (r outputRetention) buffers() (*cappedBuffer, *cappedBuffer) {
+	channelBytes := cmp.Or(r.channelBytes, maxSerializedOutputBytes)
+	var pool *outputPool
+	if r.combinedBytes != 0 && r.combinedBytes < 2*channelBytes {
+		pool = &outputPool{remaining: max(r.combinedBytes-2*r.tailBytes, 0)}
+	}
+	return &cappedBuffer{cap: channelBytes, tailCap: r.tailBytes, pool: pool},
+		&cappedBuffer{cap: channelBytes, tailCap: r.tailBytes, pool: pool}
+}
+
+// outputPool is head window space shared by the channels of one process. A
+// nil pool is unlimited.
+type outputPool struct {
+	mu        sync.Mutex
+	remaining int
+}
+
+// take reserves up to n bytes and reports how many it got.
+func (p *outputPool) take(n int) int {
+	if p == nil {
+		return n
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	n = min(n, p.remaining)
+	p.remaining -= n
+	return n
+}
+
+// negotiateOutputBudget holds the request's output budget to the server's
+// maxima. It writes the error response itself on failure.
+func negotiateOutputBudget(w http.ResponseWriter, in runReq) bool {
+	if in.OutputBudget == nil {
+		return true
+	}
+	limits := in.serverLimits()
+	retention := in.outputRetention()
+	var message string
+	switch {
+	case retention.channelBytes > limits.MaxOutputBytes:
+		message = fmt.Sprintf("channel_bytes must be at most %d.", limits.MaxOutputBytes)
+	case retention.combinedBytes > limits.MaxCombinedOutputBytes:
+		message = fmt.Sprintf("combined_bytes must be at most %d.", limits.MaxCombinedOutputBytes)
+	case retention.tailBytes > retention.channelBytes:
+		message = "tail_bytes must not exceed channel_bytes."
+	case 2*retention.tailBytes > retention.combinedBytes:
+		message = "Both tail windows must fit in combined_bytes."
+	default:
+		return true
+	}
+	writeError(w, http.StatusBadRequest, "invalid_output_budget", message)
+	return false
+}
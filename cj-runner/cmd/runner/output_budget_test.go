@@ -0,0 +1,117 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCappedBufferKeepsHeadAndTail(t *testing.T) {
+	output := &cappedBuffer{cap: 10, tailCap: 5}
+	_, _ = output.Write([]byte("hello"))
+	for range 100 {
+		_, _ = output.Write([]byte("x"))
+	}
+	_, _ = output.Write([]byte("panic"))
+	got := output.Result()
+	if got.content != "hellopanic" || !got.truncated || got.omittedBytes != 100 {
+		t.Fatalf("result = %+v", got)
+	}
+
+	output = &cappedBuffer{cap: 10, tailCap: 5}
+	_, _ = output.Write([]byte("complete"))
+	if got := output.Result(); got.content != "complete" || got.truncated || got.omittedBytes != 0 {
+		t.Fatalf("result = %+v", got)
+	}
+}
+
+func TestCappedBufferDropsRunesSplitByTheGap(t *testing.T) {
+	// The head window ends one byte into the second rune, and the tail
+	// window starts one byte into the second-to-last.
+	output := &cappedBuffer{cap: 8, tailCap: 4}
+	input := strings.Repeat("界", 10)
+	_, _ = output.Write([]byte(input))
+	got := output.Result()
+	if got.content != "界界" || !utf8.ValidString(got.content) ||
+		got.omittedBytes != int64(len(input)-len(got.content)) {
+		t.Fatalf("result = %+v", got)
+	}
+}
+
+func TestCombinedOutputBudgetIsShared(t *testing.T) {
+	stdout, stderr := outputRetention{channelBytes: 10, combinedBytes: 12, tailBytes: 2}.buffers()
+	_, _ = stdout.Write([]byte(strings.Repeat("o", 19) + "O"))
+	_, _ = stderr.Write([]byte(strings.Repeat("e", 19) + "E"))
+	out, err := stdout.Result(), stderr.Result()
+	if out.content != "oooooooooO" || out.omittedBytes != 10 || err.content != "eE" || err.omittedBytes != 18 {
+		t.Fatalf("stdout = %+v stderr = %+v", out, err)
+	}
+
+	// Without a combined budget each channel keeps its own cap.
+	stdout, stderr = outputRetention{channelBytes: 4}.buffers()
+	_, _ = stdout.Write([]byte("stdout"))
+	_, _ = stderr.Write([]byte("stderr"))
+	if out, err := stdout.Result(), stderr.Result(); out.content != "stdo" || err.content != "stde" {
+		t.Fatalf("stdout = %+v stderr = %+v", out, err)
+	}
+}
+
+func TestRunRequestOutputBudget(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseRun}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost, "/run", "application/json", `{"code":"main() {}","output_budget":{"channel_bytes":4096,"tail_bytes":1024}}`,
+	))
+	want := outputRetention{channelBytes: 4096, combinedBytes: 2 * maxSerializedOutputBytes, tailBytes: 1024}
+	if recorder.Code != http.StatusOK || received.outputRetention() != want ||
+		!strings.Contains(recorder.Body.String(), `"output_budget":{"channel_bytes":4096,"combined_bytes":2000000,"tail_bytes":1024}`) {
+		t.Fatalf("status = %d received = %+v body = %s", recorder.Code, received, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/run", "text/plain", "main() {}"))
+	if recorder.Code != http.StatusOK || strings.Contains(recorder.Body.String(), "output_budget") ||
+		received.outputRetention() != (outputRetention{channelBytes: maxSerializedOutputBytes, combinedBytes: 2 * maxSerializedOutputBytes}) {
+		t.Fatalf("status = %d received = %+v body = %s", recorder.Code, received, recorder.Body.String())
+	}
+}
+
+func TestRunRequestRejectsOutputBudgetsOutsideMaxima(t *testing.T) {
+	for _, budget := range []string{
+		`{"channel_bytes":1000001}`,
+		`{"combined_bytes":2000001}`,
+		`{"channel_bytes":100,"tail_bytes":101}`,
+		`{"combined_bytes":100,"tail_bytes":51}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(
+			http.MethodPost, "/run", "application/json", `{"code":"","output_budget":`+budget+`}`,
+		))
+		if recorder.Code != http.StatusBadRequest || responseError(t, recorder)["code"] != "invalid_output_budget" {
+			t.Fatalf("%s: status = %d body = %s", budget, recorder.Code, recorder.Body.String())
+		}
+	}
+	for _, body := range []string{
+		`{"code":"","output_budget":{"tail_bytes":-1}}`,
+		`{"code":"","output_budget":{"head_bytes":1}}`,
+		`{"code":"","output_budget":null}`,
+		`{"code":"","mode":"check","output_budget":{}}`,
+		`{"code":"","mode":"trace","output_budget":{}}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/run", "application/json", body))
+		if recorder.Code != http.StatusBadRequest || responseError(t, recorder)["code"] != "invalid_json_body" {
+			t.Fatalf("%s status = %d body = %s", body, recorder.Code, recorder.Body.String())
+		}
+	}
+}
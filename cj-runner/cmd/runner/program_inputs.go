@@ -0,0 +1,121 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	maxProgramArguments        = 64
+	maxProgramArgumentBytes    = 4 * 1024
+	maxProgramEnvironment      = 32
+	maxProgramEnvironmentName  = 128
+	maxProgramEnvironmentValue = 4 * 1024
+	maxProgramInputsTotalBytes = 32 * 1024
+)
+
+// reservedEnvironmentPrefixes cover loader and libc knobs that would let a
+// request inject code or reconfigure the runtime underneath the learner.
+var reservedEnvironmentPrefixes = []string{"LD_", "GLIBC_TUNABLES"}
+
+// isReservedEnvironmentName reports whether name is owned by the runner: every
+// key runtimeEnvironment sets, the deterministic and runtime-option knobs that
+// have their own request fields, and the loader prefixes above.
+func isReservedEnvironmentName(name string) bool {
+	reserved := append(runtimeEnvironment("/"), deterministicEnvironment...)
+	for _, entry := range reserved {
+		if key, _, _ := strings.Cut(entry, "="); key == name {
+			return true
+		}
+	}
+	if _, ok := runtimeOptionLimits[name]; ok {
+		return true
+	}
+	for _, prefix := range reservedEnvironmentPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isEnvironmentName(name string) bool {
+	if name == "" || len(name) > maxProgramEnvironmentName {
+		return false
+	}
+	for index, character := range name {
+		letter := character == '_' ||
+			character >= 'A' && character <= 'Z' ||
+			character >= 'a' && character <= 'z'
+		if !letter && (index == 0 || character < '0' || character > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func validateProgramArguments(arguments []string) error {
+	if len(arguments) > maxProgramArguments {
+		return fmt.Errorf("args must contain at most %d entries", maxProgramArguments)
+	}
+	for _, argument := range arguments {
+		if len(argument) > maxProgramArgumentBytes {
+			return fmt.Errorf("each arg must contain at most %d bytes", maxProgramArgumentBytes)
+		}
+		if strings.IndexByte(argument, 0) != -1 {
+			return errors.New("args must not contain NUL characters")
+		}
+	}
+	return nil
+}
+
+func validateProgramEnvironment(environment map[string]string) error {
+	if len(environment) > maxProgramEnvironment {
+		return fmt.Errorf("env must contain at most %d entries", maxProgramEnvironment)
+	}
+	for name, value := range environment {
+		if !isEnvironmentName(name) {
+			return fmt.Errorf("env name %q is not a portable environment variable name", name)
+		}
+		if isReservedEnvironmentName(name) {
+			return fmt.Errorf("env name %q is reserved by the runner", name)
+		}
+		if len(value) > maxProgramEnvironmentValue {
+			return fmt.Errorf("env value for %s must contain at most %d bytes", name, maxProgramEnvironmentValue)
+		}
+		if strings.IndexByte(value, 0) != -1 {
+			return errors.New("env values must not contain NUL characters")
+		}
+	}
+	return nil
+}
+
+// validateProgramInputSize bounds what args and env add to the exec block
+// together, independent of the request body limit.
+func validateProgramInputSize(arguments []string, environment map[string]string) error {
+	total := 0
+	for _, argument := range arguments {
+		total += len(argument) + 1
+	}
+	for name, value := range environment {
+		total += len(name) + len(value) + 2
+	}
+	if total > maxProgramInputsTotalBytes {
+		return fmt.Errorf("args and env must contain at most %d bytes together", maxProgramInputsTotalBytes)
+	}
+	return nil
+}
+
+// programEnvironment renders request variables in a stable order.
+func programEnvironment(environment map[string]string) []string {
+	entries := make([]string, 0, len(environment))
+	for name, value := range environment {
+		entries = append(entries, name+"="+value)
+	}
+	slices.Sort(entries)
+	return entries
+}
@@ -0,0 +1,110 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestProgramEnvironmentCannotOverrideRunnerOwnedKeys(t *testing.T) {
+	for _, entry := range runtimeEnvironment("/request") {
+		name, _, _ := strings.Cut(entry, "=")
+		if err := validateProgramEnvironment(map[string]string{name: "override"}); err == nil {
+			t.Fatalf("runtime environment key %s can be overridden by a request", name)
+		}
+	}
+	for _, name := range []string{
+		"LD_PRELOAD",
+		"LD_AUDIT",
+		"GLIBC_TUNABLES",
+		"TZ",
+		"cjHeapSize",
+		"cjProcessorNum",
+	} {
+		if err := validateProgramEnvironment(map[string]string{name: "override"}); err == nil {
+			t.Fatalf("reserved key %s can be set through env", name)
+		}
+	}
+	for _, name := range []string{"", "1ST", "WITH-DASH", "WITH=EQUALS", "SPACE NAME", strings.Repeat("A", maxProgramEnvironmentName+1)} {
+		if err := validateProgramEnvironment(map[string]string{name: "value"}); err == nil {
+			t.Fatalf("invalid env name %q passed validation", name)
+		}
+	}
+	if err := validateProgramEnvironment(map[string]string{"GREETING": "a\x00b"}); err == nil {
+		t.Fatal("NUL byte in env value passed validation")
+	}
+
+	valid := map[string]string{"GREETING": "你好", "_lesson_2": ""}
+	if err := validateProgramEnvironment(valid); err != nil {
+		t.Fatalf("valid env rejected: %v", err)
+	}
+	if got := programEnvironment(valid); !slices.Equal(got, []string{"GREETING=你好", "_lesson_2="}) {
+		t.Fatalf("program environment = %q", got)
+	}
+}
+
+func TestProgramArgumentsAreBounded(t *testing.T) {
+	if err := validateProgramArguments([]string{"--name", "仓颉", ""}); err != nil {
+		t.Fatalf("valid args rejected: %v", err)
+	}
+	for name, arguments := range map[string][]string{
+		"too many":  make([]string, maxProgramArguments+1),
+		"too long":  {strings.Repeat("x", maxProgramArgumentBytes+1)},
+		"NUL bytes": {"a\x00b"},
+	} {
+		if err := validateProgramArguments(arguments); err == nil {
+			t.Fatalf("%s args passed validation", name)
+		}
+	}
+	arguments := make([]string, maxProgramArguments)
+	for index := range arguments {
+		arguments[index] = strings.Repeat("x", maxProgramArgumentBytes)
+	}
+	if err := validateProgramInputSize(arguments, nil); err == nil {
+		t.Fatal("args beyond the combined size limit passed validation")
+	}
+}
+
+func TestRunRequestProgramArgumentsAndEnvironment(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseCompile, CompilerCode: 1}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost,
+		"/run",
+		"application/json",
+		`{"code":"main(args: Array<String>) {}","args":["one","two"],"env":{"LESSON":"7"}}`,
+	))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d; body=%s", recorder.Code, recorder.Body.String())
+	}
+	if !slices.Equal(received.Args, []string{"one", "two"}) || received.Env["LESSON"] != "7" {
+		t.Fatalf("operation received args=%q env=%q", received.Args, received.Env)
+	}
+
+	for _, body := range []string{
+		`{"code":"main() {}","args":"one"}`,
+		`{"code":"main() {}","args":null}`,
+		`{"code":"main() {}","env":{"PATH":"/tmp"}}`,
+		`{"code":"main() {}","env":{"LD_PRELOAD":"/tmp/x.so"}}`,
+		`{"code":"main() {}","env":{"COUNT":7}}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(
+			recorder,
+			runnerRequest(http.MethodPost, "/run", "application/json", body),
+		)
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+//go:build linux
+
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// protocolVersionHeader selects the response protocol of a run request. It
+// is the only way for text/plain bodies to opt in; JSON bodies may use the
+// protocol_version field instead.
+const protocolVersionHeader = "X-Playground-Runner-Protocol"
+
+const (
+	// protocolVersion1 is the flat RunMessage shape pinned by
+	// src/lib/runner-contract.ts. Clients that name no version get it, byte
+	// for byte, with optional fields only when they opted into them.
+	protocolVersion1 = 1
+	// protocolVersion2 carries the same fields plus protocol_version, and
+	// clients that select it accept fields they do not recognise, so new
+	// fields can ship without a coordinated gateway release.
+	protocolVersion2 = 2
+
+	defaultProtocolVersion = protocolVersion1
+)
+
+var supportedProtocolVersions = []int{protocolVersion1, protocolVersion2}
+
+// protocolVersion is the response protocol of the request.
+func (in runReq) protocolVersion() int {
+	if in.ProtocolVersion == 0 {
+		return defaultProtocolVersion
+	}
+	return in.ProtocolVersion
+}
+
+// runMessageV2 is a RunMessage as protocol version 2 serialises it.
+type runMessageV2 struct {
+	ProtocolVersion int `json:"protocol_version"`
+	runMessage
+}
+
+// negotiateProtocolVersion merges the protocol header into the version the
+// request body asked for, zero when it named none. A header and body field
+// that disagree, or a version the runner does not
+// speak, are refused rather than answered in a shape the client cannot read.
+// It writes the error response itself on failure.
+func negotiateProtocolVersion(w http.ResponseWriter, r *http.Request, requested *int) bool {
+	values := r.Header.Values(protocolVersionHeader)
+	if len(values) > 1 {
+		writeProtocolVersionError(w, "Send at most one "+protocolVersionHeader+" header.")
+		return false
+	}
+	if len(values) == 1 {
+		version, err := strconv.Atoi(values[0])
+		if err != nil || version < 1 {
+			writeProtocolVersionError(w, protocolVersionHeader+" must be a positive integer.")
+			return false
+		}
+		if *requested != 0 && *requested != version {
+			writeProtocolVersionError(w, protocolVersionHeader+" and protocol_version disagree.")
+			return false
+		}
+		*requested = version
+	}
+	if *requested == 0 {
+		return true
+	}
+	if !slices.Contains(supportedProtocolVersions, *requested) {
+		writeProtocolVersionError(w, "Unsupported protocol version; see GET /capabilities.")
+		return false
+	}
+	w.Header().Set(protocolVersionHeader, strconv.Itoa(*requested))
+	return true
+}
+
+func writeProtocolVersionError(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusBadRequest, "unsupported_protocol_version", message)
+}
+
+// writeRunMessage writes a RunMessage in the protocol the request selected.
+func writeRunMessage(w http.ResponseWriter, status int, in runReq, message runMessage) {
+	if in.protocolVersion() == protocolVersion1 {
+		writeJSON(w, status, message)
+		return
+	}
+	writeJSON(w, status, runMessageV2{ProtocolVersion: in.protocolVersion(), runMessage: message})
+}
+
+// Feature names advertised by GET /capabilities. A client checks for the
+// name before sending the fields or calling the endpoint it covers; features
+// this runner lacks, such as streaming or judging, are simply absent.
+const (
+	featureArtifacts      = "artifacts"
+	featureBenchmark      = "benchmark"
+	featureCLibrary       = "c_library"
+	featureCoverage       = "coverage"
+	featureDebug          = "debug"
+	featureDeterministic  = "deterministic"
+	featureFormat         = "format"
+	featureIRDumps        = "ir_dumps"
+	featureLint           = "lint"
+	featureMacroExpansion = "macro_expansion"
+	featureMultiFile      = "multi_file"
+	featureOutputBudget   = "output_budget"
+	featureOutputFiles    = "output_files"
+	featureProgramInputs  = "program_inputs"
+	featureRuntimeOptions = "runtime_options"
+	featureSanitize       = "sanitize"
+	featureSeccomp        = "seccomp"
+	featureTrace          = "trace"
+	featureTranscript     = "transcript"
+)
+
+type capabilityLimits struct {
+	MaxRequestBytes int `json:"max_request_bytes"`
+	MaxOutputBytes  int `json:"max_output_bytes"`
+	// MaxCombinedOutputBytes caps stdout and stderr together.
+	MaxCombinedOutputBytes int   `json:"max_combined_output_bytes"`
+	CompileTimeMs          int64 `json:"compile_time_ms"`
+	RunTimeMs              int64 `json:"run_time_ms"`
+	MaxCompileTimeMs       int64 `json:"max_compile_time_ms"`
+	MaxRunTimeMs           int64 `json:"max_run_time_ms"`
+}
+
+type runnerCapabilities struct {
+	ProtocolVersions       []int            `json:"protocol_versions"`
+	DefaultProtocolVersion int              `json:"default_protocol_version"`
+	Features               []string         `json:"features"`
+	Modes                  []runMode        `json:"modes"`
+	Sanitizers             []sanitizerKind  `json:"sanitizers"`
+	Limits                 capabilityLimits `json:"limits"`
+}
+
+// capabilities describes what this runner accepts. Sanitizers are probed on
+// each call, because their runtimes are optional parts of the toolchain.
+// Time limits are the defaults a request gets and the ceilings it may ask
+// for.
+func capabilities(config runnerConfig) runnerCapabilities {
+	features := []string{
+		featureArtifacts, featureBenchmark, featureCLibrary, featureCoverage, featureDebug,
+		featureDeterministic, featureFormat, featureIRDumps, featureLint, featureMacroExpansion,
+		featureMultiFile, featureOutputBudget, featureOutputFiles, featureProgramInputs, featureRuntimeOptions,
+		featureSeccomp, featureTrace, featureTranscript,
+	}
+	sanitizers := []sanitizerKind{}
+	for _, kind := range []sanitizerKind{sanitizerAddress, sanitizerThread} {
+		if sanitizerAvailable(kind) {
+			sanitizers = append(sanitizers, kind)
+		}
+	}
+	modes := runRequestModes
+	if len(sanitizers) != 0 {
+		features = append(features, featureSanitize)
+	} else {
+		modes = slices.DeleteFunc(slices.Clone(modes), func(mode runMode) bool { return mode == runModeSanitize })
+	}
+	slices.Sort(features)
+	return runnerCapabilities{
+		ProtocolVersions:       supportedProtocolVersions,
+		DefaultProtocolVersion: defaultProtocolVersion,
+		Features:               features,
+		Modes:                  modes,
+		Sanitizers:             sanitizers,
+		Limits: capabilityLimits{
+			MaxRequestBytes:        config.limits.MaxRequestBytes,
+			MaxOutputBytes:         config.limits.MaxOutputBytes,
+			MaxCombinedOutputBytes: config.limits.MaxCombinedOutputBytes,
+			CompileTimeMs:          config.limits.CompileTimeout.Milliseconds(),
+			RunTimeMs:              config.limits.RunTimeout.Milliseconds(),
+			MaxCompileTimeMs:       config.limits.MaxCompileTimeout.Milliseconds(),
+			MaxRunTimeMs:           config.limits.MaxRunTimeout.Milliseconds(),
+		},
+	}
+}
+
+func (s *runnerServer) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if !requireGet(w, r) || !s.authenticate(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, capabilities(s.config))
+}
@@ -0,0 +1,134 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestRunResponseKeepsV1ShapeWithoutProtocolOptIn(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/run", "text/plain", "main() {}"))
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(recorder.Body.Bytes(), &payload); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d body = %s", recorder.Code, recorder.Body.String())
+	}
+	if _, versioned := payload["protocol_version"]; versioned || len(payload) != 9 {
+		t.Fatalf("body = %s", recorder.Body.String())
+	}
+	if recorder.Header().Get(protocolVersionHeader) != "" {
+		t.Fatalf("%s = %q", protocolVersionHeader, recorder.Header().Get(protocolVersionHeader))
+	}
+}
+
+func TestRunResponseUsesSelectedProtocolVersion(t *testing.T) {
+	for _, test := range []struct {
+		name, contentType, body, header string
+	}{
+		{"header", "text/plain", "main() {}", "2"},
+		{"body field", "application/json", `{"code":"main() {}","protocol_version":2}`, ""},
+		{"both agreeing", "application/json", `{"code":"main() {}","protocol_version":2}`, "2"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			request := runnerRequest(http.MethodPost, "/run", test.contentType, test.body)
+			if test.header != "" {
+				request.Header.Set(protocolVersionHeader, test.header)
+			}
+			recorder := httptest.NewRecorder()
+			testHandler(testOperations()).ServeHTTP(recorder, request)
+			var payload struct {
+				ProtocolVersion int      `json:"protocol_version"`
+				Phase           runPhase `json:"phase"`
+			}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &payload); err != nil ||
+				recorder.Code != http.StatusOK || payload.ProtocolVersion != 2 || payload.Phase != runPhaseRun {
+				t.Fatalf("status = %d body = %s", recorder.Code, recorder.Body.String())
+			}
+			if recorder.Header().Get(protocolVersionHeader) != "2" {
+				t.Fatalf("%s = %q", protocolVersionHeader, recorder.Header().Get(protocolVersionHeader))
+			}
+		})
+	}
+}
+
+func TestRunRequestRejectsUnsupportedProtocolVersions(t *testing.T) {
+	for _, test := range []struct {
+		body, header string
+	}{
+		{`{"code":"","protocol_version":3}`, ""},
+		{`{"code":"","protocol_version":1}`, "2"},
+		{`{"code":""}`, "v2"},
+		{`{"code":""}`, "0"},
+	} {
+		request := runnerRequest(http.MethodPost, "/run", "application/json", test.body)
+		if test.header != "" {
+			request.Header.Set(protocolVersionHeader, test.header)
+		}
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusBadRequest || responseError(t, recorder)["code"] != "unsupported_protocol_version" {
+			t.Fatalf("%s with %q: status = %d body = %s", test.body, test.header, recorder.Code, recorder.Body.String())
+		}
+	}
+	for _, body := range []string{`{"code":"","protocol_version":"2"}`, `{"code":"","protocol_version":0}`} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/run", "application/json", body))
+		if recorder.Code != http.StatusBadRequest || responseError(t, recorder)["code"] != "invalid_json_body" {
+			t.Fatalf("%s status = %d body = %s", body, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestArtifactCompileFailureUsesSelectedProtocolVersion(t *testing.T) {
+	operations := testOperations()
+	operations.buildArtifacts = func(context.Context, runReq) (artifactBuild, error) {
+		return artifactBuild{message: runMessage{Phase: runPhaseCompile, CompilerCode: 1}}, nil
+	}
+	request := runnerRequest(http.MethodPost, "/artifacts", "text/plain", "main() {")
+	request.Header.Set(protocolVersionHeader, "2")
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, request)
+	var payload runMessageV2
+	if err := json.Unmarshal(recorder.Body.Bytes(), &payload); err != nil ||
+		recorder.Code != http.StatusUnprocessableEntity || payload.ProtocolVersion != 2 || payload.CompilerCode != 1 {
+		t.Fatalf("status = %d body = %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestCapabilitiesAdvertiseProtocolVersionsAndFeatures(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodGet, "/capabilities", "", ""))
+	var payload runnerCapabilities
+	if err := json.Unmarshal(recorder.Body.Bytes(), &payload); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d body = %s", recorder.Code, recorder.Body.String())
+	}
+	if !slices.Equal(payload.ProtocolVersions, []int{1, 2}) || payload.DefaultProtocolVersion != 1 {
+		t.Fatalf("versions = %v default = %d", payload.ProtocolVersions, payload.DefaultProtocolVersion)
+	}
+	if !slices.Contains(payload.Features, featureMultiFile) || slices.Contains(payload.Features, "streaming") ||
+		!slices.IsSorted(payload.Features) || !slices.Contains(payload.Modes, runModeTrace) ||
+		slices.Contains(payload.Modes, runModeDebug) {
+		t.Fatalf("features = %q modes = %q", payload.Features, payload.Modes)
+	}
+	if payload.Limits.MaxRequestBytes != maxRequestBodyBytes || payload.Limits.RunTimeMs != runTimeout.Milliseconds() {
+		t.Fatalf("limits = %+v", payload.Limits)
+	}
+
+	unauthenticated := runnerRequest(http.MethodGet, "/capabilities", "", "")
+	unauthenticated.Header.Del("Authorization")
+	recorder = httptest.NewRecorder()
+	testHandler(testOperations()).ServeHTTP(recorder, unauthenticated)
+	if recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("unauthenticated status = %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/capabilities", "", ""))
+	if recorder.Code != http.StatusMethodNotAllowed || recorder.Header().Get("Allow") != http.MethodGet {
+		t.Fatalf("POST status = %d", recorder.Code)
+	}
+}
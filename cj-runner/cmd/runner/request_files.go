@@ -0,0 +1,343 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+	"unsafe"
+)
+
+const (
+	maxInputFiles       = 16
+	maxRequestPathBytes = 255
+	maxRequestPathDepth = 8
+	maxOutputPatterns   = 16
+	maxOutputFiles      = 32
+	maxOutputFileBytes  = 256 * 1024
+
+	fileEncodingUTF8   = "utf-8"
+	fileEncodingBase64 = "base64"
+
+	sysOpenat2         = 437
+	resolveNoSymlinks  = 0x04
+	resolveBeneathRoot = 0x08
+)
+
+// reservedRequestPaths are produced by the compile phase and must not be
+// replaced by seeded data.
+var reservedRequestPaths = []string{
+	"main", "main.cj", packageDirectoryName, cLibraryDirectoryName,
+	debugScriptName, debugStdinName, debugStdoutName, debugStderrName,
+}
+
+// compilerOutputSuffixes are the kinds of file the build steps leave in the
+// request directory.
+var compilerOutputSuffixes = []string{".a", ".cjo", ".gcda", ".gcno", ".macrocall", ".o", ".so"}
+
+// errSeedFileConflict reports a seeded file that the build already wrote,
+// which is a fault in the request, not in the runner.
+var errSeedFileConflict = errors.New("seeded file conflicts with a build output")
+
+type inputFile struct {
+	Path     string `json:"path"`
+	Content  string `json:"content"`
+	Encoding string `json:"encoding"`
+}
+
+type seedFile struct {
+	path string
+	data []byte
+}
+
+type outputFile struct {
+	Path      string `json:"path"`
+	Encoding  string `json:"encoding"`
+	Content   string `json:"content"`
+	Size      int64  `json:"size"`
+	Truncated bool   `json:"truncated"`
+}
+
+// validateRequestPath accepts clean, relative, slash-separated paths that stay
+// inside the request directory.
+func validateRequestPath(path string) error {
+	if path == "" || len(path) > maxRequestPathBytes {
+		return fmt.Errorf("path must contain 1-%d bytes", maxRequestPathBytes)
+	}
+	if filepath.IsAbs(path) || filepath.Clean(path) != path || path == "." ||
+		strings.IndexByte(path, 0) != -1 || strings.IndexByte(path, '\\') != -1 {
+		return fmt.Errorf("path %q must be clean and relative", path)
+	}
+	components := strings.Split(path, "/")
+	if len(components) > maxRequestPathDepth {
+		return fmt.Errorf("path %q is nested more than %d levels", path, maxRequestPathDepth)
+	}
+	if slices.Contains(components, "..") {
+		return fmt.Errorf("path %q escapes the request directory", path)
+	}
+	return nil
+}
+
+func parseInputFiles(files []inputFile) ([]seedFile, error) {
+	if len(files) > maxInputFiles {
+		return nil, fmt.Errorf("files must contain at most %d entries", maxInputFiles)
+	}
+	seeds := make([]seedFile, 0, len(files))
+	seen := make(map[string]bool, len(files))
+	for _, file := range files {
+		if err := validateRequestPath(file.Path); err != nil {
+			return nil, err
+		}
+		root, _, _ := strings.Cut(file.Path, "/")
+		if slices.Contains(reservedRequestPaths, root) {
+			return nil, fmt.Errorf("path %q is reserved by the runner", file.Path)
+		}
+		if slices.Contains(compilerOutputSuffixes, filepath.Ext(file.Path)) {
+			return nil, fmt.Errorf("path %q may collide with a build output", file.Path)
+		}
+		for existing := range seen {
+			if existing == file.Path ||
+				strings.HasPrefix(file.Path, existing+"/") ||
+				strings.HasPrefix(existing, file.Path+"/") {
+				return nil, fmt.Errorf("path %q conflicts with another file", file.Path)
+			}
+		}
+		seen[file.Path] = true
+
+		seed := seedFile{path: file.Path}
+		switch file.Encoding {
+		case "", fileEncodingUTF8:
+			seed.data = []byte(file.Content)
+		case fileEncodingBase64:
+			data, err := base64.StdEncoding.DecodeString(file.Content)
+			if err != nil {
+				return nil, fmt.Errorf("file %q is not valid base64", file.Path)
+			}
+			seed.data = data
+		default:
+			return nil, fmt.Errorf("file %q has unsupported encoding %q", file.Path, file.Encoding)
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds, nil
+}
+
+func parseOutputFilePatterns(patterns []string) error {
+	if len(patterns) > maxOutputPatterns {
+		return fmt.Errorf("output_files must contain at most %d patterns", maxOutputPatterns)
+	}
+	for _, pattern := range patterns {
+		if err := validateRequestPath(pattern); err != nil {
+			return err
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("output file pattern %q is malformed", pattern)
+		}
+	}
+	return nil
+}
+
+// seedRequestFiles writes request data files next to the compiled program,
+// owned by owner. It runs after compilation so seeded files can never become
+// compiler input, and a build that ran learner code leaves the directory
+// learner-controlled, so every step is confined beneath it and refuses
+// symlinks. A seed that meets a build output fails with errSeedFileConflict.
+func seedRequestFiles(requestDirectory string, seeds []seedFile, owner *syscall.Credential) error {
+	root, err := os.Open(requestDirectory)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	for _, seed := range seeds {
+		if err := createBeneath(root, seed.path, seed.data, owner); err != nil {
+			return seedError(seed, err)
+		}
+	}
+	return nil
+}
+
+// createBeneath writes a new file at relative below root, creating missing
+// parent directories. Each component is resolved with openBeneath, so a
+// learner-planted link fails instead of redirecting the write. New entries are
+// handed to owner when it is not nil.
+func createBeneath(root *os.File, relative string, data []byte, owner *syscall.Credential) error {
+	parent, err := openBeneath(root, ".")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = parent.Close() }()
+	components := strings.Split(relative, "/")
+	for _, component := range components[:len(components)-1] {
+		created := true
+		if err := syscall.Mkdirat(int(parent.Fd()), component, 0o700); errors.Is(err, syscall.EEXIST) {
+			created = false
+		} else if err != nil {
+			return &os.PathError{Op: "mkdirat", Path: relative, Err: err}
+		}
+		next, err := openBeneath(parent, component)
+		if err != nil {
+			return err
+		}
+		_ = parent.Close()
+		parent = next
+		if created {
+			if err := chownTo(parent, owner); err != nil {
+				return err
+			}
+		}
+	}
+	fd, err := syscall.Openat(
+		int(parent.Fd()),
+		components[len(components)-1],
+		syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW|syscall.O_CLOEXEC,
+		0o600,
+	)
+	if err != nil {
+		return &os.PathError{Op: "openat", Path: relative, Err: err}
+	}
+	file := os.NewFile(uintptr(fd), relative)
+	chownErr := chownTo(file, owner)
+	_, writeErr := file.Write(data)
+	return errors.Join(chownErr, writeErr, file.Close())
+}
+
+func chownTo(file *os.File, owner *syscall.Credential) error {
+	if owner == nil {
+		return nil
+	}
+	return file.Chown(int(owner.Uid), int(owner.Gid))
+}
+
+func seedError(seed seedFile, err error) error {
+	if errors.Is(err, os.ErrExist) || errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.ELOOP) {
+		return fmt.Errorf("%w: %s", errSeedFileConflict, seed.path)
+	}
+	return err
+}
+
+// collectOutputFiles reads files matching patterns after the learner exited.
+// The learner controls the directory, so every open is confined beneath it
+// and refuses symlinks; the runner's own file privileges never reach further.
+// Like cappedBuffer, limits drop data and set flags instead of failing. All
+// captured files together share totalBytes, the per-field response budget.
+func collectOutputFiles(requestDirectory string, patterns []string, totalBytes int) ([]outputFile, bool, error) {
+	var matches []string
+	for _, pattern := range patterns {
+		found, err := filepath.Glob(filepath.Join(requestDirectory, pattern))
+		if err != nil {
+			return nil, false, err
+		}
+		for _, match := range found {
+			relative, err := filepath.Rel(requestDirectory, match)
+			if err == nil && !slices.Contains(matches, relative) {
+				matches = append(matches, relative)
+			}
+		}
+	}
+	slices.Sort(matches)
+
+	root, err := os.Open(requestDirectory)
+	if err != nil {
+		return nil, false, err
+	}
+	defer root.Close()
+
+	files := make([]outputFile, 0, min(len(matches), maxOutputFiles))
+	truncated := false
+	remaining := totalBytes
+	for _, relative := range matches {
+		if len(files) == maxOutputFiles || remaining <= 0 {
+			truncated = true
+			break
+		}
+		file, err := openBeneath(root, relative)
+		if err != nil {
+			// Symlinks, vanished entries and other non-files are not output.
+			continue
+		}
+		captured, ok := captureOutputFile(file, relative, min(maxOutputFileBytes, remaining))
+		_ = file.Close()
+		if !ok {
+			continue
+		}
+		remaining -= len(captured.Content)
+		files = append(files, captured)
+	}
+	return files, truncated, nil
+}
+
+func captureOutputFile(file *os.File, relative string, limit int) (outputFile, bool) {
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return outputFile{}, false
+	}
+	data, err := io.ReadAll(io.LimitReader(file, int64(limit)+1))
+	if err != nil {
+		return outputFile{}, false
+	}
+	captured := outputFile{
+		Path:      relative,
+		Encoding:  fileEncodingUTF8,
+		Size:      info.Size(),
+		Truncated: len(data) > limit || info.Size() > int64(len(data)),
+	}
+	if len(data) > limit {
+		data = data[:limit]
+	}
+	text := data
+	if captured.Truncated {
+		// A cut may split the final rune; drop at most its leading bytes.
+		for cut := 0; cut < utf8.UTFMax && !utf8.Valid(text) && len(text) > 0; cut++ {
+			text = text[:len(text)-1]
+		}
+	}
+	if utf8.Valid(text) {
+		captured.Content = string(text)
+		return captured, true
+	}
+	raw := data[:min(len(data), base64.StdEncoding.DecodedLen(limit))]
+	captured.Encoding = fileEncodingBase64
+	captured.Content = base64.StdEncoding.EncodeToString(raw)
+	captured.Truncated = captured.Truncated || len(raw) < len(data)
+	return captured, true
+}
+
+type openHow struct {
+	flags   uint64
+	mode    uint64
+	resolve uint64
+}
+
+// openBeneath opens relative below root without following any symlink, so a
+// learner-planted link cannot redirect the runner outside the request.
+func openBeneath(root *os.File, relative string) (*os.File, error) {
+	path, err := syscall.BytePtrFromString(relative)
+	if err != nil {
+		return nil, err
+	}
+	how := openHow{
+		flags:   uint64(syscall.O_RDONLY | syscall.O_NOFOLLOW | syscall.O_NONBLOCK | syscall.O_CLOEXEC),
+		resolve: resolveBeneathRoot | resolveNoSymlinks,
+	}
+	fd, _, errno := syscall.Syscall6(
+		sysOpenat2,
+		root.Fd(),
+		uintptr(unsafe.Pointer(path)),
+		uintptr(unsafe.Pointer(&how)),
+		unsafe.Sizeof(how),
+		0,
+		0,
+	)
+	if errno != 0 {
+		return nil, &os.PathError{Op: "openat2", Path: relative, Err: errno}
+	}
+	return os.NewFile(fd, relative), nil
+}
@@ -0,0 +1,256 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRequestPathsStayInsideTheRequestDirectory(t *testing.T) {
+	for _, path := range []string{"data.txt", "input/grades.csv", "a/b/c.bin", ".hidden"} {
+		if err := validateRequestPath(path); err != nil {
+			t.Fatalf("valid path %q rejected: %v", path, err)
+		}
+	}
+	for _, path := range []string{
+		"",
+		".",
+		"/etc/passwd",
+		"../run-other/main.cj",
+		"data/../../escape",
+		"data//file",
+		"data/",
+		"./data",
+		"a\\b",
+		"nul\x00byte",
+		strings.Repeat("a/", maxRequestPathDepth) + "deep",
+		strings.Repeat("x", maxRequestPathBytes+1),
+	} {
+		if err := validateRequestPath(path); err == nil {
+			t.Fatalf("path %q passed validation", path)
+		}
+	}
+}
+
+func TestInputFilesAreDecodedAndCannotShadowBuildProducts(t *testing.T) {
+	seeds, err := parseInputFiles([]inputFile{
+		{Path: "notes.txt", Content: "仓颉\n"},
+		{Path: "data/blob.bin", Content: base64.StdEncoding.EncodeToString([]byte{0, 0xff}), Encoding: "base64"},
+	})
+	if err != nil {
+		t.Fatalf("parse valid input files: %v", err)
+	}
+	if string(seeds[0].data) != "仓颉\n" || string(seeds[1].data) != "\x00\xff" {
+		t.Fatalf("decoded seeds = %q", seeds)
+	}
+
+	for name, files := range map[string][]inputFile{
+		"compiled binary":   {{Path: "main"}},
+		"source file":       {{Path: "main.cj"}},
+		"below the binary":  {{Path: "main/inner"}},
+		"package interface": {{Path: "lib.cjo"}},
+		"coverage notes":    {{Path: "obj/main.gcno"}},
+		"duplicate":         {{Path: "a.txt"}, {Path: "a.txt"}},
+		"file and parent":   {{Path: "a"}, {Path: "a/b.txt"}},
+		"bad base64":        {{Path: "a.bin", Content: "***", Encoding: "base64"}},
+		"unknown encoding":  {{Path: "a.txt", Encoding: "latin-1"}},
+		"too many":          make([]inputFile, maxInputFiles+1),
+	} {
+		if _, err := parseInputFiles(files); err == nil {
+			t.Fatalf("%s passed input file validation", name)
+		}
+	}
+}
+
+func TestSeedAndCollectRequestFiles(t *testing.T) {
+	outside := t.TempDir()
+	secret := filepath.Join(outside, "secret.txt")
+	if err := os.WriteFile(secret, []byte("sibling secret"), 0o600); err != nil {
+		t.Fatalf("write outside secret: %v", err)
+	}
+	requestDirectory := t.TempDir()
+	if err := seedRequestFiles(requestDirectory, []seedFile{
+		{path: "input/data.txt", data: []byte("seeded")},
+	}, nil); err != nil {
+		t.Fatalf("seed request files: %v", err)
+	}
+	if err := seedRequestFiles(requestDirectory, []seedFile{{path: "input/data.txt"}}, nil); !errors.Is(err, errSeedFileConflict) {
+		t.Fatalf("seeding over an existing file: %v", err)
+	}
+	if err := seedRequestFiles(requestDirectory, []seedFile{{path: "input/data.txt/below"}}, nil); !errors.Is(err, errSeedFileConflict) {
+		t.Fatalf("seeding below an existing file: %v", err)
+	}
+
+	write := func(name string, data []byte) {
+		t.Helper()
+		path := filepath.Join(requestDirectory, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatalf("create %s parent: %v", name, err)
+		}
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	write("out/result.txt", []byte("答案 42\n"))
+	write("out/image.bin", []byte{0x89, 'P', 'N', 'G', 0xff, 0xfe})
+	write("out/large.txt", []byte(strings.Repeat("界", maxOutputFileBytes/3+1)))
+	if err := os.Symlink(secret, filepath.Join(requestDirectory, "out", "leak.txt")); err != nil {
+		t.Fatalf("plant file symlink: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(requestDirectory, "linked")); err != nil {
+		t.Fatalf("plant directory symlink: %v", err)
+	}
+	if err := seedRequestFiles(requestDirectory, []seedFile{{path: "linked/planted.txt"}}, nil); !errors.Is(err, errSeedFileConflict) {
+		t.Fatalf("seeding through a learner symlink: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "planted.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("seed escaped the request directory: %v", err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(requestDirectory, "out", "pipe.txt"), 0o600); err != nil {
+		t.Fatalf("plant fifo: %v", err)
+	}
+
+	files, truncated, err := collectOutputFiles(
+		requestDirectory, []string{"out/*", "linked/*", "input/data.txt"}, maxSerializedOutputBytes,
+	)
+	if err != nil {
+		t.Fatalf("collect output files: %v", err)
+	}
+	if truncated {
+		t.Fatal("small output set reported total truncation")
+	}
+	byPath := map[string]outputFile{}
+	for _, file := range files {
+		byPath[file.Path] = file
+		if strings.Contains(file.Content, "sibling secret") {
+			t.Fatalf("collection followed a learner symlink: %+v", file)
+		}
+	}
+	for _, absent := range []string{"out/leak.txt", "linked/secret.txt", "out/pipe.txt"} {
+		if _, ok := byPath[absent]; ok {
+			t.Fatalf("collected non-regular or out-of-tree entry %s", absent)
+		}
+	}
+	if got := byPath["out/result.txt"]; got.Encoding != fileEncodingUTF8 || got.Content != "答案 42\n" || got.Truncated {
+		t.Fatalf("text output = %+v", got)
+	}
+	if got := byPath["input/data.txt"]; got.Content != "seeded" {
+		t.Fatalf("seeded file output = %+v", got)
+	}
+	image := byPath["out/image.bin"]
+	decoded, err := base64.StdEncoding.DecodeString(image.Content)
+	if image.Encoding != fileEncodingBase64 || err != nil || len(decoded) != 6 {
+		t.Fatalf("binary output = %+v (%v)", image, err)
+	}
+	large := byPath["out/large.txt"]
+	if !large.Truncated || len(large.Content) > maxOutputFileBytes ||
+		!utf8.ValidString(large.Content) || large.Encoding != fileEncodingUTF8 ||
+		large.Size != int64(len(strings.Repeat("界", maxOutputFileBytes/3+1))) {
+		t.Fatalf("large output truncated=%t bytes=%d size=%d encoding=%s",
+			large.Truncated, len(large.Content), large.Size, large.Encoding)
+	}
+}
+
+func TestSeedFileConflictIsARequestError(t *testing.T) {
+	operations := testOperations()
+	operations.compileAndRun = func(context.Context, runReq) (runMessage, error) {
+		return runMessage{Phase: runPhaseRun}, fmt.Errorf("%w: out.bin", errSeedFileConflict)
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost, "/run", "application/json", `{"code":"main() {}","files":[{"path":"out.bin","content":""}]}`,
+	))
+	if recorder.Code != http.StatusBadRequest || responseError(t, recorder)["code"] != "invalid_json_body" {
+		t.Fatalf("status = %d body = %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestCollectOutputFilesEnforcesCountAndTotalBudgets(t *testing.T) {
+	requestDirectory := t.TempDir()
+	for index := range maxOutputFiles + 1 {
+		name := filepath.Join(requestDirectory, fmt.Sprintf("out-%02d.txt", index))
+		if err := os.WriteFile(name, []byte("x"), 0o600); err != nil {
+			t.Fatalf("write output: %v", err)
+		}
+	}
+	files, truncated, err := collectOutputFiles(requestDirectory, []string{"*.txt"}, maxSerializedOutputBytes)
+	if err != nil {
+		t.Fatalf("collect output files: %v", err)
+	}
+	if len(files) != maxOutputFiles || !truncated {
+		t.Fatalf("collected %d files truncated=%t, want %d and true", len(files), truncated, maxOutputFiles)
+	}
+
+	// An operator's lower max_output_bytes bounds the files together.
+	const totalBytes = 2*maxOutputFileBytes + 1024
+	requestDirectory = t.TempDir()
+	large := []byte(strings.Repeat("y", maxOutputFileBytes))
+	for index := range totalBytes/maxOutputFileBytes + 2 {
+		name := filepath.Join(requestDirectory, fmt.Sprintf("big-%02d.txt", index))
+		if err := os.WriteFile(name, large, 0o600); err != nil {
+			t.Fatalf("write output: %v", err)
+		}
+	}
+	files, truncated, err = collectOutputFiles(requestDirectory, []string{"*.txt"}, totalBytes)
+	if err != nil {
+		t.Fatalf("collect output files: %v", err)
+	}
+	total := 0
+	for _, file := range files {
+		total += len(file.Content)
+	}
+	if total > totalBytes || !truncated {
+		t.Fatalf("captured %d bytes truncated=%t, want at most %d and true", total, truncated, totalBytes)
+	}
+}
+
+func TestRunRequestFilesAndOutputPatterns(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseCompile, CompilerCode: 1}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost,
+		"/run",
+		"application/json",
+		`{"code":"main() {}","files":[{"path":"in.txt","content":"hi"}],"output_files":["*.txt"]}`,
+	))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d; body=%s", recorder.Code, recorder.Body.String())
+	}
+	if len(received.Files) != 1 || received.Files[0].path != "in.txt" ||
+		len(received.OutputFiles) != 1 || received.OutputFiles[0] != "*.txt" {
+		t.Fatalf("operation received files=%+v output=%q", received.Files, received.OutputFiles)
+	}
+
+	for _, body := range []string{
+		`{"code":"main() {}","files":[{"path":"../x","content":""}]}`,
+		`{"code":"main() {}","files":[{"path":"x","content":"","mode":"0777"}]}`,
+		`{"code":"main() {}","output_files":["/etc/*"]}`,
+		`{"code":"main() {}","output_files":["[unterminated"]}`,
+		`{"code":"main() {}","files":[{"path":"main.o","content":""}]}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(
+			recorder,
+			runnerRequest(http.MethodPost, "/run", "application/json", body),
+		)
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
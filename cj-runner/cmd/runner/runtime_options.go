@@ -0,0 +1,121 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type runtimeOptionKind int
+
+const (
+	runtimeOptionSize runtimeOptionKind = iota
+	runtimeOptionCount
+	runtimeOptionDuration
+)
+
+// runtimeOptionLimit bounds one Cangjie runtime environment variable. Sizes
+// are in bytes and durations in milliseconds. Maxima follow the Modal
+// container (one CPU, 4 GiB) rather than the runtime's own wider ranges.
+type runtimeOptionLimit struct {
+	kind    runtimeOptionKind
+	minimum int64
+	maximum int64
+}
+
+const (
+	kib = int64(1024)
+	mib = 1024 * kib
+	gib = 1024 * mib
+)
+
+var runtimeOptionLimits = map[string]runtimeOptionLimit{
+	"cjHeapSize":         {kind: runtimeOptionSize, minimum: 4 * mib, maximum: 2 * gib},
+	"cjStackSize":        {kind: runtimeOptionSize, minimum: 64 * kib, maximum: 64 * mib},
+	"cjProcessorNum":     {kind: runtimeOptionCount, minimum: 1, maximum: 4},
+	"cjGCThreads":        {kind: runtimeOptionCount, minimum: 1, maximum: 4},
+	"cjGCThreshold":      {kind: runtimeOptionSize, minimum: 4 * kib, maximum: 2 * gib},
+	"cjGCInterval":       {kind: runtimeOptionDuration, minimum: 0, maximum: 60_000},
+	"cjBackupGCInterval": {kind: runtimeOptionDuration, minimum: 1, maximum: 60_000},
+}
+
+type runtimeOptionUnit struct {
+	suffix string
+	scale  int64
+}
+
+// Units are matched in order, so "ms" must precede "s".
+var (
+	runtimeSizeUnits     = []runtimeOptionUnit{{"GB", gib}, {"MB", mib}, {"KB", kib}}
+	runtimeDurationUnits = []runtimeOptionUnit{{"ms", 1}, {"s", 1_000}}
+)
+
+// parseRuntimeOptions validates requested runtime options and returns them in
+// the canonical spelling the runtime reads and the response reports.
+func parseRuntimeOptions(options map[string]string) (map[string]string, error) {
+	normalized := make(map[string]string, len(options))
+	for name, value := range options {
+		limit, ok := runtimeOptionLimits[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported runtime option %q", name)
+		}
+		canonical, err := normalizeRuntimeOption(limit, strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("runtime option %s: %w", name, err)
+		}
+		normalized[name] = canonical
+	}
+	return normalized, nil
+}
+
+func normalizeRuntimeOption(limit runtimeOptionLimit, value string) (string, error) {
+	unit := runtimeOptionUnit{scale: 1}
+	number := value
+	switch limit.kind {
+	case runtimeOptionSize:
+		// The runtime accepts sizes in any letter case; report them upper-case.
+		unit, number = splitRuntimeOptionUnit(strings.ToUpper(value), runtimeSizeUnits)
+	case runtimeOptionDuration:
+		unit, number = splitRuntimeOptionUnit(value, runtimeDurationUnits)
+	}
+	if unit.scale == 0 {
+		return "", errors.New("value has a missing or unknown unit")
+	}
+	if number == "" || strings.IndexFunc(number, func(r rune) bool { return r < '0' || r > '9' }) != -1 {
+		return "", errors.New("value must be a non-negative decimal integer")
+	}
+	amount, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || amount > limit.maximum/unit.scale ||
+		amount*unit.scale < limit.minimum || amount*unit.scale > limit.maximum {
+		return "", errors.New("value is outside the server limits")
+	}
+	return strconv.FormatInt(amount, 10) + unit.suffix, nil
+}
+
+func splitRuntimeOptionUnit(value string, units []runtimeOptionUnit) (runtimeOptionUnit, string) {
+	for _, unit := range units {
+		if number, found := strings.CutSuffix(value, unit.suffix); found {
+			return unit, number
+		}
+	}
+	return runtimeOptionUnit{}, ""
+}
+
+// runtimeOptionEnvironment renders validated options as environment entries in
+// a stable order.
+func runtimeOptionEnvironment(options map[string]string) []string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	environment := make([]string, 0, len(names))
+	for _, name := range names {
+		environment = append(environment, name+"="+options[name])
+	}
+	return environment
+}
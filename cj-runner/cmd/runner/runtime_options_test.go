@@ -0,0 +1,105 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestRuntimeOptionsAreNormalizedWithinServerLimits(t *testing.T) {
+	got, err := parseRuntimeOptions(map[string]string{
+		"cjHeapSize":     "256mb",
+		"cjStackSize":    " 1MB ",
+		"cjProcessorNum": "2",
+		"cjGCInterval":   "150ms",
+		"cjGCThreshold":  "20MB",
+	})
+	if err != nil {
+		t.Fatalf("parse valid runtime options: %v", err)
+	}
+	want := map[string]string{
+		"cjHeapSize":     "256MB",
+		"cjStackSize":    "1MB",
+		"cjProcessorNum": "2",
+		"cjGCInterval":   "150ms",
+		"cjGCThreshold":  "20MB",
+	}
+	for name, value := range want {
+		if got[name] != value {
+			t.Fatalf("%s = %q, want %q", name, got[name], value)
+		}
+	}
+	if environment := runtimeOptionEnvironment(got); !slices.IsSorted(environment) ||
+		!slices.Contains(environment, "cjHeapSize=256MB") {
+		t.Fatalf("runtime option environment = %q", environment)
+	}
+
+	for name, value := range map[string]string{
+		"cjHeapSize":           "3GB",
+		"cjStackSize":          "1KB",
+		"cjProcessorNum":       "64",
+		"cjGCThreads":          "0",
+		"cjGCInterval":         "2m",
+		"cjBackupGCInterval":   "99999999999999999999s",
+		"cjGCThreshold":        "-1MB",
+		"LD_PRELOAD":           "/tmp/x.so",
+		"cjHeapSize\x00":       "1GB",
+		"cjProcessorNum ":      "1",
+		"cjHeapSizeWithSuffix": "1GB",
+	} {
+		if _, err := parseRuntimeOptions(map[string]string{name: value}); err == nil {
+			t.Fatalf("runtime option %q=%q passed validation", name, value)
+		}
+	}
+}
+
+func TestRunRequestRuntimeOptions(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		binCode := 0
+		return runMessage{Phase: runPhaseRun, BinCode: &binCode, RuntimeOptions: in.RuntimeOptions}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost,
+		"/run",
+		"application/json",
+		`{"code":"main() {}","runtime_options":{"cjStackSize":"2mb"}}`,
+	))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d; body=%s", recorder.Code, recorder.Body.String())
+	}
+	if received.RuntimeOptions["cjStackSize"] != "2MB" {
+		t.Fatalf("operation received runtime options %q", received.RuntimeOptions)
+	}
+	var payload struct {
+		RuntimeOptions map[string]string `json:"runtime_options"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &payload); err != nil ||
+		payload.RuntimeOptions["cjStackSize"] != "2MB" {
+		t.Fatalf("response runtime options = %q, %v", payload.RuntimeOptions, err)
+	}
+
+	for _, body := range []string{
+		`{"code":"main() {}","runtime_options":null}`,
+		`{"code":"main() {}","runtime_options":{"cjProcessorNum":2}}`,
+		`{"code":"main() {}","runtime_options":{"cjHeapSize":"1TB"}}`,
+		`{"code":"main() {}","deterministic":true,"runtime_options":{"cjProcessorNum":"2"}}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(
+			recorder,
+			runnerRequest(http.MethodPost, "/run", "application/json", body),
+		)
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
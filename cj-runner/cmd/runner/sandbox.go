@@ -0,0 +1,247 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The run phase does not exec the learner binary directly. Go cannot run code
+// between fork and exec, so the runner re-executes itself as a tiny launcher
+// that restricts its own thread and then execs the learner binary in place.
+// Restrictions installed this way survive execve and cannot be lifted.
+const (
+	sandboxLauncherArgument = "__learner-sandbox"
+	sandboxSeccompFlag      = "--seccomp"
+	sandboxNoASLRFlag       = "--no-aslr"
+	// The launcher reports setup failures on this inherited close-on-exec pipe.
+	// A successful exec closes it without writing, so any byte read by the
+	// runner means the learner program never started.
+	sandboxStatusFD         = 3
+	sandboxLauncherExitCode = 127
+	maxSandboxStatusBytes   = 4 * 1024
+
+	prSetNoNewPrivs        = 38
+	personalityQuery       = 0xffffffff
+	addrNoRandomize        = 0x0040000
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+	seccompRetKillProcess  = 0x80000000
+	seccompRetAllow        = 0x7fff0000
+
+	// Every run gets its own unprivileged identity from this range so one
+	// request cannot read another's directory even when both share a host.
+	// The IDs have no passwd entry and own nothing outside their request.
+	learnerIDBase  = 200_000
+	learnerIDCount = 50_000
+
+	learnerSandboxProbePath    = "/usr/bin/id"
+	learnerSandboxProbeTimeout = 5 * time.Second
+)
+
+type learnerSandbox struct {
+	seccomp     bool
+	disableASLR bool
+	// credential is applied when the launcher is forked. Nil keeps the
+	// runner's identity, which only tests rely on.
+	credential *syscall.Credential
+}
+
+var learnerIdentityCounter atomic.Uint32
+
+// nextLearnerCredential returns a fresh identity without supplementary groups.
+func nextLearnerCredential() *syscall.Credential {
+	id := learnerIDBase + learnerIdentityCounter.Add(1)%learnerIDCount
+	return &syscall.Credential{Uid: id, Gid: id, Groups: []uint32{}}
+}
+
+// grantLearnerDirectory hands the request directory tree to the learner
+// identity. It is the only path the learner can write; the toolchain stays
+// root-owned and sibling request directories stay mode 0700 under other
+// identities. Nothing learner-controlled exists yet, so the walk is race-free.
+func grantLearnerDirectory(requestDirectory string, credential *syscall.Credential) error {
+	// The mode is set while the runner still owns the directory: the image
+	// grants no CAP_FOWNER, so it cannot chmod the learner's files.
+	if err := os.Chmod(requestDirectory, 0o700); err != nil {
+		return err
+	}
+	return filepath.WalkDir(requestDirectory, func(path string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, int(credential.Uid), int(credential.Gid))
+	})
+}
+
+// grantLearnerBuild hands the request directory to the learner once the build
+// is done. A build that ran learner code already granted it before that code
+// started, and walking the tree again could follow links the learner swaps in.
+func grantLearnerBuild(requestDirectory string, in runReq, credential *syscall.Credential) error {
+	if buildRunsLearnerCode(in) {
+		return nil
+	}
+	if err := grantLearnerDirectory(requestDirectory, credential); err != nil {
+		return infrastructureError("grant learner request directory", err)
+	}
+	return nil
+}
+
+// buildToolSandbox confines the trusted tools that read build products after
+// a build that ran learner code, since the learner may have replaced those
+// products with links to files only the runner can read.
+func buildToolSandbox(in runReq, credential *syscall.Credential) *learnerSandbox {
+	if !buildRunsLearnerCode(in) {
+		return nil
+	}
+	return &learnerSandbox{credential: credential}
+}
+
+// verifyLearnerSandbox fails startup when the runner cannot actually drop to a
+// learner identity, instead of silently running learner code as itself.
+func verifyLearnerSandbox(ctx context.Context) error {
+	credential := nextLearnerCredential()
+	result, err := runProcess(ctx, processSpec{
+		executable:              learnerSandboxProbePath,
+		arguments:               []string{"-u"},
+		environment:             runtimeEnvironment("/"),
+		workingDirectory:        "/",
+		timeout:                 learnerSandboxProbeTimeout,
+		timeoutIsInfrastructure: true,
+		sandbox:                 &learnerSandbox{credential: credential},
+	}, "probe learner sandbox")
+	if err != nil {
+		return err
+	}
+	if result.exitCode != 0 {
+		return fmt.Errorf("learner sandbox probe exited with %d: %s", result.exitCode, result.stderr.content)
+	}
+	if strings.TrimSpace(result.stdout.content) != strconv.FormatUint(uint64(credential.Uid), 10) {
+		return errors.New("learner sandbox probe did not run under the learner identity")
+	}
+	return nil
+}
+
+// sandboxLauncherExecutable resolves the runner binary used as the launcher.
+// Tests replace it when the test binary is not reachable by the learner.
+var sandboxLauncherExecutable = os.Executable
+
+func (s learnerSandbox) launcherArguments(executable string, arguments []string) []string {
+	launcherArguments := []string{sandboxLauncherArgument}
+	if s.seccomp {
+		launcherArguments = append(launcherArguments, sandboxSeccompFlag)
+	}
+	if s.disableASLR {
+		launcherArguments = append(launcherArguments, sandboxNoASLRFlag)
+	}
+	launcherArguments = append(launcherArguments, "--", executable)
+	return append(launcherArguments, arguments...)
+}
+
+// runSandboxLauncher is the entry point of the re-executed runner. It never
+// returns on success because the learner binary replaces the process image.
+func runSandboxLauncher(arguments []string) int {
+	status := os.NewFile(sandboxStatusFD, "sandbox-status")
+	fail := func(err error) int {
+		if status != nil {
+			_, _ = io.WriteString(status, err.Error())
+		}
+		return sandboxLauncherExitCode
+	}
+	syscall.CloseOnExec(sandboxStatusFD)
+
+	seccomp, disableASLR := false, false
+	for len(arguments) > 0 && arguments[0] != "--" {
+		switch arguments[0] {
+		case sandboxSeccompFlag:
+			seccomp = true
+		case sandboxNoASLRFlag:
+			disableASLR = true
+		default:
+			return fail(fmt.Errorf("unknown sandbox option %q", arguments[0]))
+		}
+		arguments = arguments[1:]
+	}
+	if len(arguments) < 2 {
+		return fail(errors.New("sandbox launcher requires an executable"))
+	}
+	executable := arguments[1]
+
+	runtime.LockOSThread()
+	if _, _, errno := syscall.RawSyscall6(
+		syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0,
+	); errno != 0 {
+		return fail(fmt.Errorf("set no_new_privs: %w", errno))
+	}
+	if disableASLR {
+		// The persona survives execve, giving the learner binary stable
+		// addresses and therefore stable address-derived hash orders.
+		persona, _, errno := syscall.RawSyscall(syscall.SYS_PERSONALITY, personalityQuery, 0, 0)
+		if errno == 0 {
+			_, _, errno = syscall.RawSyscall(syscall.SYS_PERSONALITY, persona|addrNoRandomize, 0, 0)
+		}
+		if errno != 0 {
+			return fail(fmt.Errorf("disable address space randomization: %w", errno))
+		}
+	}
+	if seccomp {
+		if err := installSeccompFilter(learnerSeccompFilter()); err != nil {
+			return fail(err)
+		}
+	}
+	err := syscall.Exec(executable, arguments[1:], os.Environ())
+	return fail(fmt.Errorf("exec learner program: %w", err))
+}
+
+func installSeccompFilter(filter []syscall.SockFilter) error {
+	if len(filter) == 0 {
+		return errors.New("seccomp filtering is not supported on " + runtime.GOARCH)
+	}
+	program := syscall.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	if _, _, errno := syscall.RawSyscall(
+		sysSeccomp,
+		seccompSetModeFilter,
+		seccompFilterFlagTSync,
+		uintptr(unsafe.Pointer(&program)),
+	); errno != 0 {
+		return fmt.Errorf("install seccomp filter: %w", errno)
+	}
+	return nil
+}
+
+func readSandboxStatus(reader *os.File) error {
+	message, err := io.ReadAll(io.LimitReader(reader, maxSandboxStatusBytes))
+	if err != nil {
+		return fmt.Errorf("read sandbox launcher status: %w", err)
+	}
+	if len(message) != 0 {
+		return errors.New("sandbox launcher: " + string(message))
+	}
+	return nil
+}
+
+func sandboxTerminationReason(sandbox *learnerSandbox, state *os.ProcessState) terminationReason {
+	if sandbox == nil || !sandbox.seccomp || state == nil {
+		return ""
+	}
+	status, ok := state.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() && status.Signal() == syscall.SIGSYS {
+		return terminationBlockedSyscall
+	}
+	return ""
+}
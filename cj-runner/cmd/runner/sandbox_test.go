@@ -0,0 +1,473 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func runTestProbe(name string) int {
+	switch name {
+	case "keyctl":
+		const keyctlGetKeyringID = 0
+		_, _, errno := syscall.RawSyscall(syscall.SYS_KEYCTL, keyctlGetKeyringID, 0, 0)
+		fmt.Printf("keyctl returned %d\n", errno)
+	case "raw-socket":
+		_, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_ICMP)
+		fmt.Printf("raw socket returned %v\n", err)
+	case "stream-socket":
+		fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "stream socket: %v\n", err)
+			return 1
+		}
+		_ = syscall.Close(fd)
+		fmt.Println("stream socket ok")
+	case "personality":
+		persona, err := os.ReadFile("/proc/self/personality")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read personality: %v\n", err)
+			return 1
+		}
+		fmt.Print(string(persona))
+		fmt.Println(os.Getenv("TZ"))
+	case "c-library-build":
+		return runCLibraryBuildProbe()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown probe %q\n", name)
+		return 2
+	}
+	return 0
+}
+
+func testProbeSpec(t *testing.T, probe string, sandbox *learnerSandbox) processSpec {
+	t.Helper()
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatalf("resolve test executable: %v", err)
+	}
+	requestDirectory := t.TempDir()
+	return processSpec{
+		executable:       executable,
+		environment:      append(runtimeEnvironment(requestDirectory), testProbeEnvironment+"="+probe),
+		workingDirectory: requestDirectory,
+		timeout:          5 * time.Second,
+		sandbox:          sandbox,
+	}
+}
+
+func TestSeccompSandboxKillsDeniedSyscallsWithLearnerVisibleReason(t *testing.T) {
+	for _, probe := range []string{"keyctl", "raw-socket"} {
+		t.Run(probe, func(t *testing.T) {
+			result, err := runProcess(
+				context.Background(),
+				testProbeSpec(t, probe, &learnerSandbox{seccomp: true}),
+				"run learner binary",
+			)
+			if err != nil {
+				t.Fatalf("run sandboxed probe: %v", err)
+			}
+			if result.terminationReason != terminationBlockedSyscall {
+				t.Fatalf("termination reason = %q, want %q; stdout=%q stderr=%q",
+					result.terminationReason, terminationBlockedSyscall,
+					result.stdout.content, result.stderr.content)
+			}
+			if result.exitCode != -1 {
+				t.Fatalf("exit code = %d, want -1 for a signalled process", result.exitCode)
+			}
+			if strings.Contains(result.stdout.content, "returned") {
+				t.Fatalf("denied syscall returned to the learner: %q", result.stdout.content)
+			}
+			if !strings.HasSuffix(result.stderr.content, "[killed: blocked system call]") {
+				t.Fatalf("stderr = %q, want blocked syscall note", result.stderr.content)
+			}
+		})
+	}
+}
+
+func TestSeccompSandboxAllowsOrdinarySyscalls(t *testing.T) {
+	result, err := runProcess(
+		context.Background(),
+		testProbeSpec(t, "stream-socket", &learnerSandbox{seccomp: true}),
+		"run learner binary",
+	)
+	if err != nil {
+		t.Fatalf("run sandboxed probe: %v", err)
+	}
+	if result.exitCode != 0 || result.terminationReason != "" {
+		t.Fatalf("exit=%d reason=%q stderr=%q", result.exitCode, result.terminationReason, result.stderr.content)
+	}
+	if result.stdout.content != "stream socket ok\n" {
+		t.Fatalf("stdout = %q", result.stdout.content)
+	}
+}
+
+func TestUnsandboxedProcessesAreNotFiltered(t *testing.T) {
+	result, err := runProcess(
+		context.Background(),
+		testProbeSpec(t, "keyctl", nil),
+		"compile",
+	)
+	if err != nil {
+		t.Fatalf("run unsandboxed probe: %v", err)
+	}
+	if result.exitCode != 0 || result.terminationReason != "" {
+		t.Fatalf("exit=%d reason=%q stderr=%q", result.exitCode, result.terminationReason, result.stderr.content)
+	}
+	if !strings.HasPrefix(result.stdout.content, "keyctl returned") {
+		t.Fatalf("stdout = %q", result.stdout.content)
+	}
+}
+
+func TestSandboxLauncherFailureIsInfrastructureError(t *testing.T) {
+	requestDirectory := t.TempDir()
+	executable := filepath.Join(requestDirectory, "main")
+	if err := os.WriteFile(executable, []byte("#!/nonexistent/interpreter\n"), 0o700); err != nil {
+		t.Fatalf("write unusable learner program: %v", err)
+	}
+	_, err := runProcess(context.Background(), processSpec{
+		executable:       executable,
+		environment:      runtimeEnvironment(requestDirectory),
+		workingDirectory: requestDirectory,
+		timeout:          5 * time.Second,
+		sandbox:          &learnerSandbox{seccomp: true},
+	}, "run learner binary")
+	if err == nil {
+		t.Fatal("launcher exec failure was reported as a learner exit")
+	}
+	if !strings.Contains(err.Error(), "exec learner program") {
+		t.Fatalf("launcher error = %v", err)
+	}
+}
+
+func TestRunRequestSeccompOptIn(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		binCode := -1
+		return runMessage{
+			Phase:             runPhaseRun,
+			BinCode:           &binCode,
+			TerminationReason: terminationBlockedSyscall,
+		}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost,
+		"/run",
+		"application/json",
+		`{"code":"main() {}","seccomp":true}`,
+	))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d; body=%s", recorder.Code, recorder.Body.String())
+	}
+	if !received.Seccomp {
+		t.Fatal("seccomp opt-in did not reach the operation")
+	}
+	if !strings.Contains(recorder.Body.String(), `"termination_reason":"blocked_syscall"`) {
+		t.Fatalf("response omits termination reason: %s", recorder.Body.String())
+	}
+
+	for _, body := range []string{
+		`{"code":"main() {}","seccomp":null}`,
+		`{"code":"main() {}","seccomp":"yes"}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(
+			recorder,
+			runnerRequest(http.MethodPost, "/run", "application/json", body),
+		)
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// useLearnerReachableLauncher copies the test binary somewhere a learner
+// identity can execute it; the Go build cache is private to the test user.
+func useLearnerReachableLauncher(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("dropping to a learner identity requires root or CAP_SETUID")
+	}
+	source, err := os.Executable()
+	if err != nil {
+		t.Fatalf("resolve test executable: %v", err)
+	}
+	binary, err := os.ReadFile(source)
+	if err != nil {
+		t.Fatalf("read test executable: %v", err)
+	}
+	directory := learnerReachableTempDir(t)
+	launcher := filepath.Join(directory, "cj-runner")
+	if err := os.WriteFile(launcher, binary, 0o755); err != nil {
+		t.Fatalf("write launcher copy: %v", err)
+	}
+	previous := sandboxLauncherExecutable
+	sandboxLauncherExecutable = func() (string, error) { return launcher, nil }
+	t.Cleanup(func() { sandboxLauncherExecutable = previous })
+}
+
+func learnerReachableTempDir(t *testing.T) string {
+	t.Helper()
+	directory := t.TempDir()
+	for _, path := range []string{filepath.Dir(directory), directory} {
+		if err := os.Chmod(path, 0o711); err != nil {
+			t.Fatalf("open %s for traversal: %v", path, err)
+		}
+	}
+	return directory
+}
+
+func TestLearnerCredentialsAreUnprivilegedAndPerRequest(t *testing.T) {
+	first := nextLearnerCredential()
+	second := nextLearnerCredential()
+	for _, credential := range []*syscall.Credential{first, second} {
+		if credential.Uid < learnerIDBase || credential.Uid >= learnerIDBase+learnerIDCount ||
+			credential.Gid != credential.Uid {
+			t.Fatalf("learner credential outside the dedicated range: %+v", credential)
+		}
+		if credential.Groups == nil || len(credential.Groups) != 0 || credential.NoSetGroups {
+			t.Fatalf("learner credential keeps supplementary groups: %+v", credential)
+		}
+	}
+	if first.Uid == second.Uid {
+		t.Fatalf("consecutive requests share learner identity %d", first.Uid)
+	}
+
+	spec := testProbeSpec(t, "stream-socket", &learnerSandbox{credential: first})
+	command, err := processCommand(context.Background(), spec)
+	if err != nil {
+		t.Fatalf("build sandboxed command: %v", err)
+	}
+	if command.SysProcAttr.Credential != first || !command.SysProcAttr.Setpgid {
+		t.Fatalf("sandboxed command attributes = %+v", command.SysProcAttr)
+	}
+	if command.Args[1] != sandboxLauncherArgument {
+		t.Fatalf("learner binary bypassed the no_new_privs launcher: %q", command.Args)
+	}
+}
+
+func TestLearnerCannotModifyToolchainOrReadSiblingRequests(t *testing.T) {
+	useLearnerReachableLauncher(t)
+	root := learnerReachableTempDir(t)
+
+	toolchain := filepath.Join(root, "cangjie")
+	if err := os.MkdirAll(filepath.Join(toolchain, "bin"), 0o755); err != nil {
+		t.Fatalf("create toolchain stand-in: %v", err)
+	}
+	compiler := filepath.Join(toolchain, "bin", "cjc")
+	if err := os.WriteFile(compiler, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatalf("write compiler stand-in: %v", err)
+	}
+
+	requestRoot := filepath.Join(root, "playground")
+	if err := os.Mkdir(requestRoot, 0o711); err != nil {
+		t.Fatalf("create request root: %v", err)
+	}
+	sibling, err := os.MkdirTemp(requestRoot, "run-")
+	if err != nil {
+		t.Fatalf("create sibling request: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(sibling, "main.cj"), []byte("secret"), 0o600); err != nil {
+		t.Fatalf("write sibling source: %v", err)
+	}
+	if err := grantLearnerDirectory(sibling, nextLearnerCredential()); err != nil {
+		t.Fatalf("grant sibling request: %v", err)
+	}
+
+	requestDirectory, err := os.MkdirTemp(requestRoot, "run-")
+	if err != nil {
+		t.Fatalf("create request directory: %v", err)
+	}
+	probe := filepath.Join(requestDirectory, "main")
+	if err := os.WriteFile(probe, []byte(`#!/bin/sh
+status=0
+if echo tampered >> "$PROBE_TOOLCHAIN/bin/cjc" 2>/dev/null; then status=$((status | 1)); fi
+if touch "$PROBE_TOOLCHAIN/planted" 2>/dev/null; then status=$((status | 2)); fi
+if ls "$PROBE_SIBLING" >/dev/null 2>&1; then status=$((status | 4)); fi
+if cat "$PROBE_SIBLING/main.cj" >/dev/null 2>&1; then status=$((status | 8)); fi
+if ! echo ok > "$PWD/output.txt"; then status=$((status | 16)); fi
+exit $status
+`), 0o755); err != nil {
+		t.Fatalf("write learner probe: %v", err)
+	}
+	sandbox := &learnerSandbox{credential: nextLearnerCredential()}
+	if err := grantLearnerDirectory(requestDirectory, sandbox.credential); err != nil {
+		t.Fatalf("grant request directory: %v", err)
+	}
+
+	result, err := runProcess(context.Background(), processSpec{
+		executable: probe,
+		environment: append(
+			runtimeEnvironment(requestDirectory),
+			"PROBE_TOOLCHAIN="+toolchain,
+			"PROBE_SIBLING="+sibling,
+		),
+		workingDirectory: requestDirectory,
+		timeout:          5 * time.Second,
+		sandbox:          sandbox,
+	}, "run learner binary")
+	if err != nil {
+		t.Fatalf("run learner probe: %v", err)
+	}
+	if result.exitCode != 0 {
+		t.Fatalf("learner probe violation mask = %d (1,2: toolchain writable; 4,8: sibling readable; 16: request directory read-only); stderr=%q",
+			result.exitCode, result.stderr.content)
+	}
+	content, err := os.ReadFile(compiler)
+	if err != nil || string(content) != "#!/bin/sh\n" {
+		t.Fatalf("toolchain stand-in changed: %q, %v", content, err)
+	}
+}
+
+func TestMacroConsumingBuildStepsRunAsTheLearner(t *testing.T) {
+	useLearnerReachableLauncher(t)
+	root := learnerReachableTempDir(t)
+	secret := filepath.Join(root, "runner-secret")
+	if err := os.WriteFile(secret, []byte("token"), 0o600); err != nil {
+		t.Fatalf("write runner secret: %v", err)
+	}
+	compiler := filepath.Join(root, "cjc")
+	previous := buildCompilerExecutable
+	buildCompilerExecutable = compiler
+	t.Cleanup(func() { buildCompilerExecutable = previous })
+	writeCompiler := func(script string) {
+		t.Helper()
+		if err := os.WriteFile(compiler, []byte(script), 0o755); err != nil {
+			t.Fatalf("write compiler stand-in: %v", err)
+		}
+	}
+	build := runReq{
+		Code: "main() {}",
+		Packages: []packageRequest{
+			{Name: "macros", OutputType: packageOutputMacro, Sources: []packageSource{{Path: "m.cj", Content: "macro package macros"}}},
+			{Name: "lib", OutputType: packageOutputStaticlib, Sources: []packageSource{{Path: "l.cj", Content: "package lib"}}},
+		},
+	}
+	compile := func(in runReq) runMessage {
+		t.Helper()
+		requestDirectory, err := os.MkdirTemp(root, "run-")
+		if err != nil {
+			t.Fatalf("create request directory: %v", err)
+		}
+		if err := writePackageSources(requestDirectory, in.Packages); err != nil {
+			t.Fatalf("write package sources: %v", err)
+		}
+		msg, err := compileRequest(context.Background(), requestDirectory, in, nextLearnerCredential())
+		if err != nil {
+			t.Fatalf("compile request: %v", err)
+		}
+		return msg
+	}
+
+	// The macro package's own compile loads no macros and stays trusted.
+	writeCompiler(`#!/bin/sh
+case " $* " in *" --compile-macro "*) exit 0 ;; esac
+id -u
+if cat "` + secret + `" 2>/dev/null; then exit 1; fi
+if touch "` + root + `/planted" 2>/dev/null; then exit 2; fi
+exit 0
+`)
+	msg := compile(build)
+	if msg.CompilerCode != 0 || len(msg.BuildSteps) != 3 {
+		t.Fatalf("macro consumer reached runner files: code=%d steps=%+v output=%q",
+			msg.CompilerCode, msg.BuildSteps, msg.CompilerOutput)
+	}
+	for _, uid := range strings.Fields(msg.CompilerOutput) {
+		if id, err := strconv.Atoi(uid); err != nil || id < learnerIDBase {
+			t.Fatalf("macro consumer ran as uid %q", uid)
+		}
+	}
+
+	// A macro that never returns is the learner's timeout.
+	writeCompiler(`#!/bin/sh
+case " $* " in *" --compile-macro "*) exit 0 ;; esac
+exec sleep 10
+`)
+	build.CompileTimeoutMs = 300
+	if msg := compile(build); msg.CompilerCode != -1 || !strings.Contains(msg.CompilerOutput, "[killed: exceeded") {
+		t.Fatalf("endless macro = code %d output %q", msg.CompilerCode, msg.CompilerOutput)
+	}
+}
+
+func TestVerifyLearnerSandboxRunsUnderLearnerIdentity(t *testing.T) {
+	useLearnerReachableLauncher(t)
+	if _, err := os.Stat(learnerSandboxProbePath); err != nil {
+		t.Skipf("identity probe unavailable: %v", err)
+	}
+	if err := verifyLearnerSandbox(context.Background()); err != nil {
+		t.Fatalf("verify learner sandbox: %v", err)
+	}
+}
+
+func TestDeterministicSandboxDisablesAddressRandomization(t *testing.T) {
+	for _, disableASLR := range []bool{false, true} {
+		spec := testProbeSpec(t, "personality", &learnerSandbox{disableASLR: disableASLR})
+		if disableASLR {
+			spec.environment = append(spec.environment, deterministicEnvironment...)
+		}
+		result, err := runProcess(context.Background(), spec, "run learner binary")
+		if err != nil {
+			t.Fatalf("run personality probe: %v", err)
+		}
+		lines := strings.Split(result.stdout.content, "\n")
+		if result.exitCode != 0 || len(lines) < 2 {
+			t.Fatalf("probe exit=%d stdout=%q stderr=%q", result.exitCode, result.stdout.content, result.stderr.content)
+		}
+		persona, err := strconv.ParseUint(strings.TrimSpace(lines[0]), 16, 32)
+		if err != nil {
+			t.Fatalf("parse personality %q: %v", lines[0], err)
+		}
+		if got := persona&addrNoRandomize != 0; got != disableASLR {
+			t.Fatalf("ADDR_NO_RANDOMIZE = %t, want %t", got, disableASLR)
+		}
+		if disableASLR && lines[1] != "UTC" {
+			t.Fatalf("deterministic TZ = %q, want UTC", lines[1])
+		}
+	}
+}
+
+func TestRunRequestDeterministicOptIn(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseCompile, CompilerCode: 1}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost,
+		"/run",
+		"application/json",
+		`{"code":"main() {}","deterministic":true}`,
+	))
+	if recorder.Code != http.StatusOK || !received.Deterministic {
+		t.Fatalf("deterministic request status=%d received=%+v", recorder.Code, received)
+	}
+
+	knobs := deterministicKnobs()
+	for _, required := range []string{"TZ=UTC", "cjProcessorNum=1", "aslr=disabled"} {
+		if !slices.Contains(knobs, required) {
+			t.Fatalf("deterministic knobs %q omit %q", knobs, required)
+		}
+	}
+	for _, knob := range knobs {
+		name, _, _ := strings.Cut(knob, "=")
+		if strings.Contains(strings.ToLower(name), "seed") || strings.Contains(strings.ToLower(name), "clock") {
+			t.Fatalf("deterministic knobs claim an unsupported override: %q", knob)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type sanitizerKind string
+
+const (
+	sanitizerAddress sanitizerKind = "address"
+	sanitizerThread  sanitizerKind = "thread"
+)
+
+const (
+	cangjieRuntimeLibraryDirectory = "/cangjie/runtime/lib/linux_x86_64_cjnative"
+	maxSanitizerReports            = 16
+	maxSanitizerFrames             = 64
+	maxSanitizerTextBytes          = 1024
+)
+
+// sanitizerRuntimeDirectories name the sanitizer variants of the Cangjie
+// runtime. Only sanitizer-enabled SDK builds ship them, so their presence is
+// what "the toolchain supports it" means for a request.
+var sanitizerRuntimeDirectories = map[sanitizerKind]string{
+	sanitizerAddress: filepath.Join(cangjieRuntimeLibraryDirectory, "asan"),
+	sanitizerThread:  filepath.Join(cangjieRuntimeLibraryDirectory, "tsan"),
+}
+
+var errSanitizerUnavailable = errors.New("the installed toolchain has no runtime for the requested sanitizer")
+
+type sanitizerFrame struct {
+	Index    int    `json:"index"`
+	Function string `json:"function,omitempty"`
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Module   string `json:"module,omitempty"`
+}
+
+type sanitizerReport struct {
+	Sanitizer string           `json:"sanitizer"`
+	Kind      string           `json:"kind"`
+	Summary   string           `json:"summary,omitempty"`
+	Frames    []sanitizerFrame `json:"frames"`
+}
+
+// sanitizerAvailable reports whether the sanitizer runtime is installed.
+func sanitizerAvailable(kind sanitizerKind) bool {
+	info, err := os.Stat(sanitizerRuntimeDirectories[kind])
+	return err == nil && info.IsDir()
+}
+
+func sanitizerArguments(kind sanitizerKind) []string {
+	return []string{"--sanitize=" + string(kind)}
+}
+
+// sanitizerLibraryEnvironment loads the sanitizer runtime ahead of the
+// regular one for the learner binary.
+func sanitizerLibraryEnvironment(environment []string, kind sanitizerKind) []string {
+	adjusted := slices.Clone(environment)
+	for index, entry := range adjusted {
+		if value, ok := strings.CutPrefix(entry, "LD_LIBRARY_PATH="); ok {
+			adjusted[index] = "LD_LIBRARY_PATH=" + sanitizerRuntimeDirectories[kind] + ":" + value
+		}
+	}
+	return adjusted
+}
+
+var (
+	// "==123==ERROR: AddressSanitizer: heap-buffer-overflow on address ..."
+	sanitizerErrorLine = regexp.MustCompile(`^==\d+==ERROR: (\w+Sanitizer): (.+)$`)
+	// "WARNING: ThreadSanitizer: data race (pid=123)"
+	sanitizerWarningLine = regexp.MustCompile(`^WARNING: (\w+Sanitizer): (.+?)(?: \(pid=\d+\))?$`)
+	sanitizerSummaryLine = regexp.MustCompile(`^SUMMARY: (\w+Sanitizer): (.+)$`)
+	// "#0 0x4f5e2b in foo /dir/main.cj:12:5" or "#2 0x7f in bar (/lib/libc.so.6+0x29d90)"
+	sanitizerFrameLine = regexp.MustCompile(`^#(\d+)(?: 0x[0-9a-fA-F]+)?(?: in)? (\S+)(?: (.+))?$`)
+	sanitizerLocation  = regexp.MustCompile(`^(.+?):(\d+)(?::(\d+))?(?: \((.+)\))?$`)
+)
+
+// parseSanitizerReports turns sanitizer stderr into structured reports. Frames
+// belong to the most recent report header; request paths are made relative so
+// learners see main.cj rather than the scratch directory.
+func parseSanitizerReports(stderr, requestDirectory string, limit int) []sanitizerReport {
+	var reports []sanitizerReport
+	scanner := bufio.NewScanner(strings.NewReader(stderr))
+	scanner.Buffer(make([]byte, 0, 64*1024), limit)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if match := sanitizerErrorLine.FindStringSubmatch(line); match != nil {
+			if len(reports) == maxSanitizerReports {
+				break
+			}
+			reports = append(reports, newSanitizerReport(match[1], match[2]))
+			continue
+		}
+		if match := sanitizerWarningLine.FindStringSubmatch(line); match != nil {
+			if len(reports) == maxSanitizerReports {
+				break
+			}
+			reports = append(reports, newSanitizerReport(match[1], match[2]))
+			continue
+		}
+		if len(reports) == 0 {
+			continue
+		}
+		current := &reports[len(reports)-1]
+		if match := sanitizerSummaryLine.FindStringSubmatch(line); match != nil {
+			current.Summary = validUTF8Within(
+				strings.ReplaceAll(match[2], requestDirectory+"/", ""),
+				maxSanitizerTextBytes,
+			)
+			continue
+		}
+		if match := sanitizerFrameLine.FindStringSubmatch(line); match != nil && len(current.Frames) < maxSanitizerFrames {
+			current.Frames = append(current.Frames, parseSanitizerFrame(match, requestDirectory))
+		}
+	}
+	return reports
+}
+
+func newSanitizerReport(sanitizer, description string) sanitizerReport {
+	kind := description
+	for _, separator := range []string{" on address", " on unknown address", ":"} {
+		kind, _, _ = strings.Cut(kind, separator)
+	}
+	if sanitizer == "LeakSanitizer" {
+		kind = "memory-leak"
+	}
+	return sanitizerReport{
+		Sanitizer: sanitizer,
+		Kind:      validUTF8Within(strings.ReplaceAll(strings.TrimSpace(kind), " ", "-"), maxSanitizerTextBytes),
+		Frames:    []sanitizerFrame{},
+	}
+}
+
+func parseSanitizerFrame(match []string, requestDirectory string) sanitizerFrame {
+	index, _ := strconv.Atoi(match[1])
+	frame := sanitizerFrame{Index: index, Function: validUTF8Within(match[2], maxSanitizerTextBytes)}
+	location := match[3]
+	if module, ok := strings.CutPrefix(location, "("); ok {
+		// Frames without debug info only name the module and offset.
+		frame.Module = strings.TrimSuffix(module, ")")
+		return frame
+	}
+	if parts := sanitizerLocation.FindStringSubmatch(location); parts != nil {
+		frame.File = parts[1]
+		frame.Line, _ = strconv.Atoi(parts[2])
+		frame.Column, _ = strconv.Atoi(parts[3])
+		frame.Module = parts[4]
+	} else {
+		frame.File = location
+	}
+	if relative, ok := strings.CutPrefix(frame.File, requestDirectory+"/"); ok {
+		frame.File = relative
+	}
+	frame.File = validUTF8Within(frame.File, maxSanitizerTextBytes)
+	frame.Module = validUTF8Within(frame.Module, maxSanitizerTextBytes)
+	return frame
+}
@@ -0,0 +1,157 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseSanitizerReportsAddressSanitizer(t *testing.T) {
+	stderr := `hello
+=================================================================
+==4242==ERROR: AddressSanitizer: heap-buffer-overflow on address 0x602000000014 at pc 0x55d0 bp 0x7ffc sp 0x7ffc
+READ of size 4 at 0x602000000014 thread T0
+    #0 0x55d0a1 in default::readPast() /playground/run-7/main.cj:5:12
+    #1 0x55d0b2 in default::main() /playground/run-7/main.cj:9
+    #2 0x7f1 in __libc_start_main (/lib/x86_64-linux-gnu/libc.so.6+0x29d90)
+SUMMARY: AddressSanitizer: heap-buffer-overflow /playground/run-7/main.cj:5:12 in default::readPast()
+==4242==ABORTING
+`
+	reports := parseSanitizerReports(stderr, "/playground/run-7", maxSerializedOutputBytes)
+	want := []sanitizerReport{{
+		Sanitizer: "AddressSanitizer",
+		Kind:      "heap-buffer-overflow",
+		Summary:   "heap-buffer-overflow main.cj:5:12 in default::readPast()",
+		Frames: []sanitizerFrame{
+			{Index: 0, Function: "default::readPast()", File: "main.cj", Line: 5, Column: 12},
+			{Index: 1, Function: "default::main()", File: "main.cj", Line: 9},
+			{Index: 2, Function: "__libc_start_main", Module: "/lib/x86_64-linux-gnu/libc.so.6+0x29d90"},
+		},
+	}}
+	if fmt.Sprintf("%+v", reports) != fmt.Sprintf("%+v", want) {
+		t.Fatalf("reports = %+v, want %+v", reports, want)
+	}
+}
+
+func TestParseSanitizerReportsThreadAndLeakSanitizer(t *testing.T) {
+	stderr := `==================
+WARNING: ThreadSanitizer: data race (pid=17)
+  Write of size 8 at 0x7b04 by thread T1:
+    #0 default::bump() /playground/run-2/main.cj:3:5 (main+0x1234)
+==================
+==17==ERROR: LeakSanitizer: detected memory leaks
+Direct leak of 8 byte(s) in 1 object(s) allocated from:
+    #0 0x4a in malloc (/cangjie/runtime/lib/linux_x86_64_cjnative/asan/libclang_rt.asan.so+0x1)
+`
+	reports := parseSanitizerReports(stderr, "/playground/run-2", maxSerializedOutputBytes)
+	if len(reports) != 2 {
+		t.Fatalf("reports = %+v", reports)
+	}
+	race := reports[0]
+	if race.Sanitizer != "ThreadSanitizer" || race.Kind != "data-race" || len(race.Frames) != 1 ||
+		race.Frames[0] != (sanitizerFrame{Function: "default::bump()", File: "main.cj", Line: 3, Column: 5, Module: "main+0x1234"}) {
+		t.Fatalf("race report = %+v", race)
+	}
+	if leak := reports[1]; leak.Sanitizer != "LeakSanitizer" || leak.Kind != "memory-leak" ||
+		len(leak.Frames) != 1 || leak.Frames[0].Function != "malloc" {
+		t.Fatalf("leak report = %+v", leak)
+	}
+}
+
+func TestParseSanitizerReportsCapsReportsAndFrames(t *testing.T) {
+	var stderr strings.Builder
+	for report := 0; report <= maxSanitizerReports; report++ {
+		stderr.WriteString("==1==ERROR: AddressSanitizer: SEGV on unknown address 0x0\n")
+		for frame := 0; frame <= maxSanitizerFrames; frame++ {
+			fmt.Fprintf(&stderr, "    #%d 0x1 in f /playground/run-1/main.cj:%d\n", frame, frame+1)
+		}
+	}
+	reports := parseSanitizerReports(stderr.String(), "/playground/run-1", maxSerializedOutputBytes)
+	if len(reports) != maxSanitizerReports || reports[0].Kind != "SEGV" ||
+		len(reports[0].Frames) != maxSanitizerFrames {
+		t.Fatalf("reports = %d, frames = %d", len(reports), len(reports[0].Frames))
+	}
+	if reports := parseSanitizerReports("plain output\n", "/playground/run-1", maxSerializedOutputBytes); reports != nil {
+		t.Fatalf("reports without sanitizer output = %+v", reports)
+	}
+}
+
+func TestParseSanitizerReportsHonoursTheOutputLimit(t *testing.T) {
+	stderr := strings.Repeat("x", 100*1024) + "\n==1==ERROR: AddressSanitizer: SEGV on unknown address 0x0\n"
+	if reports := parseSanitizerReports(stderr, "/playground/run-1", 200*1024); len(reports) != 1 {
+		t.Fatalf("reports within the limit = %+v", reports)
+	}
+	if reports := parseSanitizerReports(stderr, "/playground/run-1", 64*1024); reports != nil {
+		t.Fatalf("reports past a line over the limit = %+v", reports)
+	}
+}
+
+func TestBuildPlanSanitizesEveryLinkedPackage(t *testing.T) {
+	plan := buildPlan("/playground/run-1", runReq{
+		Mode:      runModeSanitize,
+		Sanitizer: sanitizerThread,
+		Packages: []packageRequest{
+			{Name: "macros", OutputType: packageOutputMacro},
+			{Name: "util", OutputType: packageOutputStaticlib},
+		},
+	})
+	for _, planned := range plan {
+		sanitized := slices.Contains(planned.arguments, "--sanitize=thread")
+		if sanitized == (planned.step.OutputType == packageOutputMacro) {
+			t.Fatalf("%s arguments = %q", planned.step.Package, planned.arguments)
+		}
+	}
+	if arguments := buildPlan("/playground/run-1", runReq{Mode: runModeSanitize})[0].arguments; !slices.Contains(arguments, "--sanitize=address") {
+		t.Fatalf("default sanitizer arguments = %q", arguments)
+	}
+}
+
+func TestRunRequestSanitizeMode(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseRun}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost, "/run", "application/json",
+		`{"code":"main() {}","mode":"sanitize","sanitizer":"thread","stdin":"1"}`,
+	))
+	if recorder.Code != http.StatusOK || received.Mode != runModeSanitize ||
+		received.sanitizer() != sanitizerThread || received.Stdin != "1" {
+		t.Fatalf("status = %d received=%+v", recorder.Code, received)
+	}
+	for _, body := range []string{
+		`{"code":"","sanitizer":"address"}`,
+		`{"code":"","mode":"sanitize","sanitizer":"memory"}`,
+		`{"code":"","mode":"sanitize","sanitizer":null}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/run", "application/json", body))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestRunRequestReportsUnavailableSanitizer(t *testing.T) {
+	operations := testOperations()
+	operations.compileAndRun = func(context.Context, runReq) (runMessage, error) {
+		return runMessage{Phase: runPhaseCompile}, errSanitizerUnavailable
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost, "/run", "application/json", `{"code":"","mode":"sanitize"}`,
+	))
+	if recorder.Code != http.StatusUnprocessableEntity ||
+		!strings.Contains(recorder.Body.String(), `"code":"sanitizer_unavailable"`) {
+		t.Fatalf("status = %d body=%s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,127 @@
+//go:build linux && amd64
+
+package main
+
+import "syscall"
+
+const (
+	sysSeccomp             = 317
+	seccompAuditArchX86_64 = 0xc000003e
+	// Syscall numbers at or above this bit belong to the x32 ABI, which shares
+	// the x86-64 audit architecture and would otherwise bypass the deny list.
+	seccompX32SyscallBit = 0x40000000
+	seccompSocketSyscall = 41
+)
+
+// learnerDeniedSyscalls are x86-64 syscall numbers a playground program never
+// needs and that widen the kernel attack surface or observe other processes.
+var learnerDeniedSyscalls = []uint32{
+	101, // ptrace
+	103, // syslog
+	134, // uselib
+	153, // vhangup
+	155, // pivot_root
+	156, // _sysctl
+	161, // chroot
+	163, // acct
+	164, // settimeofday
+	165, // mount
+	166, // umount2
+	167, // swapon
+	168, // swapoff
+	169, // reboot
+	170, // sethostname
+	171, // setdomainname
+	172, // iopl
+	173, // ioperm
+	174, // create_module
+	175, // init_module
+	176, // delete_module
+	179, // quotactl
+	212, // lookup_dcookie
+	227, // clock_settime
+	246, // kexec_load
+	248, // add_key
+	249, // request_key
+	250, // keyctl
+	272, // unshare
+	298, // perf_event_open
+	300, // fanotify_init
+	303, // name_to_handle_at
+	304, // open_by_handle_at
+	308, // setns
+	310, // process_vm_readv
+	311, // process_vm_writev
+	312, // kcmp
+	313, // finit_module
+	320, // kexec_file_load
+	321, // bpf
+	323, // userfaultfd
+	425, // io_uring_setup
+	426, // io_uring_enter
+	427, // io_uring_register
+	428, // open_tree
+	429, // move_mount
+	430, // fsopen
+	431, // fsconfig
+	432, // fsmount
+	433, // fspick
+	442, // mount_setattr
+}
+
+// learnerSeccompFilter builds the run-phase BPF program. Denied calls kill the
+// whole process with SIGSYS so the runner can report the termination reason;
+// everything else, including ordinary sockets, is allowed. Classic BPF only
+// jumps forward, so the socket argument checks carry their own kill/allow pair.
+func learnerSeccompFilter() []syscall.SockFilter {
+	const (
+		loadWord  = syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS
+		jumpEqual = syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K
+		jumpAbove = syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K
+		andValue  = syscall.BPF_ALU | syscall.BPF_AND | syscall.BPF_K
+		returnK   = syscall.BPF_RET | syscall.BPF_K
+
+		// Offsets into struct seccomp_data. Argument words are little-endian,
+		// so the low 32 bits of args[n] sit at 16+8n.
+		offsetNumber = 0
+		offsetArch   = 4
+		offsetArg0   = 16
+		offsetArg1   = 24
+
+		socketTypeMask = 0xf
+	)
+
+	denied := len(learnerDeniedSyscalls)
+	filter := make([]syscall.SockFilter, 0, denied+16)
+	filter = append(filter,
+		syscall.SockFilter{Code: loadWord, K: offsetArch},
+		syscall.SockFilter{Code: jumpEqual, Jt: 1, K: seccompAuditArchX86_64},
+		syscall.SockFilter{Code: returnK, K: seccompRetKillProcess},
+		syscall.SockFilter{Code: loadWord, K: offsetNumber},
+		syscall.SockFilter{Code: jumpAbove, Jf: 1, K: seccompX32SyscallBit},
+		syscall.SockFilter{Code: returnK, K: seccompRetKillProcess},
+	)
+	for index, number := range learnerDeniedSyscalls {
+		// Skip the remaining comparisons, the socket check and the allow
+		// instruction to land on the shared kill instruction.
+		filter = append(filter, syscall.SockFilter{
+			Code: jumpEqual,
+			Jt:   uint8(denied - index + 1),
+			K:    number,
+		})
+	}
+	filter = append(filter,
+		syscall.SockFilter{Code: jumpEqual, Jt: 2, K: seccompSocketSyscall},
+		syscall.SockFilter{Code: returnK, K: seccompRetAllow},
+		syscall.SockFilter{Code: returnK, K: seccompRetKillProcess},
+		// socket(domain, type, protocol): deny packet and raw sockets.
+		syscall.SockFilter{Code: loadWord, K: offsetArg0},
+		syscall.SockFilter{Code: jumpEqual, Jt: 3, K: syscall.AF_PACKET},
+		syscall.SockFilter{Code: loadWord, K: offsetArg1},
+		syscall.SockFilter{Code: andValue, K: socketTypeMask},
+		syscall.SockFilter{Code: jumpEqual, Jf: 1, K: syscall.SOCK_RAW},
+		syscall.SockFilter{Code: returnK, K: seccompRetKillProcess},
+		syscall.SockFilter{Code: returnK, K: seccompRetAllow},
+	)
+	return filter
+}
@@ -0,0 +1,14 @@
+//go:build linux && !amd64
+
+package main
+
+import "syscall"
+
+// sysSeccomp is never invoked here because no filter program is produced.
+const sysSeccomp = 0
+
+// learnerSeccompFilter has no syscall table for this architecture, so the
+// launcher refuses seccomp requests instead of running them unfiltered.
+func learnerSeccompFilter() []syscall.SockFilter {
+	return nil
+}
@@ -0,0 +1,139 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Callers that know more about a request than the runner, such as whether
+// it comes from an enrolled student, may ask for other compile and run
+// deadlines. The headers and body fields are equivalent; text/plain bodies
+// can only use the headers.
+const (
+	compileTimeoutHeader = "X-Playground-Runner-Compile-Timeout-Ms"
+	runTimeoutHeader     = "X-Playground-Runner-Run-Timeout-Ms"
+)
+
+const (
+	minTimeBudget = 100 * time.Millisecond
+	// Operators may raise the ceilings up to these bounds. The Modal
+	// container's own timeout must cover the sum.
+	maxCompileTimeoutCeiling = 60 * time.Second
+	maxRunTimeoutCeiling     = 60 * time.Second
+)
+
+// timeBudget reports the deadlines a request ran under.
+type timeBudget struct {
+	CompileMs int64 `json:"compile_ms"`
+	RunMs     int64 `json:"run_ms"`
+}
+
+// compileTimeout is the compile deadline of the request.
+func (in runReq) compileTimeout() time.Duration {
+	if in.CompileTimeoutMs == 0 {
+		return in.serverLimits().CompileTimeout
+	}
+	return time.Duration(in.CompileTimeoutMs) * time.Millisecond
+}
+
+// runTimeout is the run deadline of the request.
+func (in runReq) runTimeout() time.Duration {
+	if in.RunTimeoutMs == 0 {
+		return in.serverLimits().RunTimeout
+	}
+	return time.Duration(in.RunTimeoutMs) * time.Millisecond
+}
+
+// serverLimits are the limits of the server that admitted the request.
+func (in runReq) serverLimits() runnerLimits {
+	return in.limits.orDefaults()
+}
+
+func (in runReq) hasTimeBudget() bool {
+	return in.CompileTimeoutMs != 0 || in.RunTimeoutMs != 0
+}
+
+func decodeTimeBudgetField(raw json.RawMessage, value *int, field string) error {
+	if err := decodeRequestField(raw, value, field+" must be an integer"); err != nil {
+		return err
+	}
+	if *value < 1 {
+		return errors.New(field + " must be positive")
+	}
+	return nil
+}
+
+// negotiateTimeBudget merges the budget headers into the request, holds the
+// budget to the configured ceilings, and moves the response write deadline
+// out by however much the budget exceeds the defaults. It writes the error
+// response itself on failure.
+func (s *runnerServer) negotiateTimeBudget(w http.ResponseWriter, r *http.Request, in *runReq) bool {
+	for _, budget := range []struct {
+		header  string
+		field   string
+		value   *int
+		ceiling time.Duration
+	}{
+		{compileTimeoutHeader, "compile_timeout_ms", &in.CompileTimeoutMs, s.config.limits.MaxCompileTimeout},
+		{runTimeoutHeader, "run_timeout_ms", &in.RunTimeoutMs, s.config.limits.MaxRunTimeout},
+	} {
+		values := r.Header.Values(budget.header)
+		if len(values) > 1 {
+			writeTimeBudgetError(w, "Send at most one "+budget.header+" header.")
+			return false
+		}
+		if len(values) == 1 {
+			milliseconds, err := strconv.Atoi(values[0])
+			if err != nil || milliseconds < 1 {
+				writeTimeBudgetError(w, budget.header+" must be a positive integer.")
+				return false
+			}
+			if *budget.value != 0 && *budget.value != milliseconds {
+				writeTimeBudgetError(w, budget.header+" and "+budget.field+" disagree.")
+				return false
+			}
+			*budget.value = milliseconds
+		}
+		if *budget.value == 0 {
+			continue
+		}
+		requested := time.Duration(*budget.value) * time.Millisecond
+		if requested < minTimeBudget || requested > budget.ceiling {
+			writeTimeBudgetError(w, fmt.Sprintf(
+				"%s must be %d-%d milliseconds.",
+				budget.field,
+				minTimeBudget.Milliseconds(),
+				budget.ceiling.Milliseconds(),
+			))
+			return false
+		}
+	}
+	if in.RunTimeoutMs != 0 && !in.Mode.runsProgram() {
+		writeTimeBudgetError(w, fmt.Sprintf("Mode %q does not run the program.", in.Mode))
+		return false
+	}
+
+	limits := s.config.limits
+	extension := (in.compileTimeout() - limits.CompileTimeout) + (in.runTimeout() - limits.RunTimeout)
+	if extension <= 0 {
+		return true
+	}
+	// Writers without deadlines, such as test recorders, cannot cut the
+	// response off either.
+	err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(limits.WriteTimeout + extension))
+	if err != nil && !errors.Is(err, http.ErrNotSupported) {
+		writeError(w, http.StatusInternalServerError, "runner_internal_error", "Runner operation failed.")
+		return false
+	}
+	return true
+}
+
+func writeTimeBudgetError(w http.ResponseWriter, message string) {
+	writeError(w, http.StatusBadRequest, "invalid_time_budget", message)
+}
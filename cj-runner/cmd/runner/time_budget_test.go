@@ -0,0 +1,140 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunRequestTimeBudget(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseRun}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost, "/run", "application/json", `{"code":"main() {}","run_timeout_ms":2000}`,
+	))
+	if recorder.Code != http.StatusOK || received.runTimeout() != 2*time.Second ||
+		received.compileTimeout() != compileTimeout ||
+		!strings.Contains(recorder.Body.String(), `"time_budget":{"compile_ms":12000,"run_ms":2000}`) {
+		t.Fatalf("status = %d received = %+v body = %s", recorder.Code, received, recorder.Body.String())
+	}
+
+	request := runnerRequest(http.MethodPost, "/run", "text/plain", "main() {}")
+	request.Header.Set(compileTimeoutHeader, "500")
+	recorder = httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || received.compileTimeout() != 500*time.Millisecond ||
+		!strings.Contains(recorder.Body.String(), `"time_budget":{"compile_ms":500,"run_ms":8000}`) {
+		t.Fatalf("status = %d received = %+v body = %s", recorder.Code, received, recorder.Body.String())
+	}
+}
+
+func TestRunRequestRejectsTimeBudgetsOutsideCeilings(t *testing.T) {
+	for _, test := range []struct {
+		body    string
+		headers map[string]string
+	}{
+		{`{"code":"","run_timeout_ms":8001}`, nil},
+		{`{"code":"","compile_timeout_ms":99}`, nil},
+		{`{"code":""}`, map[string]string{runTimeoutHeader: "60000"}},
+		{`{"code":""}`, map[string]string{compileTimeoutHeader: "fast"}},
+		{`{"code":""}`, map[string]string{runTimeoutHeader: "0"}},
+		{`{"code":"","run_timeout_ms":1000}`, map[string]string{runTimeoutHeader: "2000"}},
+		{`{"code":"","mode":"check"}`, map[string]string{runTimeoutHeader: "1000"}},
+	} {
+		request := runnerRequest(http.MethodPost, "/run", "application/json", test.body)
+		for name, value := range test.headers {
+			request.Header.Set(name, value)
+		}
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusBadRequest || responseError(t, recorder)["code"] != "invalid_time_budget" {
+			t.Fatalf("%s %v: status = %d body = %s", test.body, test.headers, recorder.Code, recorder.Body.String())
+		}
+	}
+	for _, body := range []string{
+		`{"code":"","run_timeout_ms":0}`,
+		`{"code":"","run_timeout_ms":"1000"}`,
+		`{"code":"","mode":"check","run_timeout_ms":1000}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/run", "application/json", body))
+		if recorder.Code != http.StatusBadRequest || responseError(t, recorder)["code"] != "invalid_json_body" {
+			t.Fatalf("%s status = %d body = %s", body, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestLoadRunnerConfigTimeoutCeilings(t *testing.T) {
+	base := map[string]string{
+		"CJ_RUNNER_ENV":              "production",
+		"CJ_RUNNER_SHARED_TOKEN":     testSharedToken,
+		"CJ_RUNNER_ISOLATION_DRIVER": "modal-single-use-container",
+	}
+	config, err := loadRunnerConfig(base)
+	if err != nil || config.limits.MaxCompileTimeout != compileTimeout || config.limits.MaxRunTimeout != runTimeout {
+		t.Fatalf("config = %+v, err = %v", config, err)
+	}
+	base["CJ_RUNNER_MAX_RUN_TIMEOUT_MS"] = "30000"
+	config, err = loadRunnerConfig(base)
+	if err != nil || config.limits.MaxRunTimeout != 30*time.Second {
+		t.Fatalf("config = %+v, err = %v", config, err)
+	}
+	for _, value := range []string{"5000", "60001", "30s"} {
+		base["CJ_RUNNER_MAX_RUN_TIMEOUT_MS"] = value
+		if _, err := loadRunnerConfig(base); err == nil {
+			t.Fatalf("run timeout ceiling %q was accepted", value)
+		}
+	}
+}
+
+func TestLongTimeBudgetExtendsWriteDeadline(t *testing.T) {
+	operations := testOperations()
+	operations.compileAndRun = func(context.Context, runReq) (runMessage, error) {
+		time.Sleep(300 * time.Millisecond)
+		return runMessage{Phase: runPhaseRun}, nil
+	}
+	limits := defaultRunnerLimits()
+	limits.MaxRunTimeout = maxRunTimeoutCeiling
+	server := httptest.NewUnstartedServer(newRunnerHandler(runnerConfig{
+		sharedToken:         testSharedToken,
+		toolchainLockSha256: testToolchainLockSHA256,
+		limits:              limits,
+	}, operations))
+	// Stands in for writeTimeout, which the budget must be able to outlast.
+	server.Config.WriteTimeout = 100 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	send := func(budget time.Duration) (*http.Response, error) {
+		request := runnerRequest(http.MethodPost, "/run", "text/plain", "main() {}")
+		request.RequestURI = ""
+		request.URL.Scheme, request.URL.Host = "http", strings.TrimPrefix(server.URL, "http://")
+		if budget != 0 {
+			request.Header.Set(runTimeoutHeader, strconv.FormatInt(budget.Milliseconds(), 10))
+		}
+		return server.Client().Do(request)
+	}
+	response, err := send(runTimeout + time.Second)
+	if err != nil {
+		t.Fatalf("extended budget response was cut off: %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", response.StatusCode)
+	}
+	if response, err := send(0); err == nil {
+		response.Body.Close()
+		t.Fatal("default budget outlived the write timeout")
+	}
+}
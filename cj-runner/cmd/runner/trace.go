@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"syscall"
+)
+
+const (
+	defaultTraceSteps = 200
+	maxTraceSteps     = 1000
+)
+
+// traceStep is one executed line of main.cj with the stack and locals as they
+// were before the line ran.
+type traceStep struct {
+	Line   int             `json:"line"`
+	Frames []debugFrame    `json:"frames"`
+	Locals []debugVariable `json:"locals"`
+}
+
+// runTrace runs the debug build under the debugger binary, stopping at every
+// line of main.cj until the program ends or the step budget is spent. A
+// program that did not finish reports exit code -1, as a timed-out run does.
+func runTrace(
+	ctx context.Context,
+	debugger, requestDirectory string,
+	in runReq,
+	credential *syscall.Credential,
+) (processResult, []traceStep, bool, error) {
+	message, err := runDebugger(ctx, debugger, requestDirectory, debugReq{
+		Stdin:     in.Stdin,
+		MaxStops:  in.traceSteps(),
+		EveryLine: true,
+		Timeout:   in.runTimeout(),
+		limits:    in.limits,
+	}, credential)
+	if err != nil {
+		return processResult{}, nil, false, err
+	}
+	result := processResult{
+		stdout:   outputChannel{content: message.BinStdout, truncated: message.BinStdoutTruncated},
+		stderr:   outputChannel{content: message.BinStderr, truncated: message.BinStderrTruncated},
+		exitCode: -1,
+		timedOut: message.TimedOut,
+	}
+	if message.BinCode != nil {
+		result.exitCode = *message.BinCode
+	}
+	return result, traceFromStops(message.Stops), message.StopsTruncated || message.TimedOut, nil
+}
+
+func traceFromStops(stops []debugStop) []traceStep {
+	steps := make([]traceStep, 0, len(stops))
+	for _, stop := range stops {
+		step := traceStep{Frames: stop.Frames, Locals: stop.Locals}
+		if len(stop.Frames) != 0 {
+			step.Line = stop.Frames[0].Line
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
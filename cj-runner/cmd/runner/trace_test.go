@@ -0,0 +1,111 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTraceFromStopsUsesInnermostLine(t *testing.T) {
+	stops := []debugStop{
+		{
+			Reason: "breakpoint 1.3",
+			Frames: []debugFrame{{Index: 0, Function: "default::main", File: "main.cj", Line: 3}},
+			Locals: []debugVariable{{Name: "n", Type: "Int64", Value: "2"}},
+		},
+		{Reason: "signal SIGSEGV", Frames: []debugFrame{}, Locals: []debugVariable{}},
+	}
+	steps := traceFromStops(stops)
+	if len(steps) != 2 || steps[0].Line != 3 || steps[0].Locals[0].Value != "2" || steps[1].Line != 0 {
+		t.Fatalf("steps = %+v", steps)
+	}
+}
+
+func TestTraceBreaksOnEveryLineOfMain(t *testing.T) {
+	_, commands := debugScript("/playground/run-1", debugReq{EveryLine: true, MaxStops: 2})
+	if !slices.Contains(commands, "breakpoint set --file main.cj --source-pattern-regexp .") {
+		t.Fatalf("commands = %q", commands)
+	}
+	if !slices.Contains(buildPlan("/playground/run-1", runReq{Mode: runModeTrace})[0].arguments, "-g") {
+		t.Fatal("trace build has no debug info")
+	}
+	if slices.Contains(buildPlan("/playground/run-1", runReq{})[0].arguments, "-g") {
+		t.Fatal("run build has debug info")
+	}
+}
+
+func TestRunRequestTraceMode(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseRun, Trace: []traceStep{{Line: 1, Frames: []debugFrame{}, Locals: []debugVariable{}}}}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost, "/run", "application/json",
+		`{"code":"main() {}","mode":"trace","trace_steps":50,"stdin":"1","output_files":["out.txt"]}`,
+	))
+	if recorder.Code != http.StatusOK || received.Mode != runModeTrace || received.traceSteps() != 50 ||
+		!strings.Contains(recorder.Body.String(), `"trace":[{"line":1,"frames":[],"locals":[]}]`) {
+		t.Fatalf("status = %d received=%+v body=%s", recorder.Code, received, recorder.Body.String())
+	}
+	if (runReq{Mode: runModeTrace}).traceSteps() != defaultTraceSteps {
+		t.Fatal("trace without a budget does not use the default")
+	}
+	for _, body := range []string{
+		`{"code":"","trace_steps":10}`,
+		`{"code":"","mode":"trace","trace_steps":0}`,
+		`{"code":"","mode":"trace","trace_steps":1001}`,
+		`{"code":"","mode":"trace","seccomp":true}`,
+		`{"code":"","mode":"trace","args":["a"]}`,
+		`{"code":"","mode":"trace","env":{"A":"1"}}`,
+		`{"code":"","mode":"debug"}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/run", "application/json", body))
+		if recorder.Code != http.StatusBadRequest {
+			t.Fatalf("%s status = %d, want %d", body, recorder.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestRunTraceKeepsTheConfiguredOutputLimit(t *testing.T) {
+	useLearnerReachableLauncher(t)
+	root := learnerReachableTempDir(t)
+	requestDirectory, err := os.MkdirTemp(root, "run-")
+	if err != nil {
+		t.Fatalf("create request directory: %v", err)
+	}
+	credential := nextLearnerCredential()
+	if err := grantLearnerDirectory(requestDirectory, credential); err != nil {
+		t.Fatalf("grant request directory: %v", err)
+	}
+	// The stand-in prints what cjdb prints for an exited program, and the
+	// program's stdout lands where the script's process launch sends it.
+	debugger := filepath.Join(root, "cjdb")
+	script := "#!/bin/sh\nhead -c 4096 /dev/zero | tr '\\0' x > " + debugStdoutName + "\n" +
+		"echo 'Process 1 exited with status = 0'\n"
+	if err := os.WriteFile(debugger, []byte(script), 0o755); err != nil {
+		t.Fatalf("write debugger stand-in: %v", err)
+	}
+	limits := defaultRunnerLimits()
+	limits.MaxOutputBytes = 1024
+	result, _, _, err := runTrace(
+		context.Background(), debugger, requestDirectory, runReq{Mode: runModeTrace, limits: limits}, credential,
+	)
+	if err != nil {
+		t.Fatalf("run trace: %v", err)
+	}
+	if !result.stdout.truncated || len(result.stdout.content) != limits.MaxOutputBytes {
+		t.Fatalf("stdout = %d bytes truncated=%t, want %d and true",
+			len(result.stdout.content), result.stdout.truncated, limits.MaxOutputBytes)
+	}
+}
@@ -0,0 +1,148 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"io"
+	"sync"
+	"time"
+)
+
+// transcriptChannel names the pipe a transcript chunk arrived on.
+type transcriptChannel string
+
+const (
+	transcriptStdout transcriptChannel = "stdout"
+	transcriptStderr transcriptChannel = "stderr"
+)
+
+const (
+	// maxTranscriptChunks bounds the per-chunk overhead of a program that
+	// alternates between its channels in a tight loop.
+	maxTranscriptChunks = 10_000
+	// Output arriving on one channel within transcriptMergeWindow of the
+	// chunk it follows joins that chunk.
+	transcriptMergeWindow = time.Millisecond
+)
+
+// transcriptChunk is program output in the order the runner read it from the
+// pipes, ElapsedMs after the program started. The order between channels is
+// the order of arrival, which a program writing without flushing can make
+// differ from the order of its writes.
+type transcriptChunk struct {
+	Channel   transcriptChannel `json:"channel"`
+	ElapsedMs float64           `json:"elapsed_ms"`
+	Text      string            `json:"text"`
+}
+
+// transcriptBytes caps the transcript's text, which is the same output as
+// the two channels and is held to one field's share of the budget.
+func (r outputRetention) transcriptBytes() int {
+	limit := cmp.Or(r.channelBytes, maxSerializedOutputBytes)
+	if r.combinedBytes != 0 {
+		limit = min(limit, r.combinedBytes)
+	}
+	return limit
+}
+
+// transcriptRecorder keeps the start of a process's interleaved output. Once
+// anything is dropped it records nothing more, so the transcript stays a
+// prefix of what the program wrote.
+type transcriptRecorder struct {
+	mu        sync.Mutex
+	started   time.Time
+	limit     int
+	used      int
+	chunks    []recordedChunk
+	truncated bool
+}
+
+type recordedChunk struct {
+	channel transcriptChannel
+	elapsed time.Duration
+	data    []byte
+}
+
+type transcriptWriter struct {
+	recorder *transcriptRecorder
+	channel  transcriptChannel
+}
+
+func (w transcriptWriter) Write(p []byte) (int, error) {
+	w.recorder.record(w.channel, p)
+	return len(p), nil
+}
+
+// writer records what is written to it as output on channel.
+func (t *transcriptRecorder) writer(channel transcriptChannel) io.Writer {
+	return transcriptWriter{recorder: t, channel: channel}
+}
+
+func (t *transcriptRecorder) record(channel transcriptChannel, p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.truncated || len(p) == 0 {
+		return
+	}
+	elapsed := time.Since(t.started)
+	keep := min(len(p), t.limit-t.used)
+	last := len(t.chunks) - 1
+	switch {
+	case keep <= 0:
+		t.truncated = true
+		return
+	case last >= 0 && t.chunks[last].channel == channel && elapsed-t.chunks[last].elapsed < transcriptMergeWindow:
+		t.chunks[last].data = append(t.chunks[last].data, p[:keep]...)
+	case len(t.chunks) == maxTranscriptChunks:
+		t.truncated = true
+		return
+	default:
+		t.chunks = append(t.chunks, recordedChunk{channel: channel, elapsed: elapsed, data: bytes.Clone(p[:keep])})
+	}
+	t.used += keep
+	t.truncated = keep < len(p)
+}
+
+// result returns the transcript as valid UTF-8 within the recorder's limit
+// and whether anything was left out. A rune split between two reads of a
+// channel is moved to the channel's next chunk. A nil recorder has no
+// transcript.
+func (t *transcriptRecorder) result() ([]transcriptChunk, bool) {
+	if t == nil {
+		return nil, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lastChunk := map[transcriptChannel]int{}
+	for i, chunk := range t.chunks {
+		lastChunk[chunk.channel] = i
+	}
+	chunks := make([]transcriptChunk, 0, len(t.chunks))
+	pending := map[transcriptChannel]string{}
+	remaining := t.limit
+	for i, chunk := range t.chunks {
+		data := pending[chunk.channel] + string(chunk.data)
+		end := len(data)
+		if i != lastChunk[chunk.channel] {
+			end = completeRunesEnd(data)
+		}
+		pending[chunk.channel] = data[end:]
+		text, used := validOutputPrefix(data[:end], remaining)
+		if text != "" {
+			chunks = append(chunks, transcriptChunk{
+				Channel:   chunk.channel,
+				ElapsedMs: float64(chunk.elapsed.Microseconds()) / 1000,
+				Text:      text,
+			})
+		}
+		remaining -= len(text)
+		if used < end {
+			return chunks, true
+		}
+	}
+	return chunks, t.truncated
+}
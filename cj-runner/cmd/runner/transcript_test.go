@@ -0,0 +1,133 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func transcriptTexts(chunks []transcriptChunk) []string {
+	texts := make([]string, 0, len(chunks))
+	for _, chunk := range chunks {
+		texts = append(texts, string(chunk.Channel)+":"+chunk.Text)
+	}
+	return texts
+}
+
+func TestTranscriptRecorderInterleavesChannels(t *testing.T) {
+	recorder := &transcriptRecorder{started: time.Now(), limit: 100}
+	stdout, stderr := recorder.writer(transcriptStdout), recorder.writer(transcriptStderr)
+	split := []byte("界")
+	_, _ = stdout.Write([]byte("a"))
+	_, _ = stdout.Write(split[:2])
+	_, _ = stderr.Write([]byte("warning"))
+	_, _ = stdout.Write(append(split[2:], '!'))
+	chunks, truncated := recorder.result()
+	want := []string{"stdout:a", "stderr:warning", "stdout:界!"}
+	if got := transcriptTexts(chunks); truncated || !slices.Equal(got, want) {
+		t.Fatalf("transcript = %q, truncated = %v", got, truncated)
+	}
+	for i := 1; i < len(chunks); i++ {
+		if chunks[i].ElapsedMs < chunks[i-1].ElapsedMs {
+			t.Fatalf("transcript timestamps go backwards: %+v", chunks)
+		}
+	}
+}
+
+func TestTranscriptRecorderKeepsAPrefixWithinItsLimits(t *testing.T) {
+	recorder := &transcriptRecorder{started: time.Now(), limit: 5}
+	_, _ = recorder.writer(transcriptStdout).Write([]byte("abc"))
+	_, _ = recorder.writer(transcriptStderr).Write([]byte("defg"))
+	_, _ = recorder.writer(transcriptStdout).Write([]byte("h"))
+	chunks, truncated := recorder.result()
+	if got := transcriptTexts(chunks); !truncated || !slices.Equal(got, []string{"stdout:abc", "stderr:de"}) {
+		t.Fatalf("transcript = %q, truncated = %v", got, truncated)
+	}
+
+	recorder = &transcriptRecorder{started: time.Now(), limit: maxSerializedOutputBytes}
+	for i := range maxTranscriptChunks + 1 {
+		channel := transcriptStdout
+		if i%2 == 1 {
+			channel = transcriptStderr
+		}
+		_, _ = recorder.writer(channel).Write([]byte("x"))
+	}
+	if chunks, truncated := recorder.result(); !truncated || len(chunks) != maxTranscriptChunks {
+		t.Fatalf("chunks = %d, truncated = %v", len(chunks), truncated)
+	}
+
+	var recorderless *transcriptRecorder
+	if chunks, truncated := recorderless.result(); chunks != nil || truncated {
+		t.Fatalf("nil recorder = %v, %v", chunks, truncated)
+	}
+}
+
+func TestRunProcessRecordsTranscript(t *testing.T) {
+	requestDirectory := t.TempDir()
+	probe := filepath.Join(requestDirectory, "probe")
+	if err := os.WriteFile(
+		probe,
+		[]byte("#!/bin/sh\nprintf 'first\\n'\nsleep 0.05\nprintf 'oops\\n' >&2\nsleep 0.05\nprintf 'last\\n'\n"),
+		0o700,
+	); err != nil {
+		t.Fatalf("write learner probe: %v", err)
+	}
+	result, err := runProcess(context.Background(), processSpec{
+		executable:       probe,
+		environment:      runtimeEnvironment(requestDirectory),
+		workingDirectory: requestDirectory,
+		timeout:          5 * time.Second,
+		transcript:       true,
+	}, "run learner binary")
+	if err != nil {
+		t.Fatalf("run learner probe: %v", err)
+	}
+	want := []string{"stdout:first\n", "stderr:oops\n", "stdout:last\n"}
+	if got := transcriptTexts(result.transcript); result.transcriptTruncated || !slices.Equal(got, want) {
+		t.Fatalf("transcript = %q, truncated = %v", got, result.transcriptTruncated)
+	}
+	if result.stdout.content != "first\nlast\n" || result.stderr.content != "oops\n" {
+		t.Fatalf("stdout = %q stderr = %q", result.stdout.content, result.stderr.content)
+	}
+	if result.transcript[2].ElapsedMs < 50 {
+		t.Fatalf("transcript timestamps = %+v", result.transcript)
+	}
+}
+
+func TestRunRequestTranscriptOptIn(t *testing.T) {
+	var received runReq
+	operations := testOperations()
+	operations.compileAndRun = func(_ context.Context, in runReq) (runMessage, error) {
+		received = in
+		return runMessage{Phase: runPhaseRun}, nil
+	}
+	recorder := httptest.NewRecorder()
+	testHandler(operations).ServeHTTP(recorder, runnerRequest(
+		http.MethodPost, "/run", "application/json", `{"code":"main() {}","transcript":true}`,
+	))
+	if recorder.Code != http.StatusOK || !received.Transcript {
+		t.Fatalf("status = %d received = %+v body = %s", recorder.Code, received, recorder.Body.String())
+	}
+	for _, body := range []string{
+		`{"code":"","transcript":"yes"}`,
+		`{"code":"","transcript":null}`,
+		`{"code":"","mode":"check","transcript":true}`,
+		`{"code":"","mode":"trace","transcript":true}`,
+	} {
+		recorder := httptest.NewRecorder()
+		testHandler(testOperations()).ServeHTTP(recorder, runnerRequest(http.MethodPost, "/run", "application/json", body))
+		if recorder.Code != http.StatusBadRequest || responseError(t, recorder)["code"] != "invalid_json_body" {
+			t.Fatalf("%s status = %d body = %s", body, recorder.Code, recorder.Body.String())
+		}
+	}
+	if !slices.Contains(capabilities(runnerConfig{limits: defaultRunnerLimits()}).Features, featureTranscript) {
+		t.Fatal("capabilities do not advertise transcripts")
+	}
+}
@@ -1,4 +1,4 @@
-import type { RunnerRunResponse } from './runner-contract'
+import type { RunnerProgramResponse } from './runner-contract'
 import { parseRunnerRunResponse } from './runner-contract'
 
 export interface RunnerRunOptions {
@@ -7,7 +7,7 @@ export interface RunnerRunOptions {
 }
 
 export interface RunnerClient {
-  run: (code: string, options?: RunnerRunOptions) => Promise<RunnerRunResponse>
+  run: (code: string, options?: RunnerRunOptions) => Promise<RunnerProgramResponse>
 }
 
 async function readRunnerError(response: Response): Promise<string> {
@@ -32,7 +32,7 @@ async function readRunnerError(response: Response): Promise<string> {
 async function requestRunner(
   code: string,
   options?: RunnerRunOptions,
-): Promise<RunnerRunResponse> {
+): Promise<RunnerProgramResponse> {
   const hasStdin = options?.stdin !== undefined
   const response = await fetch('/api/run', {
     method: 'POST',
@@ -53,7 +53,8 @@ async function requestRunner(
 
   const payload: unknown = await response.json()
   const parsed = parseRunnerRunResponse(payload)
-  if (!parsed)
+  // The gateway only forwards code and stdin, which never select check mode.
+  if (!parsed || parsed.phase === 'check')
     throw new Error('Remote action failed: runner returned an invalid response')
   return parsed
 }
@@ -43,4 +43,46 @@ describe('runner response contract', () => {
       bin_code: Number.MAX_SAFE_INTEGER + 1,
     })).toBeNull()
   })
+
+  it('accepts check responses and dump-mode compiles', () => {
+    const check = {
+      ...validRun,
+      phase: 'check',
+      bin_stdout: '',
+      bin_code: null,
+    } as const
+    expect(parseRunnerRunResponse(check)).toEqual(check)
+    expect(parseRunnerRunResponse({ ...check, compiler_code: 1 })).toEqual({ ...check, compiler_code: 1 })
+    expect(parseRunnerRunResponse({ ...check, bin_stdout: 'ran' })).toBeNull()
+
+    const compile = { ...check, phase: 'compile' } as const
+    expect(parseRunnerRunResponse(compile)).toBeNull()
+    const dumped = { ...compile, ir_dumps: [{ kind: 'chir', files: [], truncated: false }] }
+    expect(parseRunnerRunResponse(dumped)).toEqual(dumped)
+  })
+
+  it('passes optional fields through and validates them', () => {
+    const detailed = {
+      ...validRun,
+      termination_reason: 'exited',
+      output_files: [{ path: 'out.txt', encoding: 'utf-8', content: 'x', size: 1, truncated: false }],
+      output_files_truncated: false,
+      bin_stdout_omitted_bytes: 0,
+      transcript: [{ channel: 'stdout', elapsed_ms: 1, text: 'ok' }],
+    }
+    expect(parseRunnerRunResponse(detailed)).toEqual(detailed)
+    expect(parseRunnerRunResponse({ ...validRun, termination_reason: 1 })).toBeNull()
+    expect(parseRunnerRunResponse({
+      ...validRun,
+      output_files: [{ path: 'out.txt', encoding: 'utf-16', content: '', size: 0, truncated: false }],
+    })).toBeNull()
+  })
+
+  it('accepts version 2 responses and drops fields it does not know', () => {
+    const versioned = { ...validRun, protocol_version: 2 }
+    expect(parseRunnerRunResponse(versioned)).toEqual(versioned)
+    expect(parseRunnerRunResponse({ ...versioned, future_field: true })).toEqual(versioned)
+    expect(parseRunnerRunResponse({ ...validRun, protocol_version: 1 })).toBeNull()
+    expect(parseRunnerRunResponse({ ...validRun, protocol_version: 3 })).toBeNull()
+  })
 })
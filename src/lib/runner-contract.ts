@@ -7,7 +7,17 @@
  */
 export const MAX_RUNNER_OUTPUT_BYTES = 1_000_000
 
-export type RunnerExecutionPhase = 'compile' | 'run'
+/** Phases a `/run` response can report; check mode never reaches codegen. */
+export const RUNNER_EXECUTION_PHASES = ['compile', 'run', 'check'] as const
+
+export type RunnerExecutionPhase = typeof RUNNER_EXECUTION_PHASES[number]
+
+/**
+ * Response protocols the parser understands. Version 1 is the flat shape
+ * below; version 2 adds `protocol_version` and lets the runner add fields
+ * this parser does not know yet.
+ */
+export const RUNNER_PROTOCOL_VERSIONS = [1, 2] as const
 
 interface RunnerRunResponseBase {
   compiler_output: string
@@ -18,17 +28,63 @@ interface RunnerRunResponseBase {
   bin_stderr_truncated: boolean
 }
 
-export type RunnerRunResponse
-  = | RunnerRunResponseBase & {
+export interface RunnerOutputFile {
+  path: string
+  encoding: 'utf-8' | 'base64'
+  content: string
+  size: number
+  truncated: boolean
+}
+
+/**
+ * Fields the runner only sends to requests that opted into the feature that
+ * produces them. Their members are passed through as the runner sent them.
+ */
+export interface RunnerRunOptionalFields {
+  protocol_version?: number
+  termination_reason?: string
+  deterministic_knobs?: string[]
+  runtime_options?: Record<string, string>
+  output_files?: RunnerOutputFile[]
+  output_files_truncated?: boolean
+  build_steps?: Record<string, unknown>[]
+  macro_expansions?: RunnerOutputFile[]
+  macro_expansions_truncated?: boolean
+  ir_dumps?: Record<string, unknown>[]
+  coverage?: Record<string, unknown>[]
+  coverage_truncated?: boolean
+  sanitizer_reports?: Record<string, unknown>[]
+  benchmark?: Record<string, unknown>
+  trace?: Record<string, unknown>[]
+  trace_truncated?: boolean
+  time_budget?: Record<string, unknown>
+  output_budget?: Record<string, unknown>
+  bin_stdout_omitted_bytes?: number
+  bin_stderr_omitted_bytes?: number
+  transcript?: Record<string, unknown>[]
+  transcript_truncated?: boolean
+}
+
+export type RunnerRunResponse = RunnerRunOptionalFields & (
+  | RunnerRunResponseBase & {
     phase: 'compile'
     compiler_code: number
     bin_code: null
   }
+  | RunnerRunResponseBase & {
+    phase: 'check'
+    compiler_code: number
+    bin_code: null
+  }
   | RunnerRunResponseBase & {
     phase: 'run'
     compiler_code: 0
     bin_code: number
   }
+)
+
+/** A response to a request that compiles and runs the program. */
+export type RunnerProgramResponse = Exclude<RunnerRunResponse, { phase: 'check' }>
 
 export interface RunnerTruncationState {
   readonly compilerOutput: boolean
@@ -54,6 +110,30 @@ const RUN_RESPONSE_FIELDS = new Set([
   'bin_code',
 ])
 
+const OPTIONAL_RUN_RESPONSE_FIELDS = new Map<string, (value: unknown) => boolean>([
+  ['termination_reason', isString],
+  ['deterministic_knobs', isStringArray],
+  ['runtime_options', isStringRecord],
+  ['output_files', isOutputFileArray],
+  ['output_files_truncated', isBoolean],
+  ['build_steps', isObjectArray],
+  ['macro_expansions', isOutputFileArray],
+  ['macro_expansions_truncated', isBoolean],
+  ['ir_dumps', isObjectArray],
+  ['coverage', isObjectArray],
+  ['coverage_truncated', isBoolean],
+  ['sanitizer_reports', isObjectArray],
+  ['benchmark', isObject],
+  ['trace', isObjectArray],
+  ['trace_truncated', isBoolean],
+  ['time_budget', isObject],
+  ['output_budget', isObject],
+  ['bin_stdout_omitted_bytes', isSafeInteger],
+  ['bin_stderr_omitted_bytes', isSafeInteger],
+  ['transcript', isObjectArray],
+  ['transcript_truncated', isBoolean],
+])
+
 export function runnerOutputByteLength(value: string): number {
   return new TextEncoder().encode(value).byteLength
 }
@@ -67,28 +147,88 @@ function isObject(value: unknown): value is Record<string, unknown> {
   return value !== null && typeof value === 'object' && !Array.isArray(value)
 }
 
-function hasExactFields(
-  value: Record<string, unknown>,
-  fields: ReadonlySet<string>,
-): boolean {
-  const keys = Object.keys(value)
-  return keys.length === fields.size && keys.every(key => fields.has(key))
-}
-
 function isSafeInteger(value: unknown): value is number {
   return typeof value === 'number' && Number.isSafeInteger(value)
 }
 
+function isString(value: unknown): value is string {
+  return typeof value === 'string'
+}
+
+function isBoolean(value: unknown): value is boolean {
+  return typeof value === 'boolean'
+}
+
+function isStringArray(value: unknown): value is string[] {
+  return Array.isArray(value) && value.every(isString)
+}
+
+function isStringRecord(value: unknown): value is Record<string, string> {
+  return isObject(value) && Object.values(value).every(isString)
+}
+
+function isObjectArray(value: unknown): value is Record<string, unknown>[] {
+  return Array.isArray(value) && value.every(isObject)
+}
+
+function isOutputFile(value: unknown): value is RunnerOutputFile {
+  return isObject(value)
+    && typeof value.path === 'string'
+    && (value.encoding === 'utf-8' || value.encoding === 'base64')
+    && typeof value.content === 'string'
+    && isWithinRunnerOutputLimit(value.content)
+    && isSafeInteger(value.size)
+    && typeof value.truncated === 'boolean'
+}
+
+function isOutputFileArray(value: unknown): value is RunnerOutputFile[] {
+  return Array.isArray(value) && value.every(isOutputFile)
+}
+
+function isPhase(value: unknown): value is RunnerExecutionPhase {
+  return RUNNER_EXECUTION_PHASES.some(phase => phase === value)
+}
+
+/**
+ * Copy the optional fields the runner sent. Version 1 responses may carry
+ * only the fields this parser knows; version 2 responses may carry more,
+ * which are dropped.
+ */
+function parseOptionalFields(value: Record<string, unknown>): RunnerRunOptionalFields | null {
+  const optional: Record<string, unknown> = {}
+  const version = value.protocol_version
+  if (version !== undefined) {
+    if (version === 1 || !RUNNER_PROTOCOL_VERSIONS.some(known => known === version))
+      return null
+    optional.protocol_version = version
+  }
+  for (const [key, field] of Object.entries(value)) {
+    if (RUN_RESPONSE_FIELDS.has(key) || key === 'protocol_version')
+      continue
+    const isValid = OPTIONAL_RUN_RESPONSE_FIELDS.get(key)
+    if (!isValid) {
+      if (version === undefined)
+        return null
+      continue
+    }
+    if (!isValid(field))
+      return null
+    optional[key] = field
+  }
+  return optional as RunnerRunOptionalFields
+}
+
 /**
- * Parse the canonical successful `/run` response. Unknown or missing fields
- * are rejected so protocol drift cannot silently change evaluation semantics.
+ * Parse the canonical successful `/run` response. Missing required fields,
+ * and fields a version 1 response cannot carry, are rejected so protocol
+ * drift cannot silently change evaluation semantics.
  */
 export function parseRunnerRunResponse(value: unknown): RunnerRunResponse | null {
-  if (!isObject(value) || !hasExactFields(value, RUN_RESPONSE_FIELDS))
+  if (!isObject(value) || ![...RUN_RESPONSE_FIELDS].every(field => field in value))
     return null
 
   if (
-    (value.phase !== 'compile' && value.phase !== 'run')
+    !isPhase(value.phase)
     || typeof value.compiler_output !== 'string'
     || !isWithinRunnerOutputLimit(value.compiler_output)
     || typeof value.compiler_output_truncated !== 'boolean'
@@ -103,9 +243,23 @@ export function parseRunnerRunResponse(value: unknown): RunnerRunResponse | null
     return null
   }
 
-  if (value.phase === 'compile') {
+  const optional = parseOptionalFields(value)
+  if (!optional)
+    return null
+  const base: RunnerRunResponseBase = {
+    compiler_output: value.compiler_output,
+    compiler_output_truncated: value.compiler_output_truncated,
+    bin_stdout: value.bin_stdout,
+    bin_stdout_truncated: value.bin_stdout_truncated,
+    bin_stderr: value.bin_stderr,
+    bin_stderr_truncated: value.bin_stderr_truncated,
+  }
+
+  if (value.phase === 'compile' || value.phase === 'check') {
+    // A successful compile only ends the request in dump mode, which
+    // reports the dumps instead of running the program.
     if (
-      value.compiler_code === 0
+      (value.phase === 'compile' && value.compiler_code === 0 && optional.ir_dumps === undefined)
       || value.bin_stdout !== ''
       || value.bin_stdout_truncated
       || value.bin_stderr !== ''
@@ -115,14 +269,10 @@ export function parseRunnerRunResponse(value: unknown): RunnerRunResponse | null
       return null
     }
     return {
+      ...optional,
+      ...base,
       phase: value.phase,
-      compiler_output: value.compiler_output,
-      compiler_output_truncated: value.compiler_output_truncated,
       compiler_code: value.compiler_code,
-      bin_stdout: value.bin_stdout,
-      bin_stdout_truncated: value.bin_stdout_truncated,
-      bin_stderr: value.bin_stderr,
-      bin_stderr_truncated: value.bin_stderr_truncated,
       bin_code: value.bin_code,
     }
   }
@@ -130,14 +280,10 @@ export function parseRunnerRunResponse(value: unknown): RunnerRunResponse | null
   if (value.compiler_code !== 0 || !isSafeInteger(value.bin_code))
     return null
   return {
+    ...optional,
+    ...base,
     phase: value.phase,
-    compiler_output: value.compiler_output,
-    compiler_output_truncated: value.compiler_output_truncated,
     compiler_code: value.compiler_code,
-    bin_stdout: value.bin_stdout,
-    bin_stdout_truncated: value.bin_stdout_truncated,
-    bin_stderr: value.bin_stderr,
-    bin_stderr_truncated: value.bin_stderr_truncated,
     bin_code: value.bin_code,
   }
 }
@@ -1,5 +1,5 @@
 import type {
-  RunnerRunResponse,
+  RunnerProgramResponse,
 } from '@/lib/runner-contract'
 import type { RunnerClient } from '@/lib/runner-client'
 import { browserRunnerClient } from '@/lib/runner-client'
@@ -87,7 +87,7 @@ export async function runCangjieCode(code: string, deps: RunCangjieCodeDeps = {}
   const startedAt = now()
 
   try {
-    const data: RunnerRunResponse = await client.run(code, {
+    const data: RunnerProgramResponse = await client.run(code, {
       stdin: deps.stdin,
       signal: deps.signal,
     })